@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"golang.org/x/net/context"
+	bttdpb "google.golang.org/cloud/bigtable/internal/table_data_proto"
 	bttspb "google.golang.org/cloud/bigtable/internal/table_service_proto"
 	"google.golang.org/grpc"
 )
@@ -124,9 +125,40 @@ func (ac *AdminClient) DeleteColumnFamily(ctx context.Context, table, family str
 	return err
 }
 
+// RenameTable changes the name of a table.
+func (ac *AdminClient) RenameTable(ctx context.Context, table, newName string) error {
+	prefix := ac.clusterPrefix()
+	req := &bttspb.RenameTableRequest{
+		Name:  prefix + "/tables/" + table,
+		NewId: newName,
+	}
+	_, err := ac.tClient.RenameTable(ctx, req)
+	return err
+}
+
+// SetGCPolicy specifies which cells in a column family should be garbage collected.
+// GC executes opportunistically in the background; table reads may return data
+// matching the GC policy.
+func (ac *AdminClient) SetGCPolicy(ctx context.Context, table, family string, policy GCPolicy) error {
+	prefix := ac.clusterPrefix()
+	req := &bttdpb.ColumnFamily{
+		Name:         prefix + "/tables/" + table + "/columnFamilies/" + family,
+		GcExpression: policy.String(),
+	}
+	_, err := ac.tClient.UpdateColumnFamily(ctx, req)
+	return err
+}
+
 // TableInfo represents information about a table.
 type TableInfo struct {
-	Families []string
+	Families    []string
+	FamilyInfos []FamilyInfo
+}
+
+// FamilyInfo represents information about a column family.
+type FamilyInfo struct {
+	Name     string
+	GCPolicy string // the GC expression; empty if cells are never garbage collected
 }
 
 // TableInfo retrieves information about a table.
@@ -140,8 +172,9 @@ func (ac *AdminClient) TableInfo(ctx context.Context, table string) (*TableInfo,
 		return nil, err
 	}
 	ti := &TableInfo{}
-	for fam := range res.ColumnFamilies {
+	for fam, cf := range res.ColumnFamilies {
 		ti.Families = append(ti.Families, fam)
+		ti.FamilyInfos = append(ti.FamilyInfos, FamilyInfo{Name: fam, GCPolicy: cf.GcExpression})
 	}
 	return ti, nil
 }
@@ -134,6 +134,27 @@ func TestPrefix(t *testing.T) {
 	}
 }
 
+func TestGCPolicyString(t *testing.T) {
+	tests := []struct {
+		policy GCPolicy
+		want   string
+	}{
+		{MaxVersionsPolicy(3), "version() > 3"},
+		{MaxAgePolicy(72 * time.Hour), "age() > 3d"},
+		{MaxAgePolicy(90 * time.Minute), "age() > 90m"},
+		{MaxAgePolicy(1500 * time.Millisecond), "age() > 1500000"},
+		{
+			UnionPolicy(MaxVersionsPolicy(3), IntersectionPolicy(MaxAgePolicy(72*time.Hour), MaxVersionsPolicy(1))),
+			"(version() > 3) || ((age() > 3d) && (version() > 1))",
+		},
+	}
+	for _, tc := range tests {
+		if got := tc.policy.String(); got != tc.want {
+			t.Errorf("policy string = %q, want %q", got, tc.want)
+		}
+	}
+}
+
 var useProd = flag.String("use_prod", "", `if set to "proj,zone,cluster,table", run integration test against production`)
 
 func TestClientIntegration(t *testing.T) {
@@ -287,6 +308,19 @@ func TestClientIntegration(t *testing.T) {
 		}
 	}
 
+	// Check GC policies.
+
+	if err := adminClient.SetGCPolicy(ctx, table, "follows", MaxVersionsPolicy(1)); err != nil {
+		t.Fatalf("Setting GC policy: %v", err)
+	}
+	ti, err := adminClient.TableInfo(ctx, table)
+	if err != nil {
+		t.Fatalf("Getting table info: %v", err)
+	}
+	if want := []FamilyInfo{{Name: "follows", GCPolicy: "version() > 1"}}; !reflect.DeepEqual(ti.FamilyInfos, want) {
+		t.Errorf("Family infos = %+v, want %+v", ti.FamilyInfos, want)
+	}
+
 	// Check ReadModifyWrite.
 
 	if err := adminClient.CreateColumnFamily(ctx, table, "counter"); err != nil {
@@ -37,6 +37,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/google/btree"
 	"golang.org/x/net/context"
 	btdpb "google.golang.org/cloud/bigtable/internal/data_proto"
 	emptypb "google.golang.org/cloud/bigtable/internal/empty"
@@ -44,6 +45,7 @@ import (
 	bttdpb "google.golang.org/cloud/bigtable/internal/table_data_proto"
 	bttspb "google.golang.org/cloud/bigtable/internal/table_service_proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 // Server is an in-memory Cloud Bigtable fake.
@@ -98,13 +100,19 @@ func (s *Server) Close() {
 	s.l.Close()
 }
 
+// validID matches the table and column family IDs accepted by Cloud Bigtable.
+var validID = regexp.MustCompile(`^[_a-zA-Z0-9][-_.a-zA-Z0-9]*$`)
+
 func (s *server) CreateTable(ctx context.Context, req *bttspb.CreateTableRequest) (*bttdpb.Table, error) {
+	if !validID.MatchString(req.TableId) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid table ID %q", req.TableId)
+	}
 	tbl := req.Name + "/tables/" + req.TableId
 
 	s.mu.Lock()
 	if _, ok := s.tables[tbl]; ok {
 		s.mu.Unlock()
-		return nil, fmt.Errorf("table %q already exists", tbl)
+		return nil, grpc.Errorf(codes.AlreadyExists, "table %q already exists", tbl)
 	}
 	s.tables[tbl] = newTable()
 	s.mu.Unlock()
@@ -131,7 +139,7 @@ func (s *server) DeleteTable(ctx context.Context, req *bttspb.DeleteTableRequest
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, ok := s.tables[req.Name]; !ok {
-		return nil, fmt.Errorf("no such table %q", req.Name)
+		return nil, grpc.Errorf(codes.NotFound, "no such table %q", req.Name)
 	}
 	delete(s.tables, req.Name)
 	return &emptypb.Empty{}, nil
@@ -142,28 +150,154 @@ func (s *server) CreateColumnFamily(ctx context.Context, req *bttspb.CreateColum
 	tbl, ok := s.tables[req.Name]
 	s.mu.Unlock()
 	if !ok {
-		return nil, fmt.Errorf("no such table %q", req.Name)
+		return nil, grpc.Errorf(codes.NotFound, "no such table %q", req.Name)
 	}
 
-	// Check it is unique and record it.
+	// Check it is valid and unique, and record it.
 	fam := req.ColumnFamilyId
+	if !validID.MatchString(fam) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid family ID %q", fam)
+	}
 	tbl.mu.Lock()
 	defer tbl.mu.Unlock()
 	if _, ok := tbl.families[fam]; ok {
-		return nil, fmt.Errorf("family %q already exists", fam)
+		return nil, grpc.Errorf(codes.AlreadyExists, "family %q already exists", fam)
 	}
-	tbl.families[fam] = true
+	tbl.families[fam] = &columnFamily{}
 	return &bttdpb.ColumnFamily{
-		Name: req.Name + "/families/" + fam,
+		Name: req.Name + "/columnFamilies/" + fam,
 	}, nil
 }
 
+func (s *server) GetTable(ctx context.Context, req *bttspb.GetTableRequest) (*bttdpb.Table, error) {
+	s.mu.Lock()
+	tbl, ok := s.tables[req.Name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "no such table %q", req.Name)
+	}
+
+	res := &bttdpb.Table{
+		Name:           req.Name,
+		ColumnFamilies: make(map[string]*bttdpb.ColumnFamily),
+	}
+	tbl.mu.RLock()
+	for fam, cf := range tbl.families {
+		res.ColumnFamilies[fam] = &bttdpb.ColumnFamily{
+			Name:         req.Name + "/columnFamilies/" + fam,
+			GcExpression: cf.gcExpr,
+		}
+	}
+	tbl.mu.RUnlock()
+	return res, nil
+}
+
+func (s *server) RenameTable(ctx context.Context, req *bttspb.RenameTableRequest) (*emptypb.Empty, error) {
+	if !validID.MatchString(req.NewId) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid table ID %q", req.NewId)
+	}
+	i := strings.LastIndex(req.Name, "/tables/")
+	if i < 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "bad table name %q", req.Name)
+	}
+	newName := req.Name[:i] + "/tables/" + req.NewId
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tbl, ok := s.tables[req.Name]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "no such table %q", req.Name)
+	}
+	if _, ok := s.tables[newName]; ok {
+		return nil, grpc.Errorf(codes.AlreadyExists, "table %q already exists", newName)
+	}
+	delete(s.tables, req.Name)
+	s.tables[newName] = tbl
+	return &emptypb.Empty{}, nil
+}
+
+// lookupFamily returns the table and family ID named by a fully qualified column family name.
+func (s *server) lookupFamily(name string) (*table, string, error) {
+	i := strings.LastIndex(name, "/columnFamilies/")
+	if i < 0 {
+		return nil, "", grpc.Errorf(codes.InvalidArgument, "bad column family name %q", name)
+	}
+	tblName, fam := name[:i], name[i+len("/columnFamilies/"):]
+
+	s.mu.Lock()
+	tbl, ok := s.tables[tblName]
+	s.mu.Unlock()
+	if !ok {
+		return nil, "", grpc.Errorf(codes.NotFound, "no such table %q", tblName)
+	}
+	return tbl, fam, nil
+}
+
+func (s *server) UpdateColumnFamily(ctx context.Context, req *bttdpb.ColumnFamily) (*bttdpb.ColumnFamily, error) {
+	tbl, fam, err := s.lookupFamily(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+	cf, ok := tbl.families[fam]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "no such family %q", fam)
+	}
+	// GC expressions are recorded but not enforced.
+	cf.gcExpr = req.GcExpression
+	return &bttdpb.ColumnFamily{
+		Name:         req.Name,
+		GcExpression: cf.gcExpr,
+	}, nil
+}
+
+func (s *server) DeleteColumnFamily(ctx context.Context, req *bttspb.DeleteColumnFamilyRequest) (*emptypb.Empty, error) {
+	tbl, fam, err := s.lookupFamily(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []*row
+	tbl.mu.Lock()
+	if _, ok := tbl.families[fam]; !ok {
+		tbl.mu.Unlock()
+		return nil, grpc.Errorf(codes.NotFound, "no such family %q", fam)
+	}
+	delete(tbl.families, fam)
+	tbl.ascendRange("", "", func(r *row) bool {
+		rows = append(rows, r)
+		return true
+	})
+	tbl.mu.Unlock()
+
+	// Drop the family's cells.
+	prefix := fam + ":"
+	for _, r := range rows {
+		r.mu.Lock()
+		for col := range r.cells {
+			if strings.HasPrefix(col, prefix) {
+				delete(r.cells, col)
+			}
+		}
+		tbl.unlockRow(r)
+	}
+	return &emptypb.Empty{}, nil
+}
+
 func (s *server) ReadRows(req *btspb.ReadRowsRequest, stream btspb.BigtableService_ReadRowsServer) error {
 	s.mu.Lock()
 	tbl, ok := s.tables[req.TableName]
 	s.mu.Unlock()
 	if !ok {
-		return fmt.Errorf("no such table %q", req.TableName)
+		return grpc.Errorf(codes.NotFound, "no such table %q", req.TableName)
+	}
+	if req.NumRowsLimit < 0 {
+		return grpc.Errorf(codes.InvalidArgument, "negative num_rows_limit %d", req.NumRowsLimit)
+	}
+	if err := validateFilter(req.Filter); err != nil {
+		return err
 	}
 
 	var start, end string // half-open interval
@@ -175,61 +309,107 @@ func (s *server) ReadRows(req *btspb.ReadRowsRequest, stream btspb.BigtableServi
 		end = start + "\x00"
 	}
 
-	// Get rows to stream back.
-	tbl.mu.RLock()
-	si, ei := 0, len(tbl.rows) // half-open interval
-	if start != "" {
-		si = sort.Search(len(tbl.rows), func(i int) bool { return tbl.rows[i].key >= start })
-	}
-	if end != "" {
-		ei = sort.Search(len(tbl.rows), func(i int) bool { return tbl.rows[i].key >= end })
-	}
-	if si >= ei {
+	// Stream the rows back a chunk at a time, so that a large range is
+	// neither copied nor locked while it is sent, stopping at the limit.
+	var sent int64
+	for {
+		var rows []*row
+		tbl.mu.RLock()
+		tbl.ascendRange(start, end, func(r *row) bool {
+			rows = append(rows, r)
+			return len(rows) < readRowsChunk
+		})
 		tbl.mu.RUnlock()
-		return nil
-	}
-	rows := make([]*row, ei-si)
-	copy(rows, tbl.rows[si:ei])
-	tbl.mu.RUnlock()
 
-	for _, r := range rows {
-		if err := streamRow(stream, r, req.Filter); err != nil {
-			return err
+		for _, r := range rows {
+			ok, err := streamRow(stream, r, req.Filter)
+			if err != nil {
+				return err
+			}
+			if ok {
+				sent++
+			}
+			if req.NumRowsLimit > 0 && sent >= req.NumRowsLimit {
+				return nil
+			}
+		}
+		if len(rows) < readRowsChunk {
+			return nil
 		}
+		// Continue after the last row sent.
+		start = rows[len(rows)-1].key + "\x00"
 	}
-
-	return nil
 }
 
-func streamRow(stream btspb.BigtableService_ReadRowsServer, r *row, f *btdpb.RowFilter) error {
+// readRowsChunk is how many rows ReadRows collects under the table lock at once.
+const readRowsChunk = 100
+
+// maxResponseValueBytes is roughly how many bytes of cell values are put in a
+// single ReadRowsResponse. Larger rows are split over several responses,
+// as the real service does.
+const maxResponseValueBytes = 1 << 20
+
+// streamRow sends the cells of r that pass f, in family and qualifier order.
+// It reports whether anything was sent; rows with no matching cells are omitted.
+func streamRow(stream btspb.BigtableService_ReadRowsServer, r *row, f *btdpb.RowFilter) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	var cells []colCell
+	for _, cc := range sortCells(r.cells) {
+		if includeCell(f, r, cc.fam, cc.col, cc.cell) {
+			cells = append(cells, cc)
+		}
+	}
+	if len(cells) == 0 {
+		return false, nil
+	}
+
 	rrr := &btspb.ReadRowsResponse{
 		RowKey: []byte(r.key),
 	}
-	for col, cell := range r.cells {
-		i := strings.Index(col, ":") // guaranteed to exist
-		fam, col := col[:i], col[i+1:]
-		if !includeCell(f, r, fam, col, cell) {
-			continue
+	var fam *btdpb.Family // the family currently being added to rrr
+	size := 0
+	for _, cc := range cells {
+		if size > 0 && size+len(cc.cell.value) > maxResponseValueBytes {
+			if err := stream.Send(rrr); err != nil {
+				return false, err
+			}
+			rrr = &btspb.ReadRowsResponse{
+				RowKey: []byte(r.key),
+			}
+			fam, size = nil, 0
+		}
+		if fam == nil || fam.Name != cc.fam {
+			fam = &btdpb.Family{Name: cc.fam}
+			rrr.Chunks = append(rrr.Chunks, &btspb.ReadRowsResponse_Chunk{RowContents: fam})
 		}
 		// TODO(dsymonds): Apply transformers.
-		rrr.Chunks = append(rrr.Chunks, &btspb.ReadRowsResponse_Chunk{
-			RowContents: &btdpb.Family{
-				Name: fam,
-				Columns: []*btdpb.Column{{
-					Qualifier: []byte(col),
-					Cells: []*btdpb.Cell{{
-						// TODO: timestamp
-						Value: cell.value,
-					}},
-				}},
-			},
+		fam.Columns = append(fam.Columns, &btdpb.Column{
+			Qualifier: []byte(cc.col),
+			Cells: []*btdpb.Cell{{
+				// TODO: timestamp
+				Value: cc.cell.value,
+			}},
 		})
+		size += len(cc.cell.value)
 	}
 	rrr.Chunks = append(rrr.Chunks, &btspb.ReadRowsResponse_Chunk{CommitRow: true})
-	return stream.Send(rrr)
+	return true, stream.Send(rrr)
+}
+
+// validateFilter checks that f can be applied to a row.
+func validateFilter(f *btdpb.RowFilter) error {
+	if f == nil {
+		return nil
+	}
+	if len(f.ColumnQualifierRegexFilter) > 0 {
+		pat := string(f.ColumnQualifierRegexFilter)
+		if _, err := regexp.Compile(pat); err != nil {
+			return grpc.Errorf(codes.InvalidArgument, "bad column_qualifier_regex_filter pattern %q: %v", pat, err)
+		}
+	}
+	return nil
 }
 
 func includeCell(f *btdpb.RowFilter, r *row, fam, col string, cell cell) bool {
@@ -257,26 +437,54 @@ func (s *server) MutateRow(ctx context.Context, req *btspb.MutateRowRequest) (*e
 	tbl, ok := s.tables[req.TableName]
 	s.mu.Unlock()
 	if !ok {
-		return nil, fmt.Errorf("no such table %q", req.TableName)
+		return nil, grpc.Errorf(codes.NotFound, "no such table %q", req.TableName)
 	}
 
-	r := tbl.mutableRow(string(req.RowKey))
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	// Check the families before taking the row lock,
+	// so a bad mutation doesn't leave an empty row behind.
+	tbl.mu.RLock()
 	for _, mut := range req.Mutations {
+		var fam string
 		switch {
 		default:
-			return nil, fmt.Errorf("can't handle mutation %v", mut)
+			tbl.mu.RUnlock()
+			return nil, grpc.Errorf(codes.InvalidArgument, "can't handle mutation %v", mut)
 		case mut.SetCell != nil:
-			set := mut.SetCell
-			tbl.mu.RLock()
-			famOK := tbl.families[set.FamilyName]
+			fam = mut.SetCell.FamilyName
+		case mut.DeleteFromColumn != nil:
+			fam = mut.DeleteFromColumn.FamilyName
+		case mut.DeleteFromFamily != nil:
+			fam = mut.DeleteFromFamily.FamilyName
+		case mut.DeleteFromRow != nil:
+			continue
+		}
+		if _, ok := tbl.families[fam]; !ok {
 			tbl.mu.RUnlock()
-			if !famOK {
-				return nil, fmt.Errorf("unknown family %q", set.FamilyName)
-			}
+			return nil, grpc.Errorf(codes.NotFound, "unknown family %q", fam)
+		}
+	}
+	tbl.mu.RUnlock()
+
+	r := tbl.lockRow(string(req.RowKey))
+	defer tbl.unlockRow(r)
+	for _, mut := range req.Mutations {
+		switch {
+		case mut.SetCell != nil:
+			set := mut.SetCell
 			col := fmt.Sprintf("%s:%s", set.FamilyName, set.ColumnQualifier)
 			r.cells[col] = cell{value: set.Value}
+		case mut.DeleteFromColumn != nil:
+			del := mut.DeleteFromColumn
+			delete(r.cells, fmt.Sprintf("%s:%s", del.FamilyName, del.ColumnQualifier))
+		case mut.DeleteFromFamily != nil:
+			prefix := mut.DeleteFromFamily.FamilyName + ":"
+			for col := range r.cells {
+				if strings.HasPrefix(col, prefix) {
+					delete(r.cells, col)
+				}
+			}
+		case mut.DeleteFromRow != nil:
+			r.cells = make(map[string]cell)
 		}
 	}
 
@@ -288,113 +496,166 @@ func (s *server) ReadModifyWriteRow(ctx context.Context, req *btspb.ReadModifyWr
 	tbl, ok := s.tables[req.TableName]
 	s.mu.Unlock()
 	if !ok {
-		return nil, fmt.Errorf("no such table %q", req.TableName)
+		return nil, grpc.Errorf(codes.NotFound, "no such table %q", req.TableName)
 	}
 
+	tbl.mu.RLock()
+	for _, rule := range req.Rules {
+		if _, ok := tbl.families[rule.FamilyName]; !ok {
+			tbl.mu.RUnlock()
+			return nil, grpc.Errorf(codes.NotFound, "unknown family %q", rule.FamilyName)
+		}
+	}
+	tbl.mu.RUnlock()
+
 	updates := make(map[string]cell) // copy of updated cells; keyed by full column name
 
-	r := tbl.mutableRow(string(req.RowKey))
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r := tbl.lockRow(string(req.RowKey))
+	defer tbl.unlockRow(r)
+
+	// Compute all the updates before applying any, so a failed rule leaves the row untouched.
+	current := func(key string) cell {
+		if c, ok := updates[key]; ok {
+			return c
+		}
+		return r.cells[key]
+	}
 	for _, rule := range req.Rules {
 		key := fmt.Sprintf("%s:%s", rule.FamilyName, rule.ColumnQualifier)
 		if len(rule.AppendValue) > 0 {
-			r.cells[key] = cell{
-				value: append(r.cells[key].value, rule.AppendValue...),
+			val := current(key).value
+			updates[key] = cell{
+				value: append(val[:len(val):len(val)], rule.AppendValue...),
 			}
 		}
 		if rule.IncrementAmount != 0 {
 			var v int64
-			if val := r.cells[key].value; len(val) > 0 {
+			if val := current(key).value; len(val) > 0 {
 				if len(val) != 8 {
-					return nil, fmt.Errorf("increment on non-64-bit value")
+					return nil, grpc.Errorf(codes.FailedPrecondition, "increment on non-64-bit value in %s", key)
 				}
 				v = int64(binary.BigEndian.Uint64(val))
 			}
 			v += rule.IncrementAmount
 			var val [8]byte
 			binary.BigEndian.PutUint64(val[:], uint64(v))
-			r.cells[key] = cell{
+			updates[key] = cell{
 				value: val[:],
 			}
 		}
-		updates[key] = r.cells[key]
+	}
+	for key, c := range updates {
+		r.cells[key] = c
 	}
 
 	res := &btdpb.Row{
 		Key: req.RowKey,
 	}
-	for col, cell := range updates {
-		i := strings.Index(col, ":")
-		fam, qual := col[:i], col[i+1:]
-		var f *btdpb.Family
-		for _, ff := range res.Families {
-			if ff.Name == fam {
-				f = ff
-				break
-			}
-		}
-		if f == nil {
-			f = &btdpb.Family{Name: fam}
+	var f *btdpb.Family
+	for _, cc := range sortCells(updates) {
+		if f == nil || f.Name != cc.fam {
+			f = &btdpb.Family{Name: cc.fam}
 			res.Families = append(res.Families, f)
 		}
 		f.Columns = append(f.Columns, &btdpb.Column{
-			Qualifier: []byte(qual),
+			Qualifier: []byte(cc.col),
 			Cells: []*btdpb.Cell{{
-				Value: cell.value,
+				Value: cc.cell.value,
 			}},
 		})
 	}
 	return res, nil
 }
 
+// btreeDegree is the degree of the B-tree holding a table's rows.
+const btreeDegree = 16
+
 type table struct {
 	mu       sync.RWMutex
-	families map[string]bool // keyed by plain family name
-	rows     []*row          // sorted by row key
-	rowIndex map[string]*row // indexed by row key
+	families map[string]*columnFamily // keyed by plain family name
+	rows     *btree.BTree             // of *row, ordered by row key
 }
 
 func newTable() *table {
 	return &table{
-		families: make(map[string]bool),
-		rowIndex: make(map[string]*row),
+		families: make(map[string]*columnFamily),
+		rows:     btree.New(btreeDegree),
+	}
+}
+
+type columnFamily struct {
+	gcExpr string
+}
+
+// ascendRange calls f for each row in the half-open interval [start, end),
+// in row key order, until f returns false. An empty end means no upper bound.
+// t.mu must be held for reading.
+func (t *table) ascendRange(start, end string, f func(*row) bool) {
+	it := func(i btree.Item) bool { return f(i.(*row)) }
+	if end == "" {
+		t.rows.AscendGreaterOrEqual(rowKey(start), it)
+		return
 	}
+	t.rows.AscendRange(rowKey(start), rowKey(end), it)
 }
 
-func (t *table) mutableRow(row string) *row {
-	// Try fast path first.
-	t.mu.RLock()
-	r := t.rowIndex[row]
-	t.mu.RUnlock()
-	if r != nil {
-		return r
+// lockRow returns the row with the given key, creating it if necessary.
+// The row is returned locked; release it with unlockRow.
+func (t *table) lockRow(key string) *row {
+	for {
+		t.mu.RLock()
+		i := t.rows.Get(rowKey(key))
+		t.mu.RUnlock()
+
+		if i == nil {
+			// We probably need to create the row.
+			t.mu.Lock()
+			if i = t.rows.Get(rowKey(key)); i == nil {
+				i = newRow(key)
+				t.rows.ReplaceOrInsert(i)
+			}
+			t.mu.Unlock()
+		}
+
+		r := i.(*row)
+		r.mu.Lock()
+		if !r.removed {
+			return r
+		}
+		// The row was removed from the table while we waited for it.
+		r.mu.Unlock()
+	}
+}
+
+// unlockRow unlocks a row obtained from lockRow,
+// removing it from the table if it has no cells left.
+func (t *table) unlockRow(r *row) {
+	empty := len(r.cells) == 0
+	r.mu.Unlock()
+	if !empty {
+		return
 	}
 
-	// We probably need to create the row.
+	// Lock order is table then row, so recheck once both are held.
 	t.mu.Lock()
-	r = t.rowIndex[row]
-	if r == nil {
-		r = newRow(row)
-		t.rowIndex[row] = r
-		t.rows = append(t.rows, r)
-		sort.Sort(byRowKey(t.rows)) // yay, inefficient!
+	r.mu.Lock()
+	if len(r.cells) == 0 && !r.removed {
+		t.rows.Delete(r)
+		r.removed = true
 	}
+	r.mu.Unlock()
 	t.mu.Unlock()
-	return r
 }
 
-type byRowKey []*row
-
-func (b byRowKey) Len() int           { return len(b) }
-func (b byRowKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b byRowKey) Less(i, j int) bool { return b[i].key < b[j].key }
+// rowKey returns a btree.Item suitable for looking up the row with the given key.
+func rowKey(key string) btree.Item { return &row{key: key} }
 
 type row struct {
 	key string
 
-	mu    sync.Mutex
-	cells map[string]cell // keyed by full column name
+	mu      sync.Mutex
+	cells   map[string]cell // keyed by full column name
+	removed bool            // whether the row has been removed from its table
 }
 
 func newRow(key string) *row {
@@ -404,6 +665,38 @@ func newRow(key string) *row {
 	}
 }
 
+// Less implements btree.Item.
+func (r *row) Less(i btree.Item) bool { return r.key < i.(*row).key }
+
+// colCell is a cell together with its family and column qualifier.
+type colCell struct {
+	fam, col string
+	cell     cell
+}
+
+// sortCells returns the cells in m, keyed by full column name,
+// ordered by family and then by column qualifier.
+func sortCells(m map[string]cell) []colCell {
+	cells := make([]colCell, 0, len(m))
+	for col, c := range m {
+		i := strings.Index(col, ":") // guaranteed to exist
+		cells = append(cells, colCell{fam: col[:i], col: col[i+1:], cell: c})
+	}
+	sort.Sort(byFamilyAndColumn(cells))
+	return cells
+}
+
+type byFamilyAndColumn []colCell
+
+func (b byFamilyAndColumn) Len() int      { return len(b) }
+func (b byFamilyAndColumn) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byFamilyAndColumn) Less(i, j int) bool {
+	if b[i].fam != b[j].fam {
+		return b[i].fam < b[j].fam
+	}
+	return b[i].col < b[j].col
+}
+
 type cell struct {
 	value []byte
 	// TODO: timestamp, multiple values
@@ -0,0 +1,365 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bttest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	btdpb "google.golang.org/cloud/bigtable/internal/data_proto"
+	btspb "google.golang.org/cloud/bigtable/internal/service_proto"
+	bttspb "google.golang.org/cloud/bigtable/internal/table_service_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const testCluster = "projects/proj/zones/zone/clusters/cluster"
+
+// newTestServer returns a server with a table "t" that has a family "fam".
+func newTestServer(t *testing.T) (*server, string) {
+	s := &server{tables: make(map[string]*table)}
+	ctx := context.Background()
+	tbl, err := s.CreateTable(ctx, &bttspb.CreateTableRequest{Name: testCluster, TableId: "t"})
+	if err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+	if _, err := s.CreateColumnFamily(ctx, &bttspb.CreateColumnFamilyRequest{Name: tbl.Name, ColumnFamilyId: "fam"}); err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	return s, tbl.Name
+}
+
+func setCell(fam, col, value string) *btdpb.Mutation {
+	return &btdpb.Mutation{SetCell: &btdpb.Mutation_SetCell{
+		FamilyName:      fam,
+		ColumnQualifier: []byte(col),
+		Value:           []byte(value),
+	}}
+}
+
+// rowCollector is a BigtableService_ReadRowsServer that records the rows sent to it.
+type rowCollector struct {
+	grpc.ServerStream // nil; only Send is used
+	rows              []*btspb.ReadRowsResponse
+}
+
+func (rc *rowCollector) Send(res *btspb.ReadRowsResponse) error {
+	rc.rows = append(rc.rows, res)
+	return nil
+}
+
+func (rc *rowCollector) keys() []string {
+	var keys []string
+	for _, res := range rc.rows {
+		keys = append(keys, string(res.RowKey))
+	}
+	return keys
+}
+
+func TestRowOrder(t *testing.T) {
+	s, name := newTestServer(t)
+	ctx := context.Background()
+
+	const n = 10000
+	for _, i := range rand.Perm(n) {
+		req := &btspb.MutateRowRequest{
+			TableName: name,
+			RowKey:    []byte(fmt.Sprintf("row%05d", i)),
+			Mutations: []*btdpb.Mutation{setCell("fam", "col", "v")},
+		}
+		if _, err := s.MutateRow(ctx, req); err != nil {
+			t.Fatalf("MutateRow: %v", err)
+		}
+	}
+
+	rc := new(rowCollector)
+	req := &btspb.ReadRowsRequest{TableName: name, RowRange: &btdpb.RowRange{}}
+	if err := s.ReadRows(req, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	keys := rc.keys()
+	if len(keys) != n {
+		t.Fatalf("read %d rows, want %d", len(keys), n)
+	}
+	for i, key := range keys {
+		if want := fmt.Sprintf("row%05d", i); key != want {
+			t.Fatalf("row #%d has key %q, want %q", i, key, want)
+		}
+	}
+
+	rc = new(rowCollector)
+	req = &btspb.ReadRowsRequest{
+		TableName: name,
+		RowRange:  &btdpb.RowRange{StartKey: []byte("row00100"), EndKey: []byte("row00103")},
+	}
+	if err := s.ReadRows(req, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	if got, want := fmt.Sprint(rc.keys()), "[row00100 row00101 row00102]"; got != want {
+		t.Errorf("ReadRows over range = %s, want %s", got, want)
+	}
+
+	// A range spanning several chunks.
+	rc = new(rowCollector)
+	req = &btspb.ReadRowsRequest{
+		TableName: name,
+		RowRange:  &btdpb.RowRange{StartKey: []byte("row00050"), EndKey: []byte("row00300")},
+	}
+	if err := s.ReadRows(req, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	keys = rc.keys()
+	if len(keys) != 250 || keys[0] != "row00050" || keys[249] != "row00299" {
+		t.Errorf("ReadRows over range spanning chunks returned %d rows, from %q", len(keys), keys)
+	}
+}
+
+func TestEmptyRowRemoval(t *testing.T) {
+	s, name := newTestServer(t)
+	ctx := context.Background()
+
+	mutate := func(row string, muts ...*btdpb.Mutation) error {
+		_, err := s.MutateRow(ctx, &btspb.MutateRowRequest{TableName: name, RowKey: []byte(row), Mutations: muts})
+		return err
+	}
+	numRows := func() int {
+		tbl := s.tables[name]
+		tbl.mu.RLock()
+		defer tbl.mu.RUnlock()
+		return tbl.rows.Len()
+	}
+
+	if err := mutate("a", setCell("fam", "col1", "v"), setCell("fam", "col2", "v")); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+	if err := mutate("b", setCell("nosuchfam", "col", "v")); err == nil {
+		t.Errorf("MutateRow with unknown family succeeded")
+	}
+	if n := numRows(); n != 1 {
+		t.Errorf("after failed mutation, table has %d rows, want 1", n)
+	}
+
+	del := &btdpb.Mutation{DeleteFromColumn: &btdpb.Mutation_DeleteFromColumn{FamilyName: "fam", ColumnQualifier: []byte("col1")}}
+	if err := mutate("a", del); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+	if n := numRows(); n != 1 {
+		t.Errorf("after deleting one column, table has %d rows, want 1", n)
+	}
+	del = &btdpb.Mutation{DeleteFromFamily: &btdpb.Mutation_DeleteFromFamily{FamilyName: "fam"}}
+	if err := mutate("a", del); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+	if n := numRows(); n != 0 {
+		t.Errorf("after deleting all columns, table has %d rows, want 0", n)
+	}
+
+	// Concurrently set and delete a row; the final set must not be lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mutate("c", setCell("fam", "col", "v"))
+			mutate("c", &btdpb.Mutation{DeleteFromRow: &btdpb.Mutation_DeleteFromRow{}})
+		}()
+	}
+	wg.Wait()
+	if err := mutate("c", setCell("fam", "col", "v")); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+	rc := new(rowCollector)
+	if err := s.ReadRows(&btspb.ReadRowsRequest{TableName: name, RowRange: &btdpb.RowRange{}}, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	if got, want := fmt.Sprint(rc.keys()), "[c]"; got != want {
+		t.Errorf("ReadRows = %s, want %s", got, want)
+	}
+}
+
+func TestReadRowsOrderAndLimit(t *testing.T) {
+	s, name := newTestServer(t)
+	ctx := context.Background()
+	if _, err := s.CreateColumnFamily(ctx, &bttspb.CreateColumnFamilyRequest{Name: name, ColumnFamilyId: "a-b"}); err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	for _, row := range []string{"r1", "r2", "r3"} {
+		req := &btspb.MutateRowRequest{
+			TableName: name,
+			RowKey:    []byte(row),
+			Mutations: []*btdpb.Mutation{
+				setCell("fam", "z", "1"),
+				setCell("a-b", "q", "2"),
+				setCell("fam", "b", "3"),
+				setCell("fam", "m", "4"),
+			},
+		}
+		if _, err := s.MutateRow(ctx, req); err != nil {
+			t.Fatalf("MutateRow: %v", err)
+		}
+	}
+
+	rc := new(rowCollector)
+	req := &btspb.ReadRowsRequest{TableName: name, RowRange: &btdpb.RowRange{}, NumRowsLimit: 2}
+	if err := s.ReadRows(req, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	if got, want := fmt.Sprint(rc.keys()), "[r1 r2]"; got != want {
+		t.Errorf("ReadRows with limit = %s, want %s", got, want)
+	}
+	var got []string
+	for _, chunk := range rc.rows[0].Chunks {
+		if chunk.RowContents == nil {
+			continue
+		}
+		for _, col := range chunk.RowContents.Columns {
+			got = append(got, fmt.Sprintf("%s:%s", chunk.RowContents.Name, col.Qualifier))
+		}
+	}
+	if got, want := fmt.Sprint(got), "[a-b:q fam:b fam:m fam:z]"; got != want {
+		t.Errorf("cell order = %s, want %s", got, want)
+	}
+	if n := len(rc.rows[0].Chunks); n != 3 {
+		t.Errorf("row sent in %d chunks, want 3 (one per family and a commit)", n)
+	}
+}
+
+func TestLargeRowChunking(t *testing.T) {
+	s, name := newTestServer(t)
+	ctx := context.Background()
+	big := string(make([]byte, maxResponseValueBytes/2+1))
+	var muts []*btdpb.Mutation
+	for i := 0; i < 5; i++ {
+		muts = append(muts, setCell("fam", fmt.Sprintf("col%d", i), big))
+	}
+	if _, err := s.MutateRow(ctx, &btspb.MutateRowRequest{TableName: name, RowKey: []byte("row"), Mutations: muts}); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+
+	rc := new(rowCollector)
+	if err := s.ReadRows(&btspb.ReadRowsRequest{TableName: name, RowKey: []byte("row")}, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	if len(rc.rows) != 5 {
+		t.Fatalf("row sent in %d responses, want 5", len(rc.rows))
+	}
+	for i, res := range rc.rows {
+		last := res.Chunks[len(res.Chunks)-1]
+		if commit := i == len(rc.rows)-1; last.CommitRow != commit {
+			t.Errorf("response #%d: commit_row = %t, want %t", i, last.CommitRow, commit)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	s, name := newTestServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		desc string
+		err  error
+		code codes.Code
+	}{
+		{
+			desc: "create existing table",
+			err:  errOf(s.CreateTable(ctx, &bttspb.CreateTableRequest{Name: testCluster, TableId: "t"})),
+			code: codes.AlreadyExists,
+		},
+		{
+			desc: "create table with bad ID",
+			err:  errOf(s.CreateTable(ctx, &bttspb.CreateTableRequest{Name: testCluster, TableId: "no spaces"})),
+			code: codes.InvalidArgument,
+		},
+		{
+			desc: "delete missing table",
+			err:  errOf(s.DeleteTable(ctx, &bttspb.DeleteTableRequest{Name: testCluster + "/tables/nope"})),
+			code: codes.NotFound,
+		},
+		{
+			desc: "create existing family",
+			err:  errOf(s.CreateColumnFamily(ctx, &bttspb.CreateColumnFamilyRequest{Name: name, ColumnFamilyId: "fam"})),
+			code: codes.AlreadyExists,
+		},
+		{
+			desc: "mutate unknown family",
+			err:  errOf(s.MutateRow(ctx, &btspb.MutateRowRequest{TableName: name, RowKey: []byte("r"), Mutations: []*btdpb.Mutation{setCell("nope", "c", "v")}})),
+			code: codes.NotFound,
+		},
+		{
+			desc: "read missing table",
+			err:  s.ReadRows(&btspb.ReadRowsRequest{TableName: testCluster + "/tables/nope"}, new(rowCollector)),
+			code: codes.NotFound,
+		},
+		{
+			desc: "read with bad regexp",
+			err:  s.ReadRows(&btspb.ReadRowsRequest{TableName: name, Filter: &btdpb.RowFilter{ColumnQualifierRegexFilter: []byte("(")}}, new(rowCollector)),
+			code: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range tests {
+		if got := grpc.Code(tc.err); got != tc.code {
+			t.Errorf("%s: got code %v (err %v), want %v", tc.desc, got, tc.err, tc.code)
+		}
+	}
+}
+
+func TestRenameTableAndDeleteFamily(t *testing.T) {
+	s, name := newTestServer(t)
+	ctx := context.Background()
+	if _, err := s.CreateColumnFamily(ctx, &bttspb.CreateColumnFamilyRequest{Name: name, ColumnFamilyId: "other"}); err != nil {
+		t.Fatalf("CreateColumnFamily: %v", err)
+	}
+	muts := []*btdpb.Mutation{setCell("fam", "col", "v")}
+	if _, err := s.MutateRow(ctx, &btspb.MutateRowRequest{TableName: name, RowKey: []byte("a"), Mutations: muts}); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+	muts = append(muts, setCell("other", "col", "v"))
+	if _, err := s.MutateRow(ctx, &btspb.MutateRowRequest{TableName: name, RowKey: []byte("b"), Mutations: muts}); err != nil {
+		t.Fatalf("MutateRow: %v", err)
+	}
+
+	if _, err := s.RenameTable(ctx, &bttspb.RenameTableRequest{Name: name, NewId: "t2"}); err != nil {
+		t.Fatalf("RenameTable: %v", err)
+	}
+	if _, err := s.GetTable(ctx, &bttspb.GetTableRequest{Name: name}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("GetTable of old name: got err %v, want NotFound", err)
+	}
+	name = testCluster + "/tables/t2"
+
+	if _, err := s.DeleteColumnFamily(ctx, &bttspb.DeleteColumnFamilyRequest{Name: name + "/columnFamilies/fam"}); err != nil {
+		t.Fatalf("DeleteColumnFamily: %v", err)
+	}
+	tbl, err := s.GetTable(ctx, &bttspb.GetTableRequest{Name: name})
+	if err != nil {
+		t.Fatalf("GetTable: %v", err)
+	}
+	if _, ok := tbl.ColumnFamilies["fam"]; ok || len(tbl.ColumnFamilies) != 1 {
+		t.Errorf("families after deleting one: %v", tbl.ColumnFamilies)
+	}
+	rc := new(rowCollector)
+	if err := s.ReadRows(&btspb.ReadRowsRequest{TableName: name, RowRange: &btdpb.RowRange{}}, rc); err != nil {
+		t.Fatalf("ReadRows: %v", err)
+	}
+	if got, want := fmt.Sprint(rc.keys()), "[b]"; got != want {
+		t.Errorf("ReadRows after deleting family = %s, want %s", got, want)
+	}
+}
+
+func errOf(_ interface{}, err error) error { return err }
@@ -19,15 +19,12 @@ package main
 // Command docs are in cbtdoc.go.
 
 import (
-	"bufio"
 	"bytes"
 	"flag"
 	"fmt"
 	"go/format"
-	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -42,87 +39,81 @@ import (
 
 var (
 	// These get default values from $HOME/.cbtrc if it exists.
-	project = flag.String("project", "", "project ID")
-	zone    = flag.String("zone", "", "CBT zone")
-	cluster = flag.String("cluster", "", "CBT cluster")
-	creds   = flag.String("creds", "", "if set, use application credentials in this file")
+	project  = flag.String("project", "", "project ID")
+	zone     = flag.String("zone", "", "CBT zone")
+	cluster  = flag.String("cluster", "", "CBT cluster")
+	creds    = flag.String("creds", "", "if set, use application credentials in this file")
+	emulator = flag.String("emulator", "", "if set, connect to the Cloud Bigtable emulator at this address, without TLS or credentials")
+
+	profile = flag.String("profile", "", "profile in $HOME/.cbtrc to use; by default, $CBT_PROFILE or the default profile")
 
 	client      *bigtable.Client
 	adminClient *bigtable.AdminClient
 )
 
+// inShell reports whether commands are being run by the interactive shell.
+var inShell bool
+
+// shellAbort is the panic value used by fatalf to abandon a command in the shell.
+type shellAbort struct{}
+
+// fatalf logs a message and exits, or in the shell, abandons the current command.
+func fatalf(format string, args ...interface{}) {
+	if inShell {
+		log.Printf(format, args...)
+		panic(shellAbort{})
+	}
+	log.Fatalf(format, args...)
+}
+
 func getClient() *bigtable.Client {
 	if client == nil {
 		var err error
-		client, err = bigtable.NewClient(context.Background(), *project, *zone, *cluster)
+		client, err = bigtable.NewClient(context.Background(), *project, *zone, *cluster, clientOptions()...)
 		if err != nil {
-			log.Fatalf("Making bigtable.Client: %v", err)
+			fatalf("Making bigtable.Client: %v", err)
 		}
 	}
 	return client
 }
 
+// clientOptions returns the options for making clients from the flags.
+func clientOptions() []bigtable.ClientOption {
+	if *emulator == "" {
+		return nil
+	}
+	return []bigtable.ClientOption{bigtable.WithCredentials(nil), bigtable.WithInsecureAddr(*emulator)}
+}
+
 func getAdminClient() *bigtable.AdminClient {
 	if adminClient == nil {
 		var err error
-		adminClient, err = bigtable.NewAdminClient(context.Background(), *project, *zone, *cluster)
+		adminClient, err = bigtable.NewAdminClient(context.Background(), *project, *zone, *cluster, clientOptions()...)
 		if err != nil {
-			log.Fatalf("Making bigtable.AdminClient: %v", err)
+			fatalf("Making bigtable.AdminClient: %v", err)
 		}
 	}
 	return adminClient
 }
 
-func configFilename() string {
-	// TODO(dsymonds): Might need tweaking for Windows.
-	return filepath.Join(os.Getenv("HOME"), ".cbtrc")
-}
-
-func loadConfig() {
-	filename := configFilename()
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		// silent fail if the file isn't there
-		if os.IsNotExist(err) {
-			return
-		}
-		log.Fatalf("Reading %s: %v", filename, err)
-	}
-	s := bufio.NewScanner(bytes.NewReader(data))
-	for s.Scan() {
-		line := s.Text()
-		i := strings.Index(line, "=")
-		if i < 0 {
-			log.Fatalf("Bad line in %s: %q", filename, line)
-		}
-		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
-		switch key {
-		default:
-			log.Fatalf("Unknown key in %s: %q", filename, key)
-		case "project":
-			*project = val
-		case "zone":
-			*zone = val
-		case "cluster":
-			*cluster = val
-		case "creds":
-			*creds = val
-		}
-	}
-}
-
 func main() {
-	loadConfig()
 	flag.Usage = usage
 	flag.Parse()
+	selectProfile()
+	if flag.Arg(0) == "config" {
+		// Managing the config needs no cluster, and may create the selected profile.
+		doConfig(context.Background(), flag.Args()[1:]...)
+		return
+	}
+	applyConfig()
 	if *project == "" {
-		log.Fatal("Missing -project")
+		fatalf("Missing -project")
 	}
 	if *zone == "" {
-		log.Fatal("Missing -zone")
+		fatalf("Missing -zone")
 	}
 	if *cluster == "" {
-		log.Fatal("Missing -cluster")
+		fatalf("Missing -cluster")
 	}
 	if *creds != "" {
 		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", *creds)
@@ -138,7 +129,7 @@ func main() {
 			return
 		}
 	}
-	log.Fatalf("Unknown command %q", flag.Arg(0))
+	fatalf("Unknown command %q", flag.Arg(0))
 }
 
 func usage() {
@@ -161,12 +152,20 @@ func init() {
 }
 
 var configHelp = `
-For convenience, values of the -project, -zone, -cluster and -creds flags
+For convenience, values of the -project, -zone, -cluster, -creds and -emulator flags
 may be specified in ` + configFilename() + ` in this format:
 	project = my-project-123
 	zone = us-central1-b
 	cluster = my-cluster
 	creds = path-to-account-key.json
+
+	[dev]
+	cluster = my-dev-cluster
+	emulator = localhost:8086
+Values before any [profile] section form the default profile, and are
+inherited by other profiles, except for emulator. A profile can override
+an inherited value with none, as in "creds = none". The profile used is chosen by
+the -profile flag, or else $CBT_PROFILE. Use "cbt config" to manage profiles.
 All values are optional, and all will be overridden by flags.
 `
 
@@ -175,6 +174,68 @@ var commands = []struct {
 	do         func(context.Context, ...string)
 	Usage      string
 }{
+	{
+		Name: "append",
+		Desc: "Append to the value of a cell",
+		do:   doAppend,
+		Usage: "cbt append <table> <row> family:column=val ...\n" +
+			"  family:column=val may be repeated to append to multiple cells.\n" +
+			"\n" +
+			"  An unset cell is treated as empty. The new values are printed.",
+	},
+	{
+		Name: "checkandset",
+		Desc: "Set cells if a filter matches",
+		do:   doCheckAndSet,
+		Usage: "cbt checkandset <table> <row> <filter> family:column=val[@ts] ...\n" +
+			"  <filter> is one of\n" +
+			"    columnregex=<regex>	Match if the row has a column whose qualifier matches this regex\n" +
+			"    valueregex=<regex>	Match if the row has a cell whose value matches this regex\n" +
+			"\n" +
+			"  The cells are set, as by cbt set, only if the filter matches the row.\n" +
+			"  Whether it matched is printed.",
+	},
+	{
+		Name: "config",
+		Desc: "Manage configuration profiles",
+		do:   doConfig,
+		Usage: "cbt config list				List profiles, marking the current one\n" +
+			"cbt config show [profile]			Show the settings of a profile; by default, the current one\n" +
+			"cbt config set <profile> key=val ...	Set values in a profile, creating it if needed\n" +
+			"\n" +
+			"  Keys are project, zone, cluster, creds and emulator.\n" +
+			"  An empty val removes the key from the profile.\n" +
+			"  A val of none overrides a value inherited from the default profile.\n" +
+			"  The emulator key is not inherited.\n" +
+			"  The default profile is named default.",
+	},
+	{
+		Name: "copytable",
+		Desc: "Copy rows to another table",
+		do:   doCopyTable,
+		Usage: "cbt copytable <table> <dsttable> [start=<row>] [limit=<row>] [prefix=<prefix>] [batchsize=<n>]\n" +
+			"		[dstproject=<project>] [dstzone=<zone>] [dstcluster=<cluster>]\n" +
+			"  start=<row>			Start copying at this row\n" +
+			"  limit=<row>			Stop copying before this row\n" +
+			"  prefix=<prefix>		Copy rows with this prefix\n" +
+			"  batchsize=<n>			Number of rows to apply per batch, 16 at a time (default 100)\n" +
+			"  dstproject=<project>		Project of <dsttable>; by default, the -project flag\n" +
+			"  dstzone=<zone>		Zone of <dsttable>; by default, the -zone flag\n" +
+			"  dstcluster=<cluster>		Cluster of <dsttable>; by default, the -cluster flag\n" +
+			"\n" +
+			"  Every version of each cell is copied with its timestamp.\n" +
+			"  <dsttable> must already exist, with the same column families.",
+	},
+	{
+		Name: "count",
+		Desc: "Count rows in a table",
+		do:   doCount,
+		Usage: "cbt count <table> [start=<row>] [limit=<row>] [prefix=<prefix>] [rowregex=<regex>]\n" +
+			"  start=<row>		Start counting at this row\n" +
+			"  limit=<row>		Stop counting before this row\n" +
+			"  prefix=<prefix>	Count rows with this prefix\n" +
+			"  rowregex=<regex>	Count rows whose key matches this regex\n",
+	},
 	{
 		Name:  "createfamily",
 		Desc:  "Create a column family",
@@ -211,6 +272,30 @@ var commands = []struct {
 		do:    doDoc,
 		Usage: "cbt doc",
 	},
+	{
+		Name: "droprange",
+		Desc: "Delete all rows with a prefix",
+		do:   doDropRange,
+		Usage: "cbt droprange <table> prefix=<prefix> [batchsize=<n>]\n" +
+			"  prefix=<prefix>	Delete rows with this prefix, which must not be empty\n" +
+			"  batchsize=<n>		Number of rows to delete per batch, 16 at a time (default 100)",
+	},
+	{
+		Name: "export",
+		Desc: "Export rows to a file",
+		do:   doExport,
+		Usage: "cbt export <table> <file> [format=<format>] [start=<row>] [limit=<row>] [prefix=<prefix>]\n" +
+			"  format=<format>	csv or json; by default, taken from the file extension\n" +
+			"  start=<row>		Start exporting at this row\n" +
+			"  limit=<row>		Stop exporting before this row\n" +
+			"  prefix=<prefix>	Export rows with this prefix\n" +
+			"\n" +
+			"  A <file> of - means standard output.\n" +
+			"  CSV has a header of the row key followed by family:column names,\n" +
+			"  and holds the latest value of each cell.\n" +
+			"  JSON has one object per line, holding every cell version and timestamp,\n" +
+			"  with base64-encoded values.",
+	},
 	{
 		Name:  "help",
 		Desc:  "Print help text",
@@ -218,26 +303,83 @@ var commands = []struct {
 		Usage: "cbt help [command]",
 	},
 	{
-		Name:  "lookup",
-		Desc:  "Read from a single row",
-		do:    doLookup,
-		Usage: "cbt lookup <table> <row>",
+		Name: "import",
+		Desc: "Import rows from a file",
+		do:   doImport,
+		Usage: "cbt import <table> <file> [format=<format>] [batchsize=<n>]\n" +
+			"  format=<format>	csv or json; by default, taken from the file extension\n" +
+			"  batchsize=<n>		Number of rows to apply per batch, 16 at a time (default 100)\n" +
+			"\n" +
+			"  A <file> of - means standard input.\n" +
+			"  The file format is as written by `cbt export`.\n" +
+			"  Empty CSV fields are not set.",
+	},
+	{
+		Name: "increment",
+		Desc: "Increment the value of a cell",
+		do:   doIncrement,
+		Usage: "cbt increment <table> <row> family:column=delta ...\n" +
+			"  family:column=delta may be repeated to increment multiple cells.\n" +
+			"\n" +
+			"  delta is an integer, which may be negative.\n" +
+			"  Values are 8-byte big-endian integers; an unset cell is treated as zero.\n" +
+			"  The new values are printed.",
+	},
+	{
+		Name: "loadtest",
+		Desc: "Generate load and report latencies",
+		do:   doLoadTest,
+		Usage: "cbt loadtest <table> <family> [duration=<d>] [concurrency=<n>] [reads=<fraction>]\n" +
+			"		[keys=<n>] [distribution=<dist>] [valuesize=<bytes>]\n" +
+			"  duration=<d>			How long to run, such as 30s (default 10s)\n" +
+			"  concurrency=<n>		Number of concurrent workers (default 10)\n" +
+			"  reads=<fraction>		Fraction of operations that are reads (default 0.5)\n" +
+			"  keys=<n>			Number of distinct row keys (default 10000)\n" +
+			"  distribution=<dist>		uniform (default), zipf or sequential\n" +
+			"  valuesize=<bytes>		Size of written values (default 100)\n" +
+			"\n" +
+			"  Reads fetch whole rows; writes set <family>:col.\n" +
+			"  Latency percentiles are reported for each kind of operation.",
+	},
+	{
+		Name: "lookup",
+		Desc: "Read from a single row",
+		do:   doLookup,
+		Usage: "cbt lookup <table> <row> [columnregex=<regex>] [valueregex=<regex>] [versions=<n>]\n" +
+			"		[output=<output>] [decode=<decoding>]\n" +
+			"  columnregex=<regex>	Read only columns whose qualifier matches this regex\n" +
+			"  valueregex=<regex>	Read only cells whose value matches this regex\n" +
+			"  versions=<n>		Read only the latest <n> versions of each column\n" +
+			outputUsage,
 	},
 	{
 		Name: "ls",
 		Desc: "List tables and column families",
 		do:   doLS,
 		Usage: "cbt ls			List tables\n" +
-			"cbt ls <table>		List column families in <table>",
+			"cbt ls <table>		List column families in <table>, with their GC policies",
 	},
 	{
 		Name: "read",
 		Desc: "Read rows",
 		do:   doRead,
 		Usage: "cbt read <table> [start=<row>] [limit=<row>] [prefix=<prefix>]\n" +
+			"		[rowregex=<regex>] [columnregex=<regex>] [valueregex=<regex>] [versions=<n>]\n" +
+			"		[output=<output>] [decode=<decoding>]\n" +
 			"  start=<row>		Start reading at this row\n" +
 			"  limit=<row>		Stop reading before this row\n" +
-			"  prefix=<prefix>	Read rows with this prefix\n",
+			"  prefix=<prefix>	Read rows with this prefix\n" +
+			"  rowregex=<regex>	Read rows whose key matches this regex\n" +
+			"  columnregex=<regex>	Read only columns whose qualifier matches this regex\n" +
+			"  valueregex=<regex>	Read only cells whose value matches this regex\n" +
+			"  versions=<n>		Read only the latest <n> versions of each column\n" +
+			outputUsage,
+	},
+	{
+		Name:  "renametable",
+		Desc:  "Rename a table",
+		do:    doRenameTable,
+		Usage: "cbt renametable <table> <newname>",
 	},
 	{
 		Name: "set",
@@ -250,73 +392,101 @@ var commands = []struct {
 			"  If it cannot be parsed, the `@ts` part will be\n" +
 			"  interpreted as part of the value.",
 	},
+	{
+		Name: "setgcpolicy",
+		Desc: "Set the GC policy for a column family",
+		do:   doSetGCPolicy,
+		Usage: "cbt setgcpolicy <table> <family> <policy> [(and|or) <policy> ...]\n" +
+			"  <policy> is one of\n" +
+			"    maxversions=<n>	Keep only the latest <n> versions of each cell\n" +
+			"    maxage=<d>		Keep only cells younger than <d>, such as 12h or 7d\n" +
+			"\n" +
+			"  Cells are collected when the whole policy applies to them;\n" +
+			"  and binds more tightly than or.",
+	},
+	{
+		Name: "shell",
+		Desc: "Run commands interactively",
+		do:   doShell,
+		Usage: "cbt shell\n" +
+			"  Reads commands, without the leading `cbt`, until exit, quit or end of input.\n" +
+			"  Arguments may be quoted with \"double quotes\" (Go syntax) or 'single quotes'.\n" +
+			"  The tab key completes command, table and family names,\n" +
+			"  and the up and down arrow keys step through the session's history.\n" +
+			"\n" +
+			"  use <table>		Make later commands apply to <table>, omitting it from their arguments\n" +
+			"  use			Stop applying commands to a table",
+	},
 }
 
 func doCreateFamily(ctx context.Context, args ...string) {
 	if len(args) != 2 {
-		log.Fatal("usage: cbt createfamily <table> <family>")
+		fatalf("usage: cbt createfamily <table> <family>")
 	}
 	err := getAdminClient().CreateColumnFamily(ctx, args[0], args[1])
 	if err != nil {
-		log.Fatalf("Creating column family: %v", err)
+		fatalf("Creating column family: %v", err)
 	}
 }
 
 func doCreateTable(ctx context.Context, args ...string) {
 	if len(args) != 1 {
-		log.Fatal("usage: cbt createtable <table>")
+		fatalf("usage: cbt createtable <table>")
 	}
 	err := getAdminClient().CreateTable(ctx, args[0])
 	if err != nil {
-		log.Fatalf("Creating table: %v", err)
+		fatalf("Creating table: %v", err)
 	}
 }
 
 func doDeleteFamily(ctx context.Context, args ...string) {
 	if len(args) != 2 {
-		log.Fatal("usage: cbt deletefamily <table> <family>")
+		fatalf("usage: cbt deletefamily <table> <family>")
 	}
 	err := getAdminClient().DeleteColumnFamily(ctx, args[0], args[1])
 	if err != nil {
-		log.Fatalf("Deleting column family: %v", err)
+		fatalf("Deleting column family: %v", err)
 	}
 }
 
 func doDeleteRow(ctx context.Context, args ...string) {
 	if len(args) != 2 {
-		log.Fatal("usage: cbt deleterow <table> <row>")
+		fatalf("usage: cbt deleterow <table> <row>")
 	}
 	tbl := getClient().Open(args[0])
 	mut := bigtable.NewMutation()
 	mut.DeleteRow()
 	if err := tbl.Apply(ctx, args[1], mut); err != nil {
-		log.Fatalf("Deleting row: %v", err)
+		fatalf("Deleting row: %v", err)
 	}
 }
 
 func doDeleteTable(ctx context.Context, args ...string) {
 	if len(args) != 1 {
-		log.Fatalf("Can't do `cbt deletetable %s`", args)
+		fatalf("Can't do `cbt deletetable %s`", args)
 	}
 	err := getAdminClient().DeleteTable(ctx, args[0])
 	if err != nil {
-		log.Fatalf("Deleting table: %v", err)
+		fatalf("Deleting table: %v", err)
 	}
 }
 
 // to break circular dependencies
 var (
-	doDocFn  func(ctx context.Context, args ...string)
-	doHelpFn func(ctx context.Context, args ...string)
+	doDocFn   func(ctx context.Context, args ...string)
+	doHelpFn  func(ctx context.Context, args ...string)
+	doShellFn func(ctx context.Context, args ...string)
 )
 
 func init() {
 	doDocFn = doDocReal
 	doHelpFn = doHelpReal
+	doShellFn = doShellReal
 }
 
-func doDoc(ctx context.Context, args ...string)  { doDocFn(ctx, args...) }
-func doHelp(ctx context.Context, args ...string) { doHelpFn(ctx, args...) }
+func doDoc(ctx context.Context, args ...string)   { doDocFn(ctx, args...) }
+func doHelp(ctx context.Context, args ...string)  { doHelpFn(ctx, args...) }
+func doShell(ctx context.Context, args ...string) { doShellFn(ctx, args...) }
 
 func doDocReal(ctx context.Context, args ...string) {
 	data := map[string]interface{}{
@@ -324,11 +494,11 @@ func doDocReal(ctx context.Context, args ...string) {
 	}
 	var buf bytes.Buffer
 	if err := docTemplate.Execute(&buf, data); err != nil {
-		log.Fatalf("Bad doc template: %v", err)
+		fatalf("Bad doc template: %v", err)
 	}
 	out, err := format.Source(buf.Bytes())
 	if err != nil {
-		log.Fatalf("Bad doc output: %v", err)
+		fatalf("Bad doc output: %v", err)
 	}
 	os.Stdout.Write(out)
 }
@@ -383,40 +553,29 @@ func doHelpReal(ctx context.Context, args ...string) {
 			return
 		}
 	}
-	log.Fatalf("Don't know command %q", args[0])
+	fatalf("Don't know command %q", args[0])
 }
 
 func doLookup(ctx context.Context, args ...string) {
-	if len(args) != 2 {
-		log.Fatalf("usage: cbt lookup <table> <row>")
+	if len(args) < 2 {
+		fatalf("usage: cbt lookup <table> <row> [args ...]")
 	}
 	table, row := args[0], args[1]
+	parsed := parseArgs(args[2:], "columnregex", "valueregex", "versions", "output", "decode")
+	rp := newRowPrinter(parsed)
+	var opts []bigtable.ReadOption
+	if f := parseFilter(parsed); f != nil {
+		opts = append(opts, bigtable.RowFilter(f))
+	}
 	tbl := getClient().Open(table)
-	r, err := tbl.ReadRow(ctx, row)
+	r, err := tbl.ReadRow(ctx, row, opts...)
 	if err != nil {
-		log.Fatalf("Reading row: %v", err)
-	}
-	printRow(r)
-}
-
-func printRow(r bigtable.Row) {
-	fmt.Println(strings.Repeat("-", 40))
-	fmt.Println(r.Key())
-
-	var fams []string
-	for fam := range r {
-		fams = append(fams, fam)
+		fatalf("Reading row: %v", err)
 	}
-	sort.Strings(fams)
-	for _, fam := range fams {
-		ris := r[fam]
-		sort.Sort(byColumn(ris))
-		for _, ri := range ris {
-			ts := time.Unix(0, int64(ri.Timestamp)*1e3)
-			fmt.Printf("  %-40s @ %s\n", ri.Column, ts.Format("2006/01/02-15:04:05.000000"))
-			fmt.Printf("    %q\n", ri.Value)
-		}
+	if len(r) > 0 {
+		rp.print(r)
 	}
+	rp.flush()
 }
 
 type byColumn []bigtable.ReadItem
@@ -428,11 +587,11 @@ func (b byColumn) Less(i, j int) bool { return b[i].Column < b[j].Column }
 func doLS(ctx context.Context, args ...string) {
 	switch len(args) {
 	default:
-		log.Fatalf("Can't do `cbt ls %s`", args)
+		fatalf("Can't do `cbt ls %s`", args)
 	case 0:
 		tables, err := getAdminClient().Tables(ctx)
 		if err != nil {
-			log.Fatalf("Getting list of tables: %v", err)
+			fatalf("Getting list of tables: %v", err)
 		}
 		sort.Strings(tables)
 		for _, table := range tables {
@@ -442,37 +601,267 @@ func doLS(ctx context.Context, args ...string) {
 		table := args[0]
 		ti, err := getAdminClient().TableInfo(ctx, table)
 		if err != nil {
-			log.Fatalf("Getting table info: %v", err)
+			fatalf("Getting table info: %v", err)
+		}
+		sort.Sort(byFamilyName(ti.FamilyInfos))
+		tw := tabwriter.NewWriter(os.Stdout, 10, 8, 4, '\t', 0)
+		fmt.Fprintln(tw, "Family Name\tGC Policy")
+		fmt.Fprintln(tw, "-----------\t---------")
+		for _, fi := range ti.FamilyInfos {
+			fmt.Fprintf(tw, "%s\t%s\n", fi.Name, fi.GCPolicy)
+		}
+		tw.Flush()
+	}
+}
+
+type byFamilyName []bigtable.FamilyInfo
+
+func (b byFamilyName) Len() int           { return len(b) }
+func (b byFamilyName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byFamilyName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+func doDropRange(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		fatalf("usage: cbt droprange <table> prefix=<prefix> [batchsize=<n>]")
+	}
+	tbl := getClient().Open(args[0])
+	parsed := parseArgs(args[1:], "prefix", "batchsize")
+	prefix := parsed["prefix"]
+	if prefix == "" {
+		fatalf("droprange needs a non-empty prefix")
+	}
+	batchSize := parseBatchSize(parsed)
+
+	p := &progress{verb: "Deleted", last: time.Now()}
+	var batch []*rowMutation
+	flush := func() {
+		applyBatch(ctx, tbl, batch)
+		p.add(len(batch))
+		batch = batch[:0]
+	}
+	err := tbl.ReadRows(ctx, bigtable.PrefixRange(prefix), func(r bigtable.Row) bool {
+		mut := bigtable.NewMutation()
+		mut.DeleteRow()
+		batch = append(batch, &rowMutation{key: r.Key(), mut: mut})
+		if len(batch) == batchSize {
+			flush()
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		fatalf("Reading rows: %v", err)
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	p.done()
+}
+
+func doRenameTable(ctx context.Context, args ...string) {
+	if len(args) != 2 {
+		fatalf("usage: cbt renametable <table> <newname>")
+	}
+	err := getAdminClient().RenameTable(ctx, args[0], args[1])
+	if err != nil {
+		fatalf("Renaming table: %v", err)
+	}
+}
+
+func doSetGCPolicy(ctx context.Context, args ...string) {
+	if len(args) < 3 {
+		fatalf("usage: cbt setgcpolicy <table> <family> <policy> [(and|or) <policy> ...]")
+	}
+	table, fam := args[0], args[1]
+	pol, err := parseGCPolicy(args[2:])
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if err := getAdminClient().SetGCPolicy(ctx, table, fam, pol); err != nil {
+		fatalf("Setting GC policy: %v", err)
+	}
+}
+
+// parseGCPolicy parses policies joined by "and" and "or", where "and" binds more tightly.
+func parseGCPolicy(args []string) (bigtable.GCPolicy, error) {
+	if len(args)%2 == 0 {
+		return nil, fmt.Errorf("missing policy after %q", args[len(args)-1])
+	}
+	var union, inter []bigtable.GCPolicy
+	endInter := func() {
+		if len(inter) == 1 {
+			union = append(union, inter[0])
+		} else {
+			union = append(union, bigtable.IntersectionPolicy(inter...))
+		}
+		inter = nil
+	}
+	for i, arg := range args {
+		if i%2 == 1 {
+			switch strings.ToLower(arg) {
+			case "and":
+			case "or":
+				endInter()
+			default:
+				return nil, fmt.Errorf("expected and/or, got %q", arg)
+			}
+			continue
+		}
+		pol, err := parseSinglePolicy(arg)
+		if err != nil {
+			return nil, err
+		}
+		inter = append(inter, pol)
+	}
+	endInter()
+	if len(union) == 1 {
+		return union[0], nil
+	}
+	return bigtable.UnionPolicy(union...), nil
+}
+
+func parseSinglePolicy(s string) (bigtable.GCPolicy, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("bad policy %q", s)
+	}
+	key, val := s[:i], s[i+1:]
+	switch key {
+	case "maxversions":
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad maxversions %q", val)
+		}
+		return bigtable.MaxVersionsPolicy(n), nil
+	case "maxage":
+		d, err := parseDuration(val)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad maxage %q", val)
 		}
-		sort.Strings(ti.Families)
-		for _, fam := range ti.Families {
-			fmt.Println(fam)
+		return bigtable.MaxAgePolicy(d), nil
+	}
+	return nil, fmt.Errorf("unknown policy %q", key)
+}
+
+// parseDuration is like time.ParseDuration, but also accepts a whole number of days, such as "7d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, err
 		}
+		return time.Duration(n) * 24 * time.Hour, nil
 	}
+	return time.ParseDuration(s)
 }
 
 func doRead(ctx context.Context, args ...string) {
 	if len(args) < 1 {
-		log.Fatalf("usage: cbt read <table> [args ...]")
+		fatalf("usage: cbt read <table> [args ...]")
 	}
 	tbl := getClient().Open(args[0])
 
+	parsed := parseArgs(args[1:], "start", "limit", "prefix",
+		"rowregex", "columnregex", "valueregex", "versions", "output", "decode")
+	rr := parseRowRange(parsed)
+	rp := newRowPrinter(parsed)
+	var opts []bigtable.ReadOption
+	if f := parseFilter(parsed); f != nil {
+		opts = append(opts, bigtable.RowFilter(f))
+	}
+
+	err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+		rp.print(r)
+		return true
+	}, opts...)
+	rp.flush()
+	if err != nil {
+		fatalf("Reading rows: %v", err)
+	}
+}
+
+func doCount(ctx context.Context, args ...string) {
+	if len(args) < 1 {
+		fatalf("usage: cbt count <table> [args ...]")
+	}
+	tbl := getClient().Open(args[0])
+
+	parsed := parseArgs(args[1:], "start", "limit", "prefix", "rowregex")
+	rr := parseRowRange(parsed)
+	// Only the row keys are needed.
+	filters := []bigtable.Filter{bigtable.StripValueFilter()}
+	if f := parseFilter(parsed); f != nil {
+		filters = append(filters, f)
+	}
+
+	n := 0
+	err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+		n++
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(filters...)))
+	if err != nil {
+		fatalf("Reading rows: %v", err)
+	}
+	fmt.Println(n)
+}
+
+// parseFilter returns the filter described by the "rowregex", "columnregex",
+// "valueregex" and "versions" keys of parsed args, or nil if there are none.
+func parseFilter(parsed map[string]string) bigtable.Filter {
+	var filters []bigtable.Filter
+	if re := parsed["rowregex"]; re != "" {
+		filters = append(filters, bigtable.RowKeyFilter(re))
+	}
+	if re := parsed["columnregex"]; re != "" {
+		filters = append(filters, bigtable.ColumnFilter(re))
+	}
+	if re := parsed["valueregex"]; re != "" {
+		filters = append(filters, bigtable.ValueFilter(re))
+	}
+	if v := parsed["versions"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			fatalf("Bad versions %q", v)
+		}
+		filters = append(filters, bigtable.LatestNFilter(n))
+	}
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	}
+	return bigtable.ChainFilters(filters...)
+}
+
+// parseArgs parses key=value arguments, permitting only the given keys.
+func parseArgs(args []string, keys ...string) map[string]string {
 	parsed := make(map[string]string)
-	for _, arg := range args[1:] {
+	for _, arg := range args {
 		i := strings.Index(arg, "=")
 		if i < 0 {
-			log.Fatalf("Bad arg %q", arg)
+			fatalf("Bad arg %q", arg)
 		}
 		key, val := arg[:i], arg[i+1:]
-		switch key {
-		default:
-			log.Fatalf("Unknown arg key %q", key)
-		case "start", "limit", "prefix":
-			parsed[key] = val
+		known := false
+		for _, k := range keys {
+			if k == key {
+				known = true
+				break
+			}
 		}
+		if !known {
+			fatalf("Unknown arg key %q", key)
+		}
+		parsed[key] = val
 	}
+	return parsed
+}
+
+// parseRowRange returns the row range described by
+// the "start", "limit" and "prefix" keys of parsed args.
+func parseRowRange(parsed map[string]string) bigtable.RowRange {
 	if (parsed["start"] != "" || parsed["limit"] != "") && parsed["prefix"] != "" {
-		log.Fatal(`"start"/"limit" may not be mixed with "prefix"`)
+		fatalf(`"start"/"limit" may not be mixed with "prefix"`)
 	}
 
 	var rr bigtable.RowRange
@@ -484,30 +873,31 @@ func doRead(ctx context.Context, args ...string) {
 	if prefix := parsed["prefix"]; prefix != "" {
 		rr = bigtable.PrefixRange(prefix)
 	}
-
-	// TODO(dsymonds): Support filters.
-	err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
-		printRow(r)
-		return true
-	})
-	if err != nil {
-		log.Fatalf("Reading rows: %v", err)
-	}
+	return rr
 }
 
 var setArg = regexp.MustCompile(`([^:]+):([^=]*)=(.*)`)
 
 func doSet(ctx context.Context, args ...string) {
 	if len(args) < 3 {
-		log.Fatalf("usage: cbt set <table> <row> family:[column]=val[@ts] ...")
+		fatalf("usage: cbt set <table> <row> family:[column]=val[@ts] ...")
 	}
 	tbl := getClient().Open(args[0])
 	row := args[1]
+	mut := parseSetArgs(args[2:])
+	if err := tbl.Apply(ctx, row, mut); err != nil {
+		fatalf("Applying mutation: %v", err)
+	}
+}
+
+// parseSetArgs returns a mutation setting the cells in args,
+// which are family:column=val[@ts] as for cbt set.
+func parseSetArgs(args []string) *bigtable.Mutation {
 	mut := bigtable.NewMutation()
-	for _, arg := range args[2:] {
+	for _, arg := range args {
 		m := setArg.FindStringSubmatch(arg)
 		if m == nil {
-			log.Fatalf("Bad set arg %q", arg)
+			fatalf("Bad set arg %q", arg)
 		}
 		val := m[3]
 		ts := bigtable.Now()
@@ -521,7 +911,76 @@ func doSet(ctx context.Context, args ...string) {
 		}
 		mut.Set(m[1], m[2], ts, []byte(val))
 	}
-	if err := tbl.Apply(ctx, row, mut); err != nil {
-		log.Fatalf("Applying mutation: %v", err)
+	return mut
+}
+
+func doIncrement(ctx context.Context, args ...string) {
+	if len(args) < 3 {
+		fatalf("usage: cbt increment <table> <row> family:[column]=delta ...")
+	}
+	tbl := getClient().Open(args[0])
+	row := args[1]
+	rmw := bigtable.NewReadModifyWrite()
+	for _, arg := range args[2:] {
+		m := setArg.FindStringSubmatch(arg)
+		if m == nil {
+			fatalf("Bad increment arg %q", arg)
+		}
+		delta, err := strconv.ParseInt(m[3], 0, 64)
+		if err != nil {
+			fatalf("Bad delta %q", m[3])
+		}
+		rmw.Increment(m[1], m[2], delta)
+	}
+	applyReadModifyWrite(ctx, tbl, row, rmw, "int64")
+}
+
+func doAppend(ctx context.Context, args ...string) {
+	if len(args) < 3 {
+		fatalf("usage: cbt append <table> <row> family:[column]=val ...")
+	}
+	tbl := getClient().Open(args[0])
+	row := args[1]
+	rmw := bigtable.NewReadModifyWrite()
+	for _, arg := range args[2:] {
+		m := setArg.FindStringSubmatch(arg)
+		if m == nil {
+			fatalf("Bad append arg %q", arg)
+		}
+		rmw.AppendValue(m[1], m[2], []byte(m[3]))
+	}
+	applyReadModifyWrite(ctx, tbl, row, rmw, "string")
+}
+
+// applyReadModifyWrite applies rmw to a row and prints the modified cells.
+func applyReadModifyWrite(ctx context.Context, tbl *bigtable.Table, row string, rmw *bigtable.ReadModifyWrite, decode string) {
+	r, err := tbl.ApplyReadModifyWrite(ctx, row, rmw)
+	if err != nil {
+		fatalf("Applying read-modify-write: %v", err)
+	}
+	rp := newRowPrinter(map[string]string{"decode": decode})
+	rp.print(r)
+	rp.flush()
+}
+
+func doCheckAndSet(ctx context.Context, args ...string) {
+	if len(args) < 4 {
+		fatalf("usage: cbt checkandset <table> <row> <filter> family:[column]=val[@ts] ...")
+	}
+	tbl := getClient().Open(args[0])
+	row := args[1]
+	cond := parseFilter(parseArgs(args[2:3], "columnregex", "valueregex"))
+	if cond == nil {
+		fatalf("Bad filter %q", args[2])
+	}
+	mut := bigtable.NewCondMutation(cond, parseSetArgs(args[3:]), nil)
+	var matched bool
+	if err := tbl.Apply(ctx, row, mut, bigtable.GetCondMutationResult(&matched)); err != nil {
+		fatalf("Applying mutation: %v", err)
+	}
+	if matched {
+		fmt.Println("Filter matched; cells set")
+	} else {
+		fmt.Println("Filter did not match; nothing set")
 	}
 }
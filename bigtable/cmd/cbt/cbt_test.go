@@ -0,0 +1,232 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "  read  mytable ", want: []string{"read", "mytable"}},
+		{in: `set t r "f:c=hello world"`, want: []string{"set", "t", "r", "f:c=hello world"}},
+		{in: `set t r f:c="a\tb\x00"`, want: []string{"set", "t", "r", "f:c=a\tb\x00"}},
+		{in: `set t r 'f:c=it''s "raw"'`, want: []string{"set", "t", "r", `f:c=its "raw"`}},
+		{in: `set t r "f:c=oops`, err: true},
+		{in: `set t r 'f:c=oops`, err: true},
+	}
+	for _, tc := range tests {
+		got, err := splitLine(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("splitLine(%q) = %q, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitLine(%q): %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitLine(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseGCPolicy(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string // empty for an error
+	}{
+		{[]string{"maxversions=3"}, "version() > 3"},
+		{[]string{"maxage=7d"}, "age() > 7d"},
+		{[]string{"maxage=36h", "and", "maxversions=1"}, "(age() > 36h) && (version() > 1)"},
+		{
+			[]string{"maxversions=5", "or", "maxage=1d", "and", "maxversions=1"},
+			"(version() > 5) || ((age() > 1d) && (version() > 1))",
+		},
+		{[]string{"maxversions=0"}, ""},
+		{[]string{"maxage=forever"}, ""},
+		{[]string{"maxversions=3", "and"}, ""},
+		{[]string{"maxversions=3", "xor", "maxage=1d"}, ""},
+		{[]string{"minversions=3"}, ""},
+	}
+	for _, tc := range tests {
+		pol, err := parseGCPolicy(tc.args)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("parseGCPolicy(%q) = %q, want error", tc.args, pol)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGCPolicy(%q): %v", tc.args, err)
+			continue
+		}
+		if got := pol.String(); got != tc.want {
+			t.Errorf("parseGCPolicy(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestCommandsSorted(t *testing.T) {
+	// cbt help and cbt doc list commands in table order.
+	for i := 1; i < len(commands); i++ {
+		if commands[i-1].Name >= commands[i].Name {
+			t.Errorf("command %q is listed before %q", commands[i-1].Name, commands[i].Name)
+		}
+	}
+}
+
+const testConfig = `project = my-project
+zone = us-central1-b
+
+# Development uses the emulator.
+[dev]
+emulator = localhost:8086
+
+[prod]
+cluster = prod
+zone = us-east1-c
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig(testConfig)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if want := []string{"default", "dev", "prod"}; !reflect.DeepEqual(c.names, want) {
+		t.Errorf("profile names = %q, want %q", c.names, want)
+	}
+	want := map[string]string{"project": "my-project", "zone": "us-east1-c", "cluster": "prod"}
+	if got := c.settings("prod"); !reflect.DeepEqual(got, want) {
+		t.Errorf("prod settings = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"project", "colour = blue", "[]\nproject = p"} {
+		if _, err := parseConfig(bad); err == nil {
+			t.Errorf("parseConfig(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	c, err := parseConfig(testConfig)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	c.set("default", "cluster", "main")
+	c.set("dev", "emulator", "localhost:9000")
+	c.set("prod", "zone", "")
+	c.set("test", "project", "test-project")
+	want := `project = my-project
+zone = us-central1-b
+cluster = main
+
+# Development uses the emulator.
+[dev]
+emulator = localhost:9000
+
+[prod]
+cluster = prod
+
+[test]
+project = test-project`
+	if got := strings.Join(c.lines, "\n"); got != want {
+		t.Errorf("after set, config is\n%s\nwant\n%s", got, want)
+	}
+	if got := c.settings("prod")["zone"]; got != "us-central1-b" {
+		t.Errorf("prod zone = %q, want inherited us-central1-b", got)
+	}
+}
+
+func TestConfigSetNewProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("CBT_PROFILE", os.Getenv("CBT_PROFILE"))
+	defer func(p, proj string) { *profile, *project = p, proj }(*profile, *project)
+	os.Setenv("HOME", dir)
+	os.Setenv("CBT_PROFILE", "staging")
+	*profile, *project = "", ""
+
+	// Run as the shell does, so that fatalf panics instead of exiting.
+	inShell = true
+	defer func() { inShell = false }()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("cbt config failed: %v", r)
+		}
+	}()
+
+	// The selected profile does not exist until cbt config set creates it.
+	selectProfile()
+	if *profile != "staging" {
+		t.Fatalf("profile = %q, want staging from $CBT_PROFILE", *profile)
+	}
+	doConfig(context.Background(), "set", "staging", "project=staging-project")
+	applyConfig()
+	if *project != "staging-project" {
+		t.Errorf("project = %q, want staging-project", *project)
+	}
+}
+
+func TestProfileOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer func(p, cr, em string) { *profile, *creds, *emulator = p, cr, em }(*profile, *creds, *emulator)
+	os.Setenv("HOME", dir)
+	const cfg = `creds = dev-key.json
+emulator = localhost:8086
+
+[prod]
+creds = none
+`
+	if err := ioutil.WriteFile(configFilename(), []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// prod overrides the inherited creds, and does not inherit the emulator.
+	*profile, *creds, *emulator = "prod", "", ""
+	applyConfig()
+	if *creds != "" || *emulator != "" {
+		t.Errorf("-profile prod: creds = %q, emulator = %q; want neither", *creds, *emulator)
+	}
+
+	*profile = "default"
+	applyConfig()
+	if *creds != "dev-key.json" || *emulator != "localhost:8086" {
+		t.Errorf("default profile: creds = %q, emulator = %q; want dev-key.json and localhost:8086", *creds, *emulator)
+	}
+}
@@ -26,21 +26,107 @@ Usage:
 
 The commands are:
 
+	append                    Append to the value of a cell
+	checkandset               Set cells if a filter matches
+	config                    Manage configuration profiles
+	copytable                 Copy rows to another table
+	count                     Count rows in a table
 	createfamily              Create a column family
 	createtable               Create a table
 	deletefamily              Delete a column family
 	deleterow                 Delete a row
 	deletetable               Delete a table
 	doc                       Print documentation for cbt
+	droprange                 Delete all rows with a prefix
+	export                    Export rows to a file
 	help                      Print help text
+	import                    Import rows from a file
+	increment                 Increment the value of a cell
+	loadtest                  Generate load and report latencies
 	lookup                    Read from a single row
 	ls                        List tables and column families
 	read                      Read rows
+	renametable               Rename a table
 	set                       Set value of a cell
+	setgcpolicy               Set the GC policy for a column family
+	shell                     Run commands interactively
 
 Use "cbt help <command>" for more information about a command.
 
 
+Append to the value of a cell
+
+Usage:
+	cbt append <table> <row> family:column=val ...
+	  family:column=val may be repeated to append to multiple cells.
+
+	  An unset cell is treated as empty. The new values are printed.
+
+
+
+
+Set cells if a filter matches
+
+Usage:
+	cbt checkandset <table> <row> <filter> family:column=val[@ts] ...
+	  <filter> is one of
+	    columnregex=<regex>	Match if the row has a column whose qualifier matches this regex
+	    valueregex=<regex>	Match if the row has a cell whose value matches this regex
+
+	  The cells are set, as by cbt set, only if the filter matches the row.
+	  Whether it matched is printed.
+
+
+
+
+Manage configuration profiles
+
+Usage:
+	cbt config list				List profiles, marking the current one
+	cbt config show [profile]			Show the settings of a profile; by default, the current one
+	cbt config set <profile> key=val ...	Set values in a profile, creating it if needed
+
+	  Keys are project, zone, cluster, creds and emulator.
+	  An empty val removes the key from the profile.
+	  A val of none overrides a value inherited from the default profile.
+	  The emulator key is not inherited.
+	  The default profile is named default.
+
+
+
+
+Copy rows to another table
+
+Usage:
+	cbt copytable <table> <dsttable> [start=<row>] [limit=<row>] [prefix=<prefix>] [batchsize=<n>]
+			[dstproject=<project>] [dstzone=<zone>] [dstcluster=<cluster>]
+	  start=<row>			Start copying at this row
+	  limit=<row>			Stop copying before this row
+	  prefix=<prefix>		Copy rows with this prefix
+	  batchsize=<n>			Number of rows to apply per batch, 16 at a time (default 100)
+	  dstproject=<project>		Project of <dsttable>; by default, the -project flag
+	  dstzone=<zone>		Zone of <dsttable>; by default, the -zone flag
+	  dstcluster=<cluster>		Cluster of <dsttable>; by default, the -cluster flag
+
+	  Every version of each cell is copied with its timestamp.
+	  <dsttable> must already exist, with the same column families.
+
+
+
+
+Count rows in a table
+
+Usage:
+	cbt count <table> [start=<row>] [limit=<row>] [prefix=<prefix>] [rowregex=<regex>]
+	  start=<row>		Start counting at this row
+	  limit=<row>		Stop counting before this row
+	  prefix=<prefix>	Count rows with this prefix
+	  rowregex=<regex>	Count rows whose key matches this regex
+
+
+
+
+
 Create a column family
 
 Usage:
@@ -89,6 +175,34 @@ Usage:
 
 
 
+Delete all rows with a prefix
+
+Usage:
+	cbt droprange <table> prefix=<prefix> [batchsize=<n>]
+	  prefix=<prefix>	Delete rows with this prefix, which must not be empty
+	  batchsize=<n>		Number of rows to delete per batch, 16 at a time (default 100)
+
+
+
+
+Export rows to a file
+
+Usage:
+	cbt export <table> <file> [format=<format>] [start=<row>] [limit=<row>] [prefix=<prefix>]
+	  format=<format>	csv or json; by default, taken from the file extension
+	  start=<row>		Start exporting at this row
+	  limit=<row>		Stop exporting before this row
+	  prefix=<prefix>	Export rows with this prefix
+
+	  A <file> of - means standard output.
+	  CSV has a header of the row key followed by family:column names,
+	  and holds the latest value of each cell.
+	  JSON has one object per line, holding every cell version and timestamp,
+	  with base64-encoded values.
+
+
+
+
 Print help text
 
 Usage:
@@ -97,10 +211,65 @@ Usage:
 
 
 
+Import rows from a file
+
+Usage:
+	cbt import <table> <file> [format=<format>] [batchsize=<n>]
+	  format=<format>	csv or json; by default, taken from the file extension
+	  batchsize=<n>		Number of rows to apply per batch, 16 at a time (default 100)
+
+	  A <file> of - means standard input.
+	  The file format is as written by `cbt export`.
+	  Empty CSV fields are not set.
+
+
+
+
+Increment the value of a cell
+
+Usage:
+	cbt increment <table> <row> family:column=delta ...
+	  family:column=delta may be repeated to increment multiple cells.
+
+	  delta is an integer, which may be negative.
+	  Values are 8-byte big-endian integers; an unset cell is treated as zero.
+	  The new values are printed.
+
+
+
+
+Generate load and report latencies
+
+Usage:
+	cbt loadtest <table> <family> [duration=<d>] [concurrency=<n>] [reads=<fraction>]
+			[keys=<n>] [distribution=<dist>] [valuesize=<bytes>]
+	  duration=<d>			How long to run, such as 30s (default 10s)
+	  concurrency=<n>		Number of concurrent workers (default 10)
+	  reads=<fraction>		Fraction of operations that are reads (default 0.5)
+	  keys=<n>			Number of distinct row keys (default 10000)
+	  distribution=<dist>		uniform (default), zipf or sequential
+	  valuesize=<bytes>		Size of written values (default 100)
+
+	  Reads fetch whole rows; writes set <family>:col.
+	  Latency percentiles are reported for each kind of operation.
+
+
+
+
 Read from a single row
 
 Usage:
-	cbt lookup <table> <row>
+	cbt lookup <table> <row> [columnregex=<regex>] [valueregex=<regex>] [versions=<n>]
+			[output=<output>] [decode=<decoding>]
+	  columnregex=<regex>	Read only columns whose qualifier matches this regex
+	  valueregex=<regex>	Read only cells whose value matches this regex
+	  versions=<n>		Read only the latest <n> versions of each column
+	  output=<output>	text (default), json or table
+	  decode=<decoding>	Show values as string (default), hex or int64
+
+	  json output has one object per row, on a line of its own.
+	  int64 decoding reads 8-byte values as big-endian integers,
+	  as used by increments; other values are shown as strings.
 
 
 
@@ -109,7 +278,7 @@ List tables and column families
 
 Usage:
 	cbt ls			List tables
-	cbt ls <table>		List column families in <table>
+	cbt ls <table>		List column families in <table>, with their GC policies
 
 
 
@@ -118,10 +287,29 @@ Read rows
 
 Usage:
 	cbt read <table> [start=<row>] [limit=<row>] [prefix=<prefix>]
+			[rowregex=<regex>] [columnregex=<regex>] [valueregex=<regex>] [versions=<n>]
+			[output=<output>] [decode=<decoding>]
 	  start=<row>		Start reading at this row
 	  limit=<row>		Stop reading before this row
 	  prefix=<prefix>	Read rows with this prefix
+	  rowregex=<regex>	Read rows whose key matches this regex
+	  columnregex=<regex>	Read only columns whose qualifier matches this regex
+	  valueregex=<regex>	Read only cells whose value matches this regex
+	  versions=<n>		Read only the latest <n> versions of each column
+	  output=<output>	text (default), json or table
+	  decode=<decoding>	Show values as string (default), hex or int64
 
+	  json output has one object per row, on a line of its own.
+	  int64 decoding reads 8-byte values as big-endian integers,
+	  as used by increments; other values are shown as strings.
+
+
+
+
+Rename a table
+
+Usage:
+	cbt renametable <table> <newname>
 
 
 
@@ -139,5 +327,34 @@ Usage:
 
 
 
+Set the GC policy for a column family
+
+Usage:
+	cbt setgcpolicy <table> <family> <policy> [(and|or) <policy> ...]
+	  <policy> is one of
+	    maxversions=<n>	Keep only the latest <n> versions of each cell
+	    maxage=<d>		Keep only cells younger than <d>, such as 12h or 7d
+
+	  Cells are collected when the whole policy applies to them;
+	  and binds more tightly than or.
+
+
+
+
+Run commands interactively
+
+Usage:
+	cbt shell
+	  Reads commands, without the leading `cbt`, until exit, quit or end of input.
+	  Arguments may be quoted with "double quotes" (Go syntax) or 'single quotes'.
+	  The tab key completes command, table and family names,
+	  and the up and down arrow keys step through the session's history.
+
+	  use <table>		Make later commands apply to <table>, omitting it from their arguments
+	  use			Stop applying commands to a table
+
+
+
+
 */
 package main
@@ -0,0 +1,306 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// The config file and its profiles.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// defaultProfile is the name of the profile holding settings outside any section.
+const defaultProfile = "default"
+
+// configKeys are the settings a profile may hold. Each has a flag of the same name.
+var configKeys = []string{"project", "zone", "cluster", "creds", "emulator"}
+
+// uninherited are the keys that other profiles do not inherit from the
+// default profile. An emulator is for particular profiles; inheriting one
+// would silently send, say, a production profile's traffic to it.
+var uninherited = map[string]bool{"emulator": true}
+
+// noValue is the value by which a profile overrides an inherited one,
+// leaving the key unset.
+const noValue = "none"
+
+// config is a parsed config file.
+// Settings outside any [name] section belong to the default profile,
+// and, except for those in uninherited, are inherited by every other profile.
+type config struct {
+	lines    []string                     // the file, kept for rewriting by "cbt config set"
+	names    []string                     // profile names, in file order
+	profiles map[string]map[string]string // profile name -> key -> value
+}
+
+func configFilename() string {
+	// TODO(dsymonds): Might need tweaking for Windows.
+	return filepath.Join(os.Getenv("HOME"), ".cbtrc")
+}
+
+// loadConfig reads the config file. A missing file is an empty config.
+func loadConfig() *config {
+	filename := configFilename()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		fatalf("Reading %s: %v", filename, err)
+	}
+	c, err := parseConfig(string(data))
+	if err != nil {
+		fatalf("Bad %s: %v", filename, err)
+	}
+	return c
+}
+
+func parseConfig(data string) (*config, error) {
+	c := &config{
+		names:    []string{defaultProfile},
+		profiles: map[string]map[string]string{defaultProfile: {}},
+	}
+	if data != "" {
+		c.lines = strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	}
+	cur := defaultProfile
+	for _, line := range c.lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := sectionName(line); ok {
+			if name == "" {
+				return nil, fmt.Errorf("bad section %q", line)
+			}
+			cur = name
+			if _, ok := c.profiles[cur]; !ok {
+				c.names = append(c.names, cur)
+				c.profiles[cur] = make(map[string]string)
+			}
+			continue
+		}
+		key, val, ok := splitSetting(line)
+		if !ok {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		if !validConfigKey(key) {
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		c.profiles[cur][key] = val
+	}
+	return c, nil
+}
+
+// sectionName returns the profile name from a "[name]" line.
+func sectionName(line string) (string, bool) {
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", false
+	}
+	return strings.TrimSpace(line[1 : len(line)-1]), true
+}
+
+func splitSetting(line string) (key, val string, ok bool) {
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
+
+func validConfigKey(key string) bool {
+	for _, k := range configKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// settings returns the settings of a profile, including those it inherits.
+func (c *config) settings(profile string) map[string]string {
+	s := make(map[string]string)
+	for k, v := range c.profiles[defaultProfile] {
+		if profile == defaultProfile || !uninherited[k] {
+			s[k] = v
+		}
+	}
+	for k, v := range c.profiles[profile] {
+		s[k] = v
+	}
+	for k, v := range s {
+		if v == noValue {
+			delete(s, k)
+		}
+	}
+	return s
+}
+
+// set sets a key in a profile, creating the profile if needed.
+// An empty value removes the key. Other lines of the file are left alone.
+func (c *config) set(profile, key, val string) {
+	// Find the line setting the key, and the last line of the profile's section.
+	keyLine, lastLine := -1, -1
+	cur := defaultProfile
+	for i, line := range c.lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := sectionName(line); ok {
+			cur = name
+			if cur == profile {
+				lastLine = i
+			}
+			continue
+		}
+		if cur != profile {
+			continue
+		}
+		lastLine = i
+		if k, _, _ := splitSetting(line); k == key {
+			keyLine = i
+		}
+	}
+
+	setting := key + " = " + val
+	switch {
+	case keyLine >= 0 && val == "":
+		c.lines = append(c.lines[:keyLine], c.lines[keyLine+1:]...)
+	case keyLine >= 0:
+		c.lines[keyLine] = setting
+	case val == "":
+	case lastLine >= 0 || profile == defaultProfile:
+		// Settings of the default profile must precede any section.
+		i := lastLine + 1
+		c.lines = append(c.lines[:i], append([]string{setting}, c.lines[i:]...)...)
+	default:
+		if len(c.lines) > 0 {
+			c.lines = append(c.lines, "")
+		}
+		c.lines = append(c.lines, "["+profile+"]", setting)
+	}
+
+	nc, err := parseConfig(strings.Join(c.lines, "\n"))
+	if err != nil {
+		// Only valid keys are set, so this should not happen.
+		fatalf("Updating config: %v", err)
+	}
+	*c = *nc
+}
+
+func (c *config) save() {
+	filename := configFilename()
+	data := strings.Join(c.lines, "\n") + "\n"
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		fatalf("Writing %s: %v", filename, err)
+	}
+}
+
+// selectProfile sets -profile, if it was not given, from $CBT_PROFILE or else to the default profile.
+// The profile need not exist yet; "cbt config set" may be about to create it.
+func selectProfile() {
+	if *profile == "" {
+		*profile = os.Getenv("CBT_PROFILE")
+	}
+	if *profile == "" {
+		*profile = defaultProfile
+	}
+}
+
+// applyConfig sets each flag that was not given on the command line
+// from the selected profile, which must exist.
+func applyConfig() {
+	c := loadConfig()
+	if _, ok := c.profiles[*profile]; !ok {
+		fatalf("Unknown profile %q in %s", *profile, configFilename())
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for k, v := range c.settings(*profile) {
+		if !given[k] {
+			flag.Set(k, v)
+		}
+	}
+}
+
+func doConfig(ctx context.Context, args ...string) {
+	if len(args) == 0 {
+		fatalf("usage: cbt config (list | show [profile] | set <profile> key=val ...)")
+	}
+	c := loadConfig()
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			fatalf("usage: cbt config list")
+		}
+		for _, name := range c.names {
+			mark := " "
+			if name == *profile {
+				mark = "*"
+			}
+			fmt.Printf("%s %s\n", mark, name)
+		}
+	case "show":
+		name := *profile
+		switch len(args) {
+		case 1:
+		case 2:
+			name = args[1]
+		default:
+			fatalf("usage: cbt config show [profile]")
+		}
+		if _, ok := c.profiles[name]; !ok {
+			fatalf("Unknown profile %q", name)
+		}
+		s := c.settings(name)
+		var keys []string
+		for k := range s {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Printf("[%s]\n", name)
+		for _, k := range keys {
+			fmt.Printf("%s = %s\n", k, s[k])
+		}
+	case "set":
+		if len(args) < 3 {
+			fatalf("usage: cbt config set <profile> key=val ...")
+		}
+		name := args[1]
+		if strings.ContainsAny(name, "[]") || strings.TrimSpace(name) != name || name == "" {
+			fatalf("Bad profile name %q", name)
+		}
+		for _, arg := range args[2:] {
+			key, val, ok := splitSetting(arg)
+			if !ok {
+				fatalf("Bad arg %q", arg)
+			}
+			if !validConfigKey(key) {
+				fatalf("Unknown key %q; valid keys are %s", key, strings.Join(configKeys, ", "))
+			}
+			c.set(name, key, val)
+		}
+		c.save()
+	default:
+		fatalf("Unknown config command %q", args[0])
+	}
+}
@@ -0,0 +1,493 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Bulk import, export and copying of table data.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/bigtable"
+)
+
+// File formats understood by import and export.
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
+)
+
+const (
+	defaultBatchSize     = 100
+	maxConcurrentApplies = 16
+)
+
+// fileFormat returns the format named by the "format" arg,
+// or else the one implied by the file's extension.
+func fileFormat(parsed map[string]string, filename string) string {
+	switch format := parsed["format"]; format {
+	case formatCSV, formatJSON:
+		return format
+	case "":
+	default:
+		fatalf("Unknown format %q", format)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return formatCSV
+	case ".json", ".jsonl", ".ndjson":
+		return formatJSON
+	}
+	fatalf("Can't tell the format of %q; use format=csv or format=json", filename)
+	panic("unreachable")
+}
+
+// jsonRow is the newline-delimited JSON representation of a row.
+// Every version of every cell is preserved.
+type jsonRow struct {
+	Key   string     `json:"key"`
+	Cells []jsonCell `json:"cells"`
+}
+
+type jsonCell struct {
+	Family    string `json:"family"`
+	Column    string `json:"column"`
+	Timestamp *int64 `json:"timestamp,omitempty"` // microseconds; the import time if missing
+	Value     []byte `json:"value"`               // base64 encoded
+}
+
+// progress periodically reports how many rows have been processed.
+type progress struct {
+	verb string
+	n    int
+	last time.Time
+}
+
+func (p *progress) add(n int) {
+	p.n += n
+	if now := time.Now(); now.Sub(p.last) >= time.Second {
+		fmt.Fprintf(os.Stderr, "%s %d rows\n", p.verb, p.n)
+		p.last = now
+	}
+}
+
+func (p *progress) done() {
+	fmt.Fprintf(os.Stderr, "%s %d rows in total\n", p.verb, p.n)
+}
+
+func doExport(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		fatalf("usage: cbt export <table> <file> [args ...]")
+	}
+	table, filename := args[0], args[1]
+	parsed := parseArgs(args[2:], "format", "start", "limit", "prefix")
+	format := fileFormat(parsed, filename)
+	rr := parseRowRange(parsed)
+	tbl := getClient().Open(table)
+
+	out := os.Stdout
+	if filename != "-" {
+		f, err := os.Create(filename)
+		if err != nil {
+			fatalf("Creating export file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+
+	var write func(bigtable.Row) error
+	flush := func() error { return nil }
+	switch format {
+	case formatCSV:
+		// The header needs every column, so find them first.
+		cols := make(map[string]bool)
+		err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+			for _, ris := range r {
+				for _, ri := range ris {
+					cols[ri.Column] = true
+				}
+			}
+			return true
+		}, bigtable.RowFilter(bigtable.StripValueFilter()))
+		if err != nil {
+			fatalf("Reading columns: %v", err)
+		}
+		w := newCSVRowWriter(bw, cols)
+		write, flush = w.write, w.flush
+	case formatJSON:
+		enc := json.NewEncoder(bw)
+		write = func(r bigtable.Row) error { return enc.Encode(newJSONRow(r)) }
+	}
+
+	p := &progress{verb: "Exported", last: time.Now()}
+	var werr error
+	err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+		if werr = write(r); werr != nil {
+			return false
+		}
+		p.add(1)
+		return true
+	})
+	if err != nil {
+		fatalf("Reading rows: %v", err)
+	}
+	if werr != nil {
+		fatalf("Writing export file: %v", werr)
+	}
+	// The CSV writer buffers records, and writes the header of an empty
+	// export, so it must be flushed before the buffer beneath it.
+	if err := flush(); err != nil {
+		fatalf("Writing export file: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		fatalf("Writing export file: %v", err)
+	}
+	p.done()
+}
+
+// csvRowWriter writes rows as CSV records. The first field of each record
+// is the row key, and the rest are the latest values of the columns
+// named in the header.
+type csvRowWriter struct {
+	w       *csv.Writer
+	cols    []string
+	index   map[string]int // column name to field index
+	started bool
+}
+
+func newCSVRowWriter(w io.Writer, cols map[string]bool) *csvRowWriter {
+	cw := &csvRowWriter{
+		w:     csv.NewWriter(w),
+		index: make(map[string]int),
+	}
+	for col := range cols {
+		cw.cols = append(cw.cols, col)
+	}
+	sort.Strings(cw.cols)
+	for i, col := range cw.cols {
+		cw.index[col] = i + 1
+	}
+	return cw
+}
+
+func (cw *csvRowWriter) writeHeader() error {
+	cw.started = true
+	return cw.w.Write(append([]string{"key"}, cw.cols...))
+}
+
+func (cw *csvRowWriter) write(r bigtable.Row) error {
+	if !cw.started {
+		if err := cw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	rec := make([]string, len(cw.cols)+1)
+	rec[0] = r.Key()
+	latest := make(map[string]bigtable.Timestamp)
+	for _, ris := range r {
+		for _, ri := range ris {
+			i, ok := cw.index[ri.Column]
+			if !ok {
+				return fmt.Errorf("column %q in row %q appeared after the export started", ri.Column, ri.Row)
+			}
+			if ts, seen := latest[ri.Column]; seen && ts >= ri.Timestamp {
+				continue
+			}
+			latest[ri.Column] = ri.Timestamp
+			rec[i] = string(ri.Value)
+		}
+	}
+	return cw.w.Write(rec)
+}
+
+func (cw *csvRowWriter) flush() error {
+	if !cw.started {
+		// Write a header even for an empty export.
+		if err := cw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func newJSONRow(r bigtable.Row) *jsonRow {
+	jr := &jsonRow{Key: r.Key()}
+	var fams []string
+	for fam := range r {
+		fams = append(fams, fam)
+	}
+	sort.Strings(fams)
+	for _, fam := range fams {
+		ris := r[fam]
+		sort.Sort(byColumn(ris))
+		for _, ri := range ris {
+			ts := int64(ri.Timestamp)
+			jr.Cells = append(jr.Cells, jsonCell{
+				Family:    fam,
+				Column:    ri.Column[len(fam)+1:],
+				Timestamp: &ts,
+				Value:     ri.Value,
+			})
+		}
+	}
+	return jr
+}
+
+// parseBatchSize returns the "batchsize" arg, or the default.
+func parseBatchSize(parsed map[string]string) int {
+	return parsePositiveInt(parsed, "batchsize", defaultBatchSize)
+}
+
+// parsePositiveInt returns the positive integer value of parsed[key], or def if it is unset.
+func parsePositiveInt(parsed map[string]string, key string, def int) int {
+	v := parsed[key]
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		fatalf("Bad %s %q", key, v)
+	}
+	return n
+}
+
+// rowMutation is a mutation to apply to a row.
+type rowMutation struct {
+	key string
+	mut *bigtable.Mutation
+}
+
+func doImport(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		fatalf("usage: cbt import <table> <file> [args ...]")
+	}
+	table, filename := args[0], args[1]
+	parsed := parseArgs(args[2:], "format", "batchsize")
+	format := fileFormat(parsed, filename)
+	batchSize := parseBatchSize(parsed)
+	tbl := getClient().Open(table)
+
+	in := os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			fatalf("Opening import file: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	br := bufio.NewReader(in)
+
+	var next func() (*rowMutation, error)
+	switch format {
+	case formatCSV:
+		next = newCSVRowReader(br)
+	case formatJSON:
+		next = newJSONRowReader(br)
+	}
+
+	p := &progress{verb: "Imported", last: time.Now()}
+	var batch []*rowMutation
+	for {
+		r, err := next()
+		if err != nil && err != io.EOF {
+			fatalf("Reading import file: %v", err)
+		}
+		if r != nil {
+			batch = append(batch, r)
+		}
+		if len(batch) == batchSize || (err == io.EOF && len(batch) > 0) {
+			applyBatch(ctx, tbl, batch)
+			p.add(len(batch))
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	p.done()
+}
+
+// applyBatch applies the mutations of a batch of rows,
+// at most maxConcurrentApplies at a time.
+func applyBatch(ctx context.Context, tbl *bigtable.Table, batch []*rowMutation) {
+	sem := make(chan bool, maxConcurrentApplies)
+	errc := make(chan error, len(batch))
+	var wg sync.WaitGroup
+	for _, r := range batch {
+		wg.Add(1)
+		sem <- true
+		go func(r *rowMutation) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := tbl.Apply(ctx, r.key, r.mut); err != nil {
+				errc <- fmt.Errorf("row %q: %v", r.key, err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		fatalf("Applying mutation: %v", err)
+	}
+}
+
+// newCSVRowReader returns a function that reads rows from CSV.
+// The header names the row key field first, followed by family:column names.
+// Empty fields are not set.
+func newCSVRowReader(r io.Reader) func() (*rowMutation, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return func() (*rowMutation, error) { return nil, io.EOF }
+	}
+	if err != nil {
+		fatalf("Reading CSV header: %v", err)
+	}
+	type column struct{ fam, col string }
+	cols := make([]column, len(header))
+	for i, h := range header[1:] {
+		m := strings.SplitN(h, ":", 2)
+		if len(m) != 2 || m[0] == "" {
+			fatalf("Bad CSV header field %q; want family:column", h)
+		}
+		cols[i+1] = column{m[0], m[1]}
+	}
+
+	return func() (*rowMutation, error) {
+		for {
+			rec, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			ts := bigtable.Now()
+			mut := bigtable.NewMutation()
+			empty := true
+			for i, val := range rec[1:] {
+				if val == "" {
+					continue
+				}
+				mut.Set(cols[i+1].fam, cols[i+1].col, ts, []byte(val))
+				empty = false
+			}
+			if !empty {
+				return &rowMutation{key: rec[0], mut: mut}, nil
+			}
+		}
+	}
+}
+
+// newJSONRowReader returns a function that reads rows from newline-delimited JSON,
+// in the format written by export.
+func newJSONRowReader(r io.Reader) func() (*rowMutation, error) {
+	dec := json.NewDecoder(r)
+	return func() (*rowMutation, error) {
+		for {
+			var jr jsonRow
+			if err := dec.Decode(&jr); err != nil {
+				return nil, err
+			}
+			if len(jr.Cells) == 0 {
+				continue
+			}
+			now := bigtable.Now()
+			mut := bigtable.NewMutation()
+			for _, c := range jr.Cells {
+				ts := now
+				if c.Timestamp != nil {
+					ts = bigtable.Timestamp(*c.Timestamp)
+				}
+				mut.Set(c.Family, c.Column, ts, c.Value)
+			}
+			return &rowMutation{key: jr.Key, mut: mut}, nil
+		}
+	}
+}
+
+func doCopyTable(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		fatalf("usage: cbt copytable <table> <dsttable> [args ...]")
+	}
+	src, dst := args[0], args[1]
+	parsed := parseArgs(args[2:], "start", "limit", "prefix", "batchsize",
+		"dstproject", "dstzone", "dstcluster")
+	rr := parseRowRange(parsed)
+	batchSize := parseBatchSize(parsed)
+
+	dstClient := getClient()
+	dstProject, dstZone, dstCluster := *project, *zone, *cluster
+	if v := parsed["dstproject"]; v != "" {
+		dstProject = v
+	}
+	if v := parsed["dstzone"]; v != "" {
+		dstZone = v
+	}
+	if v := parsed["dstcluster"]; v != "" {
+		dstCluster = v
+	}
+	if dstProject != *project || dstZone != *zone || dstCluster != *cluster {
+		var err error
+		dstClient, err = bigtable.NewClient(ctx, dstProject, dstZone, dstCluster, clientOptions()...)
+		if err != nil {
+			fatalf("Making destination bigtable.Client: %v", err)
+		}
+		defer dstClient.Close()
+	}
+	srcTbl, dstTbl := getClient().Open(src), dstClient.Open(dst)
+
+	p := &progress{verb: "Copied", last: time.Now()}
+	var batch []*rowMutation
+	flush := func() {
+		applyBatch(ctx, dstTbl, batch)
+		p.add(len(batch))
+		batch = batch[:0]
+	}
+	err := srcTbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+		// Copy every version of every cell, keeping its timestamp.
+		mut := bigtable.NewMutation()
+		for fam, ris := range r {
+			for _, ri := range ris {
+				mut.Set(fam, ri.Column[len(fam)+1:], ri.Timestamp, ri.Value)
+			}
+		}
+		batch = append(batch, &rowMutation{key: r.Key(), mut: mut})
+		if len(batch) == batchSize {
+			flush()
+		}
+		return true
+	})
+	if err != nil {
+		fatalf("Reading rows: %v", err)
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	p.done()
+}
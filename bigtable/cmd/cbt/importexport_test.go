@@ -0,0 +1,165 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/bigtable"
+	"google.golang.org/cloud/bigtable/bttest"
+)
+
+// testCells are written to the source table of the round-trip tests.
+var testCells = []struct {
+	row, fam, col string
+	ts            bigtable.Timestamp
+	val           string
+}{
+	{"r1", "f", "a", 1000, "plain"},
+	{"r1", "f", "b", 1000, "comma, \"quote\"\nnewline"},
+	{"r2", "f", "a", 1000, "\x00\xff\xfe\x80binary"},
+	{"r2", "g", "c", 1000, "old"},
+	{"r2", "g", "c", 2000, "new"},
+	{"r3", "g", "c", 3000, "only"},
+}
+
+// setupTables starts a bttest server, points the package client at it,
+// and creates tables src, holding testCells, and dst, which is empty.
+func setupTables(t *testing.T) (ctx context.Context, cleanup func()) {
+	srv, err := bttest.NewServer()
+	if err != nil {
+		t.Fatalf("bttest.NewServer: %v", err)
+	}
+	ctx = context.Background()
+	opts := []bigtable.ClientOption{bigtable.WithCredentials(nil), bigtable.WithInsecureAddr(srv.Addr)}
+	ac, err := bigtable.NewAdminClient(ctx, "proj", "zone", "cluster", opts...)
+	if err != nil {
+		t.Fatalf("NewAdminClient: %v", err)
+	}
+	for _, tbl := range []string{"src", "dst"} {
+		if err := ac.CreateTable(ctx, tbl); err != nil {
+			t.Fatalf("CreateTable: %v", err)
+		}
+		for _, fam := range []string{"f", "g"} {
+			if err := ac.CreateColumnFamily(ctx, tbl, fam); err != nil {
+				t.Fatalf("CreateColumnFamily: %v", err)
+			}
+		}
+	}
+	client, err = bigtable.NewClient(ctx, "proj", "zone", "cluster", opts...)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	src := client.Open("src")
+	for _, c := range testCells {
+		mut := bigtable.NewMutation()
+		mut.Set(c.fam, c.col, c.ts, []byte(c.val))
+		if err := src.Apply(ctx, c.row, mut); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+	return ctx, func() {
+		client.Close()
+		client = nil
+		ac.Close()
+		srv.Close()
+	}
+}
+
+// readTable returns the cells of a table as "row fam:col@ts=value" strings.
+// If latest is set, only the latest version of each cell is returned, without its timestamp.
+func readTable(ctx context.Context, t *testing.T, table string, latest bool) []string {
+	var cells []string
+	err := client.Open(table).ReadRows(ctx, bigtable.InfiniteRange(""), func(r bigtable.Row) bool {
+		newest := make(map[string]bigtable.ReadItem)
+		for _, ris := range r {
+			for _, ri := range ris {
+				if !latest {
+					cells = append(cells, fmt.Sprintf("%s %s@%d=%q", ri.Row, ri.Column, ri.Timestamp, ri.Value))
+				} else if n, ok := newest[ri.Column]; !ok || ri.Timestamp > n.Timestamp {
+					newest[ri.Column] = ri
+				}
+			}
+		}
+		for _, ri := range newest {
+			cells = append(cells, fmt.Sprintf("%s %s=%q", ri.Row, ri.Column, ri.Value))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ReadRows(%s): %v", table, err)
+	}
+	sort.Strings(cells)
+	return cells
+}
+
+func testRoundTrip(t *testing.T, filename string, latest bool) {
+	ctx, cleanup := setupTables(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "cbt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename = filepath.Join(dir, filename)
+
+	doExport(ctx, "src", filename)
+	// A small batch size exercises more than one batch.
+	doImport(ctx, "dst", filename, "batchsize=2")
+
+	want := readTable(ctx, t, "src", latest)
+	if got := readTable(ctx, t, "dst", latest); !reflect.DeepEqual(got, want) {
+		t.Errorf("after export and import, table has\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	// CSV holds only the latest version of each cell, with no timestamp.
+	testRoundTrip(t, "rows.csv", true)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	// JSON holds every version, with its timestamp.
+	testRoundTrip(t, "rows.json", false)
+}
+
+func TestCSVEmptyExport(t *testing.T) {
+	ctx, cleanup := setupTables(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "cbt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "empty.csv")
+
+	doExport(ctx, "src", filename, "prefix=none")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "key\n"; got != want {
+		t.Errorf("empty export is %q, want just the header %q", got, want)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// A simple load generator.
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/bigtable"
+)
+
+// latencies records the latency of each operation of one kind.
+type latencies struct {
+	d    []time.Duration
+	errs int
+}
+
+func (l *latencies) merge(m *latencies) {
+	l.d = append(l.d, m.d...)
+	l.errs += m.errs
+}
+
+// percentile returns the latency below which p percent of operations completed.
+// l.d must be sorted.
+func (l *latencies) percentile(p float64) time.Duration {
+	if len(l.d) == 0 {
+		return 0
+	}
+	i := int(float64(len(l.d)) * p / 100)
+	if i >= len(l.d) {
+		i = len(l.d) - 1
+	}
+	return l.d[i]
+}
+
+type byDuration []time.Duration
+
+func (b byDuration) Len() int           { return len(b) }
+func (b byDuration) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byDuration) Less(i, j int) bool { return b[i] < b[j] }
+
+func doLoadTest(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		fatalf("usage: cbt loadtest <table> <family> [args ...]")
+	}
+	table, family := args[0], args[1]
+	parsed := parseArgs(args[2:], "duration", "concurrency", "reads", "keys", "distribution", "valuesize")
+
+	duration := 10 * time.Second
+	if v := parsed["duration"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			fatalf("Bad duration %q", v)
+		}
+		duration = d
+	}
+	concurrency := parsePositiveInt(parsed, "concurrency", 10)
+	numKeys := parsePositiveInt(parsed, "keys", 10000)
+	valueSize := parsePositiveInt(parsed, "valuesize", 100)
+	reads := 0.5
+	if v := parsed["reads"]; v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			fatalf("Bad reads %q; it must be between 0 and 1", v)
+		}
+		reads = f
+	}
+	dist := parsed["distribution"]
+	switch dist {
+	case "":
+		dist = "uniform"
+	case "uniform", "zipf", "sequential":
+	default:
+		fatalf("Unknown distribution %q", dist)
+	}
+
+	tbl := getClient().Open(table)
+	fmt.Printf("Running %v of load with %d workers: %.0f%% reads over %d %s keys\n",
+		duration, concurrency, reads*100, numKeys, dist)
+
+	var (
+		mu          sync.Mutex
+		allR, allW  latencies
+		wg          sync.WaitGroup
+		deadline    = time.Now().Add(duration)
+		seed        = time.Now().UnixNano()
+		sequentialN int64
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed + int64(i)))
+			var zipf *rand.Zipf
+			if dist == "zipf" && numKeys > 1 {
+				zipf = rand.NewZipf(rnd, 1.1, 1, uint64(numKeys-1))
+			}
+			value := make([]byte, valueSize)
+			var r, w latencies
+			for time.Now().Before(deadline) {
+				var n int
+				switch {
+				case dist == "sequential":
+					mu.Lock()
+					n = int(sequentialN % int64(numKeys))
+					sequentialN++
+					mu.Unlock()
+				case zipf != nil:
+					n = int(zipf.Uint64())
+				default:
+					n = rnd.Intn(numKeys)
+				}
+				key := fmt.Sprintf("loadtest%010d", n)
+
+				start := time.Now()
+				if rnd.Float64() < reads {
+					_, err := tbl.ReadRow(ctx, key)
+					record(&r, start, err)
+				} else {
+					for j := range value {
+						value[j] = byte('a' + rnd.Intn(26))
+					}
+					mut := bigtable.NewMutation()
+					mut.Set(family, "col", bigtable.Now(), value)
+					record(&w, start, tbl.Apply(ctx, key, mut))
+				}
+			}
+			mu.Lock()
+			allR.merge(&r)
+			allW.merge(&w)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OP\tCOUNT\tERRORS\tOPS/S\tP50\tP90\tP99\tP99.9\tMAX\t")
+	for _, op := range []struct {
+		name string
+		l    *latencies
+	}{
+		{"read", &allR},
+		{"write", &allW},
+	} {
+		l := op.l
+		sort.Sort(byDuration(l.d))
+		var max time.Duration
+		if len(l.d) > 0 {
+			max = l.d[len(l.d)-1]
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%v\t\n", op.name, len(l.d), l.errs,
+			float64(len(l.d))/duration.Seconds(),
+			l.percentile(50), l.percentile(90), l.percentile(99), l.percentile(99.9), max)
+	}
+	tw.Flush()
+}
+
+// record records the latency of an operation that started at start.
+// Failed operations are counted, but not included in the latencies.
+func record(l *latencies, start time.Time, err error) {
+	if err != nil {
+		l.errs++
+		return
+	}
+	l.d = append(l.d, time.Since(start))
+}
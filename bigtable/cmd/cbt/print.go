@@ -0,0 +1,156 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// Output of rows read by read and lookup.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/cloud/bigtable"
+)
+
+const outputUsage = "  output=<output>	text (default), json or table\n" +
+	"  decode=<decoding>	Show values as string (default), hex or int64\n" +
+	"\n" +
+	"  json output has one object per row, on a line of its own.\n" +
+	"  int64 decoding reads 8-byte values as big-endian integers,\n" +
+	"  as used by increments; other values are shown as strings."
+
+// rowPrinter prints rows in a chosen output format.
+type rowPrinter struct {
+	output, decode string
+
+	tw  *tabwriter.Writer // for table output
+	enc *json.Encoder     // for json output
+}
+
+func newRowPrinter(parsed map[string]string) *rowPrinter {
+	rp := &rowPrinter{
+		output: parsed["output"],
+		decode: parsed["decode"],
+	}
+	switch rp.output {
+	case "":
+		rp.output = "text"
+	case "text":
+	case "json":
+		rp.enc = json.NewEncoder(os.Stdout)
+	case "table":
+		rp.tw = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(rp.tw, "ROW\tCOLUMN\tTIMESTAMP\tVALUE")
+	default:
+		fatalf("Unknown output %q", rp.output)
+	}
+	switch rp.decode {
+	case "":
+		rp.decode = "string"
+	case "string", "hex", "int64":
+	default:
+		fatalf("Unknown decoding %q", rp.decode)
+	}
+	return rp
+}
+
+// sortedItems returns the items of r ordered by column.
+func sortedItems(r bigtable.Row) []bigtable.ReadItem {
+	var fams []string
+	for fam := range r {
+		fams = append(fams, fam)
+	}
+	sort.Strings(fams)
+	var items []bigtable.ReadItem
+	for _, fam := range fams {
+		ris := r[fam]
+		sort.Sort(byColumn(ris))
+		items = append(items, ris...)
+	}
+	return items
+}
+
+func formatTimestamp(ts bigtable.Timestamp) string {
+	return ts.Time().Format("2006/01/02-15:04:05.000000")
+}
+
+// value returns a value decoded according to rp.decode.
+// Strings are returned quoted unless raw is set.
+func (rp *rowPrinter) value(v []byte, raw bool) interface{} {
+	switch rp.decode {
+	case "hex":
+		return hex.EncodeToString(v)
+	case "int64":
+		if len(v) == 8 {
+			return int64(binary.BigEndian.Uint64(v))
+		}
+	}
+	if raw {
+		return string(v)
+	}
+	return strconv.Quote(string(v))
+}
+
+func (rp *rowPrinter) print(r bigtable.Row) {
+	items := sortedItems(r)
+	switch rp.output {
+	case "text":
+		fmt.Println(strings.Repeat("-", 40))
+		fmt.Println(r.Key())
+		for _, ri := range items {
+			fmt.Printf("  %-40s @ %s\n", ri.Column, formatTimestamp(ri.Timestamp))
+			fmt.Printf("    %v\n", rp.value(ri.Value, false))
+		}
+	case "table":
+		for _, ri := range items {
+			fmt.Fprintf(rp.tw, "%s\t%s\t%s\t%v\n", ri.Row, ri.Column, formatTimestamp(ri.Timestamp), rp.value(ri.Value, false))
+		}
+	case "json":
+		type cell struct {
+			Column    string      `json:"column"`
+			Timestamp int64       `json:"timestamp"`
+			Value     interface{} `json:"value"`
+		}
+		jr := struct {
+			Key   string `json:"key"`
+			Cells []cell `json:"cells"`
+		}{Key: r.Key()}
+		for _, ri := range items {
+			jr.Cells = append(jr.Cells, cell{
+				Column:    ri.Column,
+				Timestamp: int64(ri.Timestamp),
+				Value:     rp.value(ri.Value, true),
+			})
+		}
+		if err := rp.enc.Encode(jr); err != nil {
+			fatalf("Writing output: %v", err)
+		}
+	}
+}
+
+// flush writes any buffered output.
+func (rp *rowPrinter) flush() {
+	if rp.tw != nil {
+		rp.tw.Flush()
+	}
+}
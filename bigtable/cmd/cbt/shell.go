@@ -0,0 +1,305 @@
+/*
+Copyright 2015 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// The interactive shell.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/context"
+)
+
+// shell runs commands read from the user, sharing one Client and AdminClient.
+type shell struct {
+	ctx   context.Context
+	table string // set by "use"
+
+	tables   []string            // cached for completion; nil if unknown
+	families map[string][]string // cached for completion; keyed by table
+}
+
+func doShellReal(ctx context.Context, args ...string) {
+	if len(args) != 0 {
+		fatalf("usage: cbt shell")
+	}
+	if inShell {
+		fatalf("Already in the shell")
+	}
+	inShell = true
+	defer func() { inShell = false }()
+
+	sh := &shell{
+		ctx:      ctx,
+		families: make(map[string][]string),
+	}
+	if !terminal.IsTerminal(0) {
+		// Run a script from standard input.
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if !sh.exec(s.Text()) {
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			fatalf("Reading input: %v", err)
+		}
+		return
+	}
+
+	t := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return sh.complete(t, line, pos)
+	}
+	for {
+		t.SetPrompt(sh.prompt())
+		// The terminal is only put in raw mode while reading,
+		// so command output is written normally.
+		state, err := terminal.MakeRaw(0)
+		if err != nil {
+			fatalf("Setting up terminal: %v", err)
+		}
+		line, err := t.ReadLine()
+		terminal.Restore(0, state)
+		if err == io.EOF {
+			fmt.Println()
+			return
+		}
+		if err != nil {
+			fatalf("Reading input: %v", err)
+		}
+		if !sh.exec(line) {
+			return
+		}
+	}
+}
+
+func (sh *shell) prompt() string {
+	if sh.table != "" {
+		return "cbt:" + sh.table + "> "
+	}
+	return "cbt> "
+}
+
+// exec runs one line of input. It reports whether the shell should continue.
+func (sh *shell) exec(line string) bool {
+	args, err := splitLine(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return true
+	}
+	if len(args) == 0 {
+		return true
+	}
+	switch args[0] {
+	case "exit", "quit":
+		return false
+	case "use":
+		switch len(args) {
+		case 1:
+			sh.table = ""
+		case 2:
+			sh.table = args[1]
+		default:
+			fmt.Fprintln(os.Stderr, "usage: use [table]")
+		}
+		return true
+	}
+	for _, cmd := range commands {
+		if cmd.Name != args[0] {
+			continue
+		}
+		cmdArgs := args[1:]
+		if sh.table != "" && takesTable(cmd.Usage, cmd.Name) {
+			cmdArgs = append([]string{sh.table}, cmdArgs...)
+		}
+		sh.run(cmd.do, cmdArgs)
+		switch cmd.Name {
+		case "createtable", "deletetable", "renametable", "createfamily", "deletefamily":
+			// Forget cached names.
+			sh.tables = nil
+			sh.families = make(map[string][]string)
+		}
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+	return true
+}
+
+// run runs a command, returning normally if it fails.
+func (sh *shell) run(do func(context.Context, ...string), args []string) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(shellAbort); !ok {
+				panic(e)
+			}
+		}
+	}()
+	do(sh.ctx, args...)
+}
+
+// takesTable reports whether a command's first argument is a table,
+// which "use" lets the user omit.
+func takesTable(usage, name string) bool {
+	return strings.HasPrefix(usage, "cbt "+name+" <table>")
+}
+
+// complete completes the word before pos in line.
+// Ambiguous completions are extended as far as possible, and otherwise listed.
+func (sh *shell) complete(t *terminal.Terminal, line string, pos int) (string, int, bool) {
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	word := line[start:pos]
+	args := strings.Fields(line[:start])
+
+	var cands []string
+	switch {
+	case len(args) == 0:
+		cands = []string{"exit", "quit", "use"}
+		for _, cmd := range commands {
+			cands = append(cands, cmd.Name)
+		}
+	case args[0] == "use" && len(args) == 1:
+		cands = sh.tableNames()
+	default:
+		var cmdTakesTable bool
+		for _, cmd := range commands {
+			if cmd.Name == args[0] {
+				cmdTakesTable = takesTable(cmd.Usage, cmd.Name)
+			}
+		}
+		table := sh.table
+		if table == "" && cmdTakesTable {
+			if len(args) == 1 {
+				cands = sh.tableNames()
+				break
+			}
+			table = args[1]
+		}
+		if table != "" {
+			cands = sh.familyNames(table)
+		}
+	}
+
+	var matches []string
+	for _, c := range cands {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", 0, false
+	case 1:
+		c := matches[0] + " "
+		return line[:start] + c + line[pos:], start + len(c), true
+	}
+	sort.Strings(matches)
+	prefix := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		return line[:start] + prefix + line[pos:], start + len(prefix), true
+	}
+	fmt.Fprintf(t, "%s\n", strings.Join(matches, "  "))
+	return "", 0, false
+}
+
+func (sh *shell) tableNames() []string {
+	if sh.tables == nil {
+		tables, err := getAdminClient().Tables(sh.ctx)
+		if err != nil {
+			return nil
+		}
+		sh.tables = tables
+	}
+	return sh.tables
+}
+
+func (sh *shell) familyNames(table string) []string {
+	fams, ok := sh.families[table]
+	if !ok {
+		ti, err := getAdminClient().TableInfo(sh.ctx, table)
+		if err != nil {
+			return nil
+		}
+		fams = ti.Families
+		sh.families[table] = fams
+	}
+	return fams
+}
+
+// splitLine splits a line of input into words at spaces.
+// Words may be double-quoted, using Go syntax, or single-quoted, without escapes.
+func splitLine(line string) ([]string, error) {
+	var words []string
+	var word []byte
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case ' ', '\t':
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = word[:0], false
+			}
+		case '"':
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			s, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted string %s", line[i:j+1])
+			}
+			word, inWord = append(word, s...), true
+			i = j
+		case '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			word, inWord = append(word, line[i+1:i+1+j]...), true
+			i += j + 1
+		default:
+			word, inWord = append(word, c), true
+		}
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// A Cache holds serialized entities for a Client, so that Get and GetMulti
+// can avoid looking them up in the datastore. See WithCache.
+//
+// A Cache must be safe for concurrent use. It may drop entries at any time,
+// and its methods do not report errors, so a backend that fails, such as a
+// shared cache server that cannot be reached, should behave as if it were
+// empty. Entries should expire, to bound how long a failed Delete or a
+// concurrent writer can leave a stale entity in the cache.
+type Cache interface {
+	// Get returns the value stored for each of keys, or nil if there is
+	// none.
+	Get(ctx context.Context, keys []string) [][]byte
+	// Set stores values[i] for keys[i].
+	Set(ctx context.Context, keys []string, values [][]byte)
+	// Delete removes the values stored for keys.
+	Delete(ctx context.Context, keys []string)
+}
+
+// NewLRUCache returns an in-process Cache that holds up to maxEntries
+// entries, dropping the least recently used ones when it is full, and
+// dropping each entry ttl after it was stored. A ttl of zero means that
+// entries do not expire.
+func NewLRUCache(maxEntries int, ttl time.Duration) Cache {
+	return &lruCache{
+		max:     maxEntries,
+		ttl:     ttl,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+type lruCache struct {
+	max int
+	ttl time.Duration
+
+	mu      sync.Mutex
+	ll      *list.List // of *lruEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // zero if the entry does not expire
+}
+
+// timeNow is time.Now, and is a variable for testing.
+var timeNow = time.Now
+
+func (c *lruCache) Get(ctx context.Context, keys []string) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([][]byte, len(keys))
+	t := timeNow()
+	for i, k := range keys {
+		el, ok := c.entries[k]
+		if !ok {
+			continue
+		}
+		e := el.Value.(*lruEntry)
+		if !e.expires.IsZero() && !t.Before(e.expires) {
+			c.remove(el)
+			continue
+		}
+		c.ll.MoveToFront(el)
+		values[i] = e.value
+	}
+	return values
+}
+
+func (c *lruCache) Set(ctx context.Context, keys []string, values [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = timeNow().Add(c.ttl)
+	}
+	for i, k := range keys {
+		if el, ok := c.entries[k]; ok {
+			c.remove(el)
+		}
+		c.entries[k] = c.ll.PushFront(&lruEntry{k, values[i], expires})
+	}
+	for c.ll.Len() > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *lruCache) Delete(ctx context.Context, keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		if el, ok := c.entries[k]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// remove removes an element of c.ll. c.mu must be held.
+func (c *lruCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).key)
+}
+
+// cacheKey returns the key of the entity with key k in the client's cache.
+// It includes the project, so that a Cache may be shared by clients.
+func (c *Client) cacheKey(k *Key) string {
+	return c.projectID + "/" + k.Encode()
+}
+
+// cacheLeases tracks the cache keys that lookups are about to fill, so that
+// an entity written while its lookup is in flight is not put back in the
+// cache after the write has removed it.
+type cacheLeases struct {
+	mu sync.Mutex
+	m  map[string]map[*cacheLease]bool // cache key -> the leases on it
+}
+
+// A cacheLease is held by a lookup on the cache keys it may fill.
+type cacheLease struct {
+	keys  []string
+	stale map[string]bool // keys invalidated since the lease was taken
+}
+
+// acquire returns a lease on keys, which must be released.
+func (ls *cacheLeases) acquire(keys []string) *cacheLease {
+	l := &cacheLease{keys: keys, stale: make(map[string]bool)}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, k := range keys {
+		if ls.m[k] == nil {
+			ls.m[k] = make(map[*cacheLease]bool)
+		}
+		ls.m[k][l] = true
+	}
+	return l
+}
+
+// release gives up a lease.
+func (ls *cacheLeases) release(l *cacheLease) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, k := range l.keys {
+		delete(ls.m[k], l)
+		if len(ls.m[k]) == 0 {
+			delete(ls.m, k)
+		}
+	}
+}
+
+// invalidate marks keys as stale in every lease on them.
+func (ls *cacheLeases) invalidate(keys []string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, k := range keys {
+		for l := range ls.m[k] {
+			l.stale[k] = true
+		}
+	}
+}
+
+// stale returns a copy of the keys invalidated since l was acquired.
+func (ls *cacheLeases) stale(l *cacheLease) map[string]bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	stale := make(map[string]bool, len(l.stale))
+	for k := range l.stale {
+		stale[k] = true
+	}
+	return stale
+}
+
+// fill stores looked-up entities in the client's cache under the lease l,
+// skipping any that were invalidated since l was acquired. Those invalidated
+// while the Set is in flight are deleted again once it completes, as the
+// invalidating Delete may have run first.
+func (c *Client) fill(ctx context.Context, l *cacheLease, keys []string, values [][]byte) {
+	stale := c.leases.stale(l)
+	var setKeys []string
+	var setValues [][]byte
+	for i, k := range keys {
+		if !stale[k] {
+			setKeys = append(setKeys, k)
+			setValues = append(setValues, values[i])
+		}
+	}
+	if len(setKeys) == 0 {
+		return
+	}
+	c.cache.Set(ctx, setKeys, setValues)
+	stale = c.leases.stale(l)
+	var again []string
+	for _, k := range setKeys {
+		if stale[k] {
+			again = append(again, k)
+		}
+	}
+	if len(again) > 0 {
+		c.cache.Delete(ctx, again)
+	}
+}
+
+// uncache removes the entities with the given keys from the client's cache,
+// if it has one. Incomplete keys are ignored.
+func (c *Client) uncache(ctx context.Context, keys []*Key) {
+	if c.cache == nil {
+		return
+	}
+	var ckeys []string
+	for _, k := range keys {
+		if k != nil && !k.Incomplete() {
+			ckeys = append(ckeys, c.cacheKey(k))
+		}
+	}
+	if len(ckeys) > 0 {
+		// Stop lookups in flight from caching the old entities, then remove
+		// any that are cached.
+		c.leases.invalidate(ckeys)
+		c.cache.Delete(ctx, ckeys)
+	}
+}
+
+// mutationKeys returns the keys of the existing entities that a mutation
+// changes.
+func mutationKeys(m *pb.Mutation) []*Key {
+	var keys []*Key
+	for _, es := range [][]*pb.Entity{m.Upsert, m.Update, m.Insert} {
+		for _, e := range es {
+			keys = append(keys, protoToKey(e.Key))
+		}
+	}
+	for _, k := range m.Delete {
+		keys = append(keys, protoToKey(k))
+	}
+	return keys
+}
@@ -0,0 +1,251 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore/dstest"
+)
+
+func TestLRUCache(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	clock := time.Unix(1000, 0)
+	timeNow = func() time.Time { return clock }
+	ctx := context.Background()
+
+	c := NewLRUCache(2, time.Minute)
+	c.Set(ctx, []string{"a", "b"}, [][]byte{[]byte("A"), []byte("B")})
+	if got := c.Get(ctx, []string{"a", "x"}); string(got[0]) != "A" || got[1] != nil {
+		t.Errorf("Get(a, x) = %q, want [A nil]", got)
+	}
+	// a is now more recently used than b, so b is dropped.
+	c.Set(ctx, []string{"c"}, [][]byte{[]byte("C")})
+	if got := c.Get(ctx, []string{"a", "b", "c"}); !reflect.DeepEqual(got, [][]byte{[]byte("A"), nil, []byte("C")}) {
+		t.Errorf("after eviction, Get(a, b, c) = %q, want [A nil C]", got)
+	}
+	c.Delete(ctx, []string{"a"})
+	if got := c.Get(ctx, []string{"a"}); got[0] != nil {
+		t.Errorf("after Delete, Get(a) = %q, want nil", got)
+	}
+	clock = clock.Add(time.Minute)
+	if got := c.Get(ctx, []string{"c"}); got[0] != nil {
+		t.Errorf("after the TTL, Get(c) = %q, want nil", got)
+	}
+}
+
+// lookupCounter counts the lookup requests it sends.
+type lookupCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (l *lookupCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/lookup") {
+		l.mu.Lock()
+		l.n++
+		l.mu.Unlock()
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (l *lookupCounter) reset() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.n
+	l.n = 0
+	return n
+}
+
+func TestCachedClient(t *testing.T) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	lc := &lookupCounter{}
+	c, err := NewClient(ctx, "proj",
+		WithHTTPClient(&http.Client{Transport: lc}),
+		WithEndpoint(srv.Endpoint()),
+		WithCache(NewLRUCache(100, 0)))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	k1, k2 := c.NewKey(ctx, "Counter", "a", 0, nil), c.NewKey(ctx, "Counter", "b", 0, nil)
+	if _, err := c.PutMulti(ctx, []*Key{k1, k2}, []*counter{{N: 1}, {N: 2}}); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	get := func(k *Key) int64 {
+		var x counter
+		if err := c.Get(ctx, k, &x); err != nil {
+			t.Fatalf("Get(%v): %v", k, err)
+		}
+		return x.N
+	}
+	get(k1)
+	lc.reset()
+
+	// Cached entities are not looked up again, even with others.
+	if n := get(k1); n != 1 || lc.reset() != 0 {
+		t.Errorf("cached Get returned %d, or made a lookup", n)
+	}
+	xs := make([]counter, 2)
+	if err := c.GetMulti(ctx, []*Key{k1, k2}, xs); err != nil || xs[0].N != 1 || xs[1].N != 2 {
+		t.Errorf("GetMulti = %v, %v; want N=1 and N=2", xs, err)
+	}
+	if n := lc.reset(); n != 1 {
+		t.Errorf("GetMulti of a cached and an uncached entity made %d lookups, want 1", n)
+	}
+	if err := c.GetMulti(ctx, []*Key{k1, k2}, xs); err != nil || lc.reset() != 0 {
+		t.Errorf("GetMulti of cached entities: %v, or made a lookup", err)
+	}
+
+	// Writes invalidate the cache.
+	if _, err := c.Put(ctx, k1, &counter{N: 10}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := get(k1); n != 10 || lc.reset() != 1 {
+		t.Errorf("Get after Put returned %d, want 10 from a lookup", n)
+	}
+	_, err = c.RunInTransaction(ctx, func(tx *Transaction) error {
+		var x counter
+		if err := tx.Get(k1, &x); err != nil {
+			return err
+		}
+		_, err := tx.Put(k1, &counter{N: x.N + 1})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if n := lc.reset(); n != 1 {
+		t.Errorf("transactional Get made %d lookups, want 1", n)
+	}
+	if n := get(k1); n != 11 || lc.reset() != 1 {
+		t.Errorf("Get after Commit returned %d, want 11 from a lookup", n)
+	}
+	if err := c.Delete(ctx, k2); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := c.Get(ctx, k2, &counter{}); err != ErrNoSuchEntity {
+		t.Errorf("Get after Delete: got %v, want ErrNoSuchEntity", err)
+	}
+
+	// A write by another client is not seen.
+	other, err := NewClient(ctx, "proj",
+		WithHTTPClient(http.DefaultClient),
+		WithEndpoint(srv.Endpoint()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if _, err := other.Put(ctx, k1, &counter{N: 20}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := get(k1); n != 11 {
+		t.Errorf("Get after another client's Put returned %d, want the cached 11", n)
+	}
+}
+
+// hookTransport calls onLookup, if set, after each lookup response arrives
+// and before it is returned.
+type hookTransport struct {
+	onLookup func()
+}
+
+func (h *hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if f := h.onLookup; f != nil && err == nil && strings.HasSuffix(req.URL.Path, "/lookup") {
+		h.onLookup = nil
+		f()
+	}
+	return resp, err
+}
+
+// hookCache calls onSet, if set, before storing values in the Cache.
+type hookCache struct {
+	Cache
+	onSet func()
+}
+
+func (h *hookCache) Set(ctx context.Context, keys []string, values [][]byte) {
+	if f := h.onSet; f != nil {
+		h.onSet = nil
+		f()
+	}
+	h.Cache.Set(ctx, keys, values)
+}
+
+func TestCacheWriteDuringGet(t *testing.T) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	ht := &hookTransport{}
+	hc := &hookCache{Cache: NewLRUCache(100, 0)}
+	c, err := NewClient(ctx, "proj",
+		WithHTTPClient(&http.Client{Transport: ht}),
+		WithEndpoint(srv.Endpoint()),
+		WithCache(hc))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	k := c.NewKey(ctx, "Counter", "a", 0, nil)
+	put := func(n int64) {
+		if _, err := c.Put(ctx, k, &counter{N: n}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	get := func() int64 {
+		var x counter
+		if err := c.Get(ctx, k, &x); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return x.N
+	}
+	put(1)
+
+	// A Put that completes while a Get's lookup is in flight: the Get may
+	// return the old entity, but must not cache it.
+	ht.onLookup = func() { put(2) }
+	if n := get(); n != 1 {
+		t.Errorf("Get during Put returned %d, want the looked-up 1", n)
+	}
+	if n := get(); n != 2 {
+		t.Errorf("Get after Put returned %d, want 2", n)
+	}
+
+	// The same, when the Put removes the entity just before the Get caches it.
+	put(3)
+	hc.onSet = func() { put(4) }
+	if n := get(); n != 3 {
+		t.Errorf("Get during Put returned %d, want the looked-up 3", n)
+	}
+	if n := get(); n != 4 {
+		t.Errorf("Get after Put returned %d, want 4", n)
+	}
+	if len(c.leases.m) != 0 {
+		t.Errorf("%d keys are still leased after the Gets", len(c.leases.m))
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/cloud/internal"
+)
+
+const defaultEndpoint = "https://www.googleapis.com/datastore/v1beta2/datasets/"
+
+// A RetryPolicy says how many times, and how often, an operation is tried.
+type RetryPolicy struct {
+	// MaxAttempts is the most times the operation is tried.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry.
+	// The wait doubles before each later retry.
+	InitialBackoff time.Duration
+}
+
+// defaultRetryPolicy is used by clients made without WithRetryPolicy, and by
+// the package functions.
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+}
+
+// sleep waits for about backoff, with some jitter so that callers retrying
+// at the same time spread out. It returns early if ctx is done.
+func sleep(ctx context.Context, backoff time.Duration) error {
+	d := backoff/2 + time.Duration(rand.Int63n(int64(backoff)+1))
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Client is a client for a project's datastore. Its methods are the same as
+// the package functions of the same names, but use the client's configuration
+// instead of that of a context made by cloud.NewContext.
+//
+// A Client is safe for concurrent use by multiple goroutines.
+type Client struct {
+	projectID string
+	hc        *http.Client
+	endpoint  string
+	namespace string
+	retry     RetryPolicy
+	userAgent string
+	cache     Cache
+	leases    *cacheLeases // set if cache is
+}
+
+// A ClientOption configures a Client.
+type ClientOption interface {
+	apply(*Client)
+}
+
+type clientOption func(*Client)
+
+func (f clientOption) apply(c *Client) { f(c) }
+
+// WithHTTPClient returns a ClientOption that sets the HTTP client used to
+// make requests, which is responsible for authorizing them.
+//
+// If this option is not used, a client using the Application Default
+// Credentials is made.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return clientOption(func(c *Client) { c.hc = hc })
+}
+
+// WithEndpoint returns a ClientOption that sets the base URL of the datastore
+// API, such as "http://localhost:8080/datastore/v1beta2/datasets/" for a
+// local emulator. The project ID and method name are appended to it.
+func WithEndpoint(url string) ClientOption {
+	return clientOption(func(c *Client) { c.endpoint = url })
+}
+
+// WithDefaultNamespace returns a ClientOption that sets the namespace of the
+// keys the client makes, and of the queries it runs, unless the context
+// passed to its methods has a namespace set by WithNamespace.
+func WithDefaultNamespace(namespace string) ClientOption {
+	return clientOption(func(c *Client) { c.namespace = namespace })
+}
+
+// WithRetryPolicy returns a ClientOption that sets how the client retries
+// RunInTransaction after contention, and requests that are safe to repeat
+// after transient failures, such as lookups and queries.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return clientOption(func(c *Client) { c.retry = p })
+}
+
+// WithUserAgent returns a ClientOption that sets the User-Agent header of the
+// client's requests.
+func WithUserAgent(ua string) ClientOption {
+	return clientOption(func(c *Client) { c.userAgent = ua })
+}
+
+// WithCache returns a ClientOption that makes the client's Get and GetMulti
+// read through cache: entities are served from it when present, and stored
+// in it when looked up. The client's Put, Delete and their variants, and
+// successful Commits of its transactions, remove the entities they change,
+// and a Get whose lookup overlaps such a write does not cache what it read.
+// Reads in transactions and queries do not use the cache.
+//
+// Writes by other clients are not seen until the cached entities expire, so
+// a cache suits entities that rarely change, such as configuration.
+func WithCache(cache Cache) ClientOption {
+	return clientOption(func(c *Client) { c.cache = cache })
+}
+
+// NewClient creates a new Client for the datastore of the given project.
+func NewClient(ctx context.Context, projectID string, opts ...ClientOption) (*Client, error) {
+	if projectID == "" {
+		return nil, errors.New("datastore: missing project ID")
+	}
+	c := &Client{
+		projectID: projectID,
+		endpoint:  defaultEndpoint,
+		retry:     defaultRetryPolicy,
+	}
+	for _, o := range opts {
+		o.apply(c)
+	}
+	if c.retry.MaxAttempts < 1 {
+		return nil, errors.New("datastore: retry policy must allow at least one attempt")
+	}
+	if c.cache != nil {
+		c.leases = &cacheLeases{m: make(map[string]map[*cacheLease]bool)}
+	}
+	if c.hc == nil {
+		hc, err := google.DefaultClient(ctx, ScopeDatastore, ScopeUserEmail)
+		if err != nil {
+			return nil, err
+		}
+		c.hc = hc
+	}
+	return c, nil
+}
+
+// clientFromContext returns a Client configured by a context made by
+// cloud.NewContext and the "base_url" ContextKey, for the package functions.
+func clientFromContext(ctx context.Context) *Client {
+	return &Client{
+		projectID: internal.ProjID(ctx),
+		hc:        internal.HTTPClient(ctx),
+		endpoint:  baseUrl(ctx),
+		retry:     defaultRetryPolicy,
+	}
+}
+
+// ns returns the namespace of the keys made with ctx: the one set by
+// WithNamespace, or else the client's default namespace.
+func (c *Client) ns(ctx context.Context) string {
+	if ns := ctxNamespace(ctx); ns != "" {
+		return ns
+	}
+	return c.namespace
+}
+
+// NewKey is like the package function NewKey, using the client's default
+// namespace.
+func (c *Client) NewKey(ctx context.Context, kind, name string, id int64, parent *Key) *Key {
+	return &Key{
+		kind:      kind,
+		name:      name,
+		id:        id,
+		parent:    parent,
+		namespace: c.ns(ctx),
+	}
+}
+
+// NewIncompleteKey is like the package function NewIncompleteKey, using the
+// client's default namespace.
+func (c *Client) NewIncompleteKey(ctx context.Context, kind string, parent *Key) *Key {
+	return c.NewKey(ctx, kind, "", 0, parent)
+}
+
+// AllocateIDs is like the package function AllocateIDs.
+func (c *Client) AllocateIDs(ctx context.Context, keys []*Key) ([]*Key, error) {
+	return c.allocateIDs(ctx, keys)
+}
+
+// Get is like the package function Get.
+func (c *Client) Get(ctx context.Context, key *Key, dst interface{}) error {
+	err := c.get(ctx, []*Key{key}, []interface{}{dst}, nil)
+	if me, ok := err.(MultiError); ok {
+		return me[0]
+	}
+	return err
+}
+
+// GetMulti is like the package function GetMulti.
+func (c *Client) GetMulti(ctx context.Context, keys []*Key, dst interface{}) error {
+	return c.get(ctx, keys, dst, nil)
+}
+
+// Put is like the package function Put.
+func (c *Client) Put(ctx context.Context, key *Key, src interface{}) (*Key, error) {
+	k, err := c.PutMulti(ctx, []*Key{key}, []interface{}{src})
+	if err != nil {
+		if me, ok := err.(MultiError); ok {
+			return nil, me[0]
+		}
+		return nil, err
+	}
+	return k[0], nil
+}
+
+// PutMulti is like the package function PutMulti.
+func (c *Client) PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
+	return c.putMulti(ctx, upsert, keys, src)
+}
+
+// Insert is like the package function Insert.
+func (c *Client) Insert(ctx context.Context, key *Key, src interface{}) (*Key, error) {
+	k, err := c.InsertMulti(ctx, []*Key{key}, []interface{}{src})
+	if err != nil {
+		if me, ok := err.(MultiError); ok {
+			return nil, me[0]
+		}
+		return nil, err
+	}
+	return k[0], nil
+}
+
+// InsertMulti is like the package function InsertMulti.
+func (c *Client) InsertMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
+	return c.putMulti(ctx, insert, keys, src)
+}
+
+// Update is like the package function Update.
+func (c *Client) Update(ctx context.Context, key *Key, src interface{}) error {
+	err := c.UpdateMulti(ctx, []*Key{key}, []interface{}{src})
+	if me, ok := err.(MultiError); ok {
+		return me[0]
+	}
+	return err
+}
+
+// UpdateMulti is like the package function UpdateMulti.
+func (c *Client) UpdateMulti(ctx context.Context, keys []*Key, src interface{}) error {
+	_, err := c.putMulti(ctx, update, keys, src)
+	return err
+}
+
+// Delete is like the package function Delete.
+func (c *Client) Delete(ctx context.Context, key *Key) error {
+	err := c.DeleteMulti(ctx, []*Key{key})
+	if me, ok := err.(MultiError); ok {
+		return me[0]
+	}
+	return err
+}
+
+// DeleteMulti is like the package function DeleteMulti.
+func (c *Client) DeleteMulti(ctx context.Context, keys []*Key) error {
+	return c.deleteMulti(ctx, keys)
+}
+
+// Run runs the query q.
+func (c *Client) Run(ctx context.Context, q *Query) *Iterator {
+	return c.run(ctx, q)
+}
+
+// GetAll runs the query q, as Query.GetAll does.
+func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*Key, error) {
+	return c.getAll(ctx, q, dst)
+}
+
+// Count returns the number of results for the query q.
+func (c *Client) Count(ctx context.Context, q *Query) (int, error) {
+	return c.count(ctx, q)
+}
+
+// SplitPoints returns the keys that split the query q, as Query.SplitPoints
+// does.
+func (c *Client) SplitPoints(ctx context.Context, q *Query, n int) ([]*Key, error) {
+	return c.splitPoints(ctx, q, n)
+}
+
+// RunSplits is like the package function RunSplits.
+func (c *Client) RunSplits(ctx context.Context, qs []*Query, f func(i int, it *Iterator) error) error {
+	return c.runSplits(ctx, qs, f)
+}
+
+// Namespaces is like the package function Namespaces.
+func (c *Client) Namespaces(ctx context.Context) ([]string, error) {
+	return c.namespaces(ctx)
+}
+
+// Kinds is like the package function Kinds, using the client's default
+// namespace.
+func (c *Client) Kinds(ctx context.Context) ([]string, error) {
+	return c.kinds(ctx)
+}
+
+// KindProperties is like the package function KindProperties, using the
+// client's default namespace.
+func (c *Client) KindProperties(ctx context.Context, kind string) (map[string][]string, error) {
+	return c.kindProperties(ctx, kind)
+}
+
+// NewTransaction is like the package function NewTransaction.
+func (c *Client) NewTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
+	return c.newTransaction(ctx, newTransactionSettings(opts))
+}
+
+// RunInTransaction is like the package function RunInTransaction. Unless
+// MaxAttempts is given, it tries as many times as the client's retry policy
+// allows.
+func (c *Client) RunInTransaction(ctx context.Context, f func(tx *Transaction) error, opts ...TransactionOption) (*Commit, error) {
+	return c.runInTransaction(ctx, f, opts)
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore/dstest"
+)
+
+// agentRecorder records the User-Agent headers of the requests it sends.
+type agentRecorder struct {
+	mu     sync.Mutex
+	agents map[string]bool
+}
+
+func (r *agentRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.agents[req.Header.Get("User-Agent")] = true
+	r.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClient(t *testing.T) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	rec := &agentRecorder{agents: make(map[string]bool)}
+	c, err := NewClient(ctx, "proj",
+		WithHTTPClient(&http.Client{Transport: rec}),
+		WithEndpoint(srv.Endpoint()),
+		WithDefaultNamespace("ns"),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+		WithUserAgent("test-agent"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	k := c.NewKey(ctx, "Counter", "a", 0, nil)
+	if k.Namespace() != "ns" {
+		t.Errorf("NewKey: namespace is %q, want ns", k.Namespace())
+	}
+	if k := c.NewKey(WithNamespace(ctx, "other"), "Counter", "a", 0, nil); k.Namespace() != "other" {
+		t.Errorf("NewKey with a context namespace: namespace is %q, want other", k.Namespace())
+	}
+	if _, err := c.Put(ctx, k, &counter{N: 1}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var got counter
+	if err := c.Get(ctx, k, &got); err != nil || got.N != 1 {
+		t.Errorf("Get = %+v, %v; want N=1", got, err)
+	}
+	if n, err := c.Count(ctx, NewQuery("Counter").Ancestor(c.NewKey(ctx, "Counter", "a", 0, nil))); n != 1 || err != nil {
+		t.Errorf("Count = %d, %v; want 1", n, err)
+	}
+	if !rec.agents["test-agent"] || len(rec.agents) != 1 {
+		t.Errorf("requests had User-Agents %v, want only test-agent", rec.agents)
+	}
+
+	// The retry policy limits RunInTransaction's attempts.
+	attempts := 0
+	_, err = c.RunInTransaction(ctx, func(tx *Transaction) error {
+		attempts++
+		return ErrConcurrentTransaction
+	})
+	if err != ErrConcurrentTransaction || attempts != 2 {
+		t.Errorf("RunInTransaction: got %v after %d attempts, want ErrConcurrentTransaction after 2", err, attempts)
+	}
+
+	// A second client, configured differently, is independent of the first.
+	c2, err := NewClient(ctx, "proj2", WithHTTPClient(http.DefaultClient), WithEndpoint(srv.Endpoint()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c2.Get(ctx, c2.NewKey(ctx, "Counter", "a", 0, nil), &got); err != ErrNoSuchEntity {
+		t.Errorf("Get from another project: got %v, want ErrNoSuchEntity", err)
+	}
+
+	if _, err := NewClient(ctx, "", WithHTTPClient(http.DefaultClient)); err == nil {
+		t.Errorf("NewClient with no project succeeded")
+	}
+}
+
+// flakyTransport fails requests while failures remains positive, alternately
+// with a 503 response and a reset connection.
+type flakyTransport struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.requests++
+	fail := f.failures
+	f.failures--
+	f.mu.Unlock()
+	switch {
+	case fail > 0 && fail%2 == 0:
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"error": {"errors": [{"reason": "UNAVAILABLE"}], "message": "try again"}}`)),
+		}, nil
+	case fail > 0:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRetries(t *testing.T) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	ft := &flakyTransport{}
+	c, err := NewClient(ctx, "proj",
+		WithHTTPClient(&http.Client{Transport: ft}),
+		WithEndpoint(srv.Endpoint()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	k := c.NewKey(ctx, "Counter", "a", 0, nil)
+
+	// Idempotent requests are retried.
+	ft.failures, ft.requests = 2, 0
+	if _, err := c.Put(ctx, k, &counter{N: 1}); err != nil || ft.requests != 3 {
+		t.Errorf("Put after 2 failures: got %v after %d requests, want success after 3", err, ft.requests)
+	}
+	ft.failures, ft.requests = 2, 0
+	var got counter
+	if err := c.Get(ctx, k, &got); err != nil || got.N != 1 {
+		t.Errorf("Get after 2 failures = %+v, %v; want N=1", got, err)
+	}
+	ft.failures, ft.requests = 2, 0
+	if n, err := c.Count(ctx, NewQuery("Counter")); n != 1 || err != nil {
+		t.Errorf("Count after 2 failures = %d, %v; want 1", n, err)
+	}
+	ft.failures, ft.requests = 4, 0
+	err = c.Get(ctx, k, &got)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable || ft.requests != 3 {
+		t.Errorf("Get after 4 failures: got %v after %d requests, want a 503 Error after 3", err, ft.requests)
+	} else if e.Reason != "UNAVAILABLE" || e.Message != "try again" {
+		t.Errorf("Get after 4 failures: got reason %q, message %q", e.Reason, e.Message)
+	}
+
+	// Others are not.
+	ft.failures, ft.requests = 2, 0
+	if _, err := c.Insert(ctx, c.NewIncompleteKey(ctx, "Counter", nil), &counter{}); err == nil || ft.requests != 1 {
+		t.Errorf("Insert after 2 failures: got %v after %d requests, want an error after 1", err, ft.requests)
+	}
+	ft.failures, ft.requests = 2, 0
+	if _, err := c.NewTransaction(ctx); err == nil || ft.requests != 1 {
+		t.Errorf("NewTransaction after 2 failures: got %v after %d requests, want an error after 1", err, ft.requests)
+	}
+
+	// Errors that are not transient are not retried, and are parsed.
+	ft.failures, ft.requests = 0, 0
+	_, err = c.Count(ctx, NewQuery("Counter").Filter("N >", 0).Order("__key__"))
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest || e.Reason != "INVALID_ARGUMENT" || e.Message == "" || ft.requests != 1 {
+		t.Errorf("invalid query: got %#v after %d requests, want a parsed 400 Error after 1", err, ft.requests)
+	}
+}
+
+func TestErrorHelpers(t *testing.T) {
+	tests := []struct {
+		err                  error
+		notFound, contention bool
+	}{
+		{ErrNoSuchEntity, true, false},
+		{ErrConcurrentTransaction, false, true},
+		{ErrAlreadyExists, false, false},
+		{newError(http.StatusNotFound, []byte(`{"error": {"errors": [{"reason": "NOT_FOUND"}]}}`), nil), true, false},
+		{newError(http.StatusConflict, []byte(`{"error": {"errors": [{"reason": "ABORTED"}]}}`), nil), false, true},
+		{newError(http.StatusConflict, []byte("too much contention"), nil), false, true},
+		{newError(http.StatusInternalServerError, []byte("oops"), nil), false, false},
+		{nil, false, false},
+	}
+	for _, tc := range tests {
+		if got := IsNotFound(tc.err); got != tc.notFound {
+			t.Errorf("IsNotFound(%v) = %v, want %v", tc.err, got, tc.notFound)
+		}
+		if got := IsContention(tc.err); got != tc.contention {
+			t.Errorf("IsContention(%v) = %v, want %v", tc.err, got, tc.contention)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Datastore exports datastore entities to newline-delimited JSON files, and
+imports them back, for backups and for seeding datasets. The format is
+described by the dsjson package.
+
+Usage:
+
+	datastore [flags] export [kind ...]
+	datastore [flags] import [file ...]
+
+Export writes the entities of the given kinds, or else of every kind in the
+namespace, to standard output, or to the file named by -o.
+
+Import saves the entities in the given files, or else on standard input.
+Each entity keeps the namespace of its key; the -namespace flag is ignored.
+
+The flags are:
+
+	-project
+		the project ID (required)
+	-namespace
+		the namespace to export
+	-o
+		the file to export to
+	-batch
+		the number of entities to import with each request
+	-creds
+		if set, use application credentials in this file
+	-endpoint
+		if set, send unauthenticated requests to this datastore API base URL,
+		such as "http://localhost:8080/datastore/v1beta2/datasets/"
+*/
+package main // import "google.golang.org/cloud/datastore/cmd/datastore"
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+	"google.golang.org/cloud/datastore/dsjson"
+)
+
+var (
+	project   = flag.String("project", "", "project ID")
+	namespace = flag.String("namespace", "", "namespace to export")
+	output    = flag.String("o", "", "file to export to; by default, standard output")
+	batchSize = flag.Int("batch", dsjson.DefaultBatchSize, "number of entities to import with each request")
+	creds     = flag.String("creds", "", "if set, use application credentials in this file")
+	endpoint  = flag.String("endpoint", "", "if set, send unauthenticated requests to this datastore API base URL")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n\t%s [flags] export [kind ...]\n\t%s [flags] import [file ...]\n", os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+	if *project == "" {
+		log.Fatal("Missing -project")
+	}
+	if *creds != "" {
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", *creds)
+	}
+	var opts []datastore.ClientOption
+	if *endpoint != "" {
+		opts = append(opts, datastore.WithEndpoint(*endpoint), datastore.WithHTTPClient(http.DefaultClient))
+	}
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, *project, opts...)
+	if err != nil {
+		log.Fatalf("Making datastore.Client: %v", err)
+	}
+
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "export":
+		doExport(datastore.WithNamespace(ctx, *namespace), client, args)
+	case "import":
+		doImport(ctx, client, args)
+	default:
+		log.Fatalf("Unknown command %q", cmd)
+	}
+}
+
+func doExport(ctx context.Context, client *datastore.Client, kinds []string) {
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		w = f
+	}
+	var n int
+	var err error
+	if len(kinds) == 0 {
+		n, err = dsjson.ExportNamespace(ctx, client, w)
+	} else {
+		for _, kind := range kinds {
+			var m int
+			m, err = dsjson.Export(ctx, client, w, datastore.NewQuery(kind))
+			n += m
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Fatalf("Exported %d entities, then failed: %v", n, err)
+	}
+	log.Printf("Exported %d entities", n)
+}
+
+func doImport(ctx context.Context, client *datastore.Client, files []string) {
+	if len(files) == 0 {
+		importFrom(ctx, client, "standard input", os.Stdin)
+		return
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		importFrom(ctx, client, name, f)
+		f.Close()
+	}
+}
+
+func importFrom(ctx context.Context, client *datastore.Client, name string, r io.Reader) {
+	n, err := dsjson.Import(ctx, client, r, *batchSize)
+	if err != nil {
+		log.Fatalf("Imported %d entities from %s, then failed: %v", n, name, err)
+	}
+	log.Printf("Imported %d entities from %s", n, name)
+}
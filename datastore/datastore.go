@@ -21,13 +21,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"reflect"
+	"sync"
+	"syscall"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
-	"google.golang.org/cloud/internal"
 	pb "google.golang.org/cloud/internal/datastore"
 )
 
@@ -51,6 +56,9 @@ var (
 	ErrInvalidKey = errors.New("datastore: invalid key")
 	// ErrNoSuchEntity is returned when no entity was found for a given key.
 	ErrNoSuchEntity = errors.New("datastore: no such entity")
+	// ErrAlreadyExists is returned by Insert when an entity already exists
+	// for a given key.
+	ErrAlreadyExists = errors.New("datastore: entity already exists")
 )
 
 type multiArgType int
@@ -68,7 +76,9 @@ const (
 type nsKey struct{}
 
 // WithNamespace returns a new context that limits the scope its parent
-// context with a Datastore namespace.
+// context with a Datastore namespace. Keys made with it are in the namespace,
+// and queries run with it, even those without an ancestor, return only
+// entities in the namespace.
 func WithNamespace(parent context.Context, namespace string) context.Context {
 	return context.WithValue(parent, nsKey{}, namespace)
 }
@@ -91,18 +101,34 @@ type ErrFieldMismatch struct {
 	Reason     string
 }
 
-// errHTTP is returned when responds is a non-200 HTTP response.
-type errHTTP struct {
-	StatusCode int
-	Body       string
-	err        error
+// mayConflict reports whether e, from a commit of m, may be because m
+// inserted an entity that already exists or updated one that does not.
+// The status alone does not say, as other failures share it, so the keys
+// must be looked up to tell.
+func mayConflict(e *Error, m *pb.Mutation) bool {
+	return e.StatusCode == http.StatusConflict && len(m.Insert) > 0 ||
+		e.StatusCode == http.StatusNotFound && len(m.Update) > 0
 }
 
-func (e *errHTTP) Error() string {
-	if e.err == nil {
-		return fmt.Sprintf("error during call, http status code: %v %s", e.StatusCode, e.Body)
+// lookupExisting looks up keys, outside any transaction, and returns the set
+// of those, as strings, that have stored entities.
+func (c *Client) lookupExisting(ctx context.Context, keys []*Key) (map[string]bool, error) {
+	req := &pb.LookupRequest{}
+	for _, k := range keys {
+		req.Key = append(req.Key, keyToProto(k))
 	}
-	return e.err.Error()
+	resp := &pb.LookupResponse{}
+	if err := c.call(ctx, "lookup", req, resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Deferred) > 0 {
+		return nil, errors.New("datastore: lookup deferred keys")
+	}
+	found := make(map[string]bool)
+	for _, e := range resp.Found {
+		found[protoToKey(e.Entity.Key).String()] = true
+	}
+	return found, nil
 }
 
 func (e *ErrFieldMismatch) Error() string {
@@ -115,41 +141,98 @@ func (e *ErrFieldMismatch) Error() string {
 func baseUrl(ctx context.Context) string {
 	v := ctx.Value(ContextKey("base_url"))
 	if v == nil {
-		return "https://www.googleapis.com/datastore/v1beta2/datasets/"
+		return defaultEndpoint
 	} else {
 		return v.(string)
 	}
 }
 
-func call(ctx context.Context, method string, req proto.Message, resp proto.Message) error {
+// call makes an API request, of the named method, with the client's
+// configuration. Requests that are safe to repeat are retried after
+// transient failures, as the client's retry policy allows.
+func (c *Client) call(ctx context.Context, method string, req proto.Message, resp proto.Message) error {
 	payload, err := proto.Marshal(req)
 	if err != nil {
 		return err
 	}
-	url := baseUrl(ctx) + internal.ProjID(ctx) + "/" + method
-	r, err := internal.HTTPClient(ctx).Post(url, "application/x-protobuf", bytes.NewReader(payload))
+	attempts := 1
+	if idempotent(method, req) {
+		attempts = c.retry.MaxAttempts
+	}
+	backoff := c.retry.InitialBackoff
+	for i := 0; ; i++ {
+		err = c.post(method, payload, resp)
+		if i+1 >= attempts || !isTransient(err) {
+			return err
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a request, in the form of its serialized payload, to the given
+// method, and reads the response into resp.
+func (c *Client) post(method string, payload []byte, resp proto.Message) error {
+	url := c.endpoint + c.projectID + "/" + method
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/x-protobuf")
+	if c.userAgent != "" {
+		hreq.Header.Set("User-Agent", c.userAgent)
+	}
+	r, err := c.hc.Do(hreq)
 	if err != nil {
 		return err
 	}
 	defer r.Body.Close()
 	all, err := ioutil.ReadAll(r.Body)
 	if r.StatusCode != http.StatusOK {
-		e := &errHTTP{
-			StatusCode: r.StatusCode,
-			err:        err,
-		}
-		if err == nil {
-			e.Body = string(all)
-		}
-		return e
+		return newError(r.StatusCode, all, err)
 	}
 	if err != nil {
 		return err
 	}
-	if err = proto.Unmarshal(all, resp); err != nil {
-		return err
+	return proto.Unmarshal(all, resp)
+}
+
+// idempotent reports whether a request can be repeated without changing its
+// effect: lookups, queries, and non-transactional commits that only upsert or
+// delete entities.
+func idempotent(method string, req proto.Message) bool {
+	switch method {
+	case "lookup", "runQuery":
+		return true
+	case "commit":
+		r := req.(*pb.CommitRequest)
+		if r.GetMode() != pb.CommitRequest_NON_TRANSACTIONAL {
+			return false
+		}
+		m := r.GetMutation()
+		return len(m.Insert) == 0 && len(m.InsertAutoId) == 0 && len(m.Update) == 0
 	}
-	return nil
+	return false
+}
+
+// isTransient reports whether err, returned by a request, is a failure that
+// may not happen if the request is sent again.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *Error:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	case *url.Error:
+		return isTransient(e.Err)
+	case *net.OpError:
+		return isTransient(e.Err)
+	case *os.SyscallError:
+		return isTransient(e.Err)
+	}
+	return err == syscall.ECONNRESET || err == io.ErrUnexpectedEOF || err == io.EOF
 }
 
 func keyToProto(k *Key) *pb.Key {
@@ -288,11 +371,7 @@ func checkMultiArg(v reflect.Value) (m multiArgType, elemType reflect.Type) {
 // unexported in the destination struct. ErrFieldMismatch is only returned if
 // dst is a struct pointer.
 func Get(ctx context.Context, key *Key, dst interface{}) error {
-	err := get(ctx, []*Key{key}, []interface{}{dst}, nil)
-	if me, ok := err.(MultiError); ok {
-		return me[0]
-	}
-	return err
+	return clientFromContext(ctx).Get(ctx, key, dst)
 }
 
 // GetMulti is a batch version of Get.
@@ -305,11 +384,15 @@ func Get(ctx context.Context, key *Key, dst interface{}) error {
 // As a special case, PropertyList is an invalid type for dst, even though a
 // PropertyList is a slice of structs. It is treated as invalid to avoid being
 // mistakenly passed when []PropertyList was intended.
+//
+// Large batches are split into several requests, which are made concurrently.
+// If some of those requests fail, GetMulti returns a MultiError holding each
+// failed request's error for each of its keys.
 func GetMulti(ctx context.Context, keys []*Key, dst interface{}) error {
-	return get(ctx, keys, dst, nil)
+	return clientFromContext(ctx).GetMulti(ctx, keys, dst)
 }
 
-func get(ctx context.Context, keys []*Key, dst interface{}, opts *pb.ReadOptions) error {
+func (c *Client) get(ctx context.Context, keys []*Key, dst interface{}, opts *pb.ReadOptions) error {
 	v := reflect.ValueOf(dst)
 	multiArgType, _ := checkMultiArg(v)
 
@@ -323,51 +406,103 @@ func get(ctx context.Context, keys []*Key, dst interface{}, opts *pb.ReadOptions
 	if len(keys) == 0 {
 		return nil
 	}
+	return runBatches(len(keys), maxGetBatch, func(i, j int) error {
+		return c.getBatch(ctx, keys[i:j], v.Slice(i, j), multiArgType, opts)
+	})
+}
 
-	// Go through keys, validate them, serialize then, and create a dict mapping them to their index
+// getBatch looks up keys, loading the entities into the slice v.
+// keys must fit in a single request. Reads outside transactions use the
+// client's cache, if it has one.
+func (c *Client) getBatch(ctx context.Context, keys []*Key, v reflect.Value, multiArgType multiArgType, opts *pb.ReadOptions) error {
 	multiErr, any := make(MultiError, len(keys)), false
-	keyMap := make(map[string]int)
-	pbKeys := make([]*pb.Key, len(keys))
 	for i, k := range keys {
 		if !k.valid() {
 			multiErr[i] = ErrInvalidKey
 			any = true
-		} else {
-			keyMap[k.String()] = i
-			pbKeys[i] = keyToProto(k)
 		}
 	}
 	if any {
 		return multiErr
 	}
+	load := func(index int, e *pb.Entity) {
+		elem := v.Index(index)
+		if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
+			elem = elem.Addr()
+		}
+		if err := loadEntity(elem.Interface(), e); err != nil {
+			multiErr[index] = err
+			any = true
+		}
+	}
+
+	// Load what we can from the cache, and map the other keys to their
+	// indexes, to look them up.
+	var cacheKeys []string
+	var cached [][]byte
+	var lease *cacheLease
+	if c.cache != nil && opts == nil {
+		cacheKeys = make([]string, len(keys))
+		for i, k := range keys {
+			cacheKeys[i] = c.cacheKey(k)
+		}
+		// Lease the keys before reading them, so that a write from now on
+		// stops their lookup from caching the entities it replaces.
+		lease = c.leases.acquire(cacheKeys)
+		defer c.leases.release(lease)
+		cached = c.cache.Get(ctx, cacheKeys)
+	}
+	keyMap := make(map[string]int)
+	var pbKeys []*pb.Key
+	for i, k := range keys {
+		if i < len(cached) && cached[i] != nil {
+			e := &pb.Entity{}
+			if proto.Unmarshal(cached[i], e) == nil {
+				load(i, e)
+				continue
+			}
+		}
+		keyMap[k.String()] = i
+		pbKeys = append(pbKeys, keyToProto(k))
+	}
+	if len(pbKeys) == 0 {
+		if any {
+			return multiErr
+		}
+		return nil
+	}
+
 	req := &pb.LookupRequest{
 		Key:         pbKeys,
 		ReadOptions: opts,
 	}
 	resp := &pb.LookupResponse{}
-	if err := call(ctx, "lookup", req, resp); err != nil {
+	if err := c.call(ctx, "lookup", req, resp); err != nil {
 		return err
 	}
 	if len(resp.Deferred) > 0 {
 		// TODO(jbd): Assess whether we should retry the deferred keys.
 		return errors.New("datastore: some entities temporarily unavailable")
 	}
-	if len(keys) != len(resp.Found)+len(resp.Missing) {
+	if len(pbKeys) != len(resp.Found)+len(resp.Missing) {
 		return errors.New("datastore: internal error: server returned the wrong number of entities")
 	}
+	var setKeys []string
+	var setValues [][]byte
 	for _, e := range resp.Found {
 		k := protoToKey(e.Entity.Key)
 		index := keyMap[k.String()]
-		elem := v.Index(index)
-		if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
-			elem = elem.Addr()
-		}
-		err := loadEntity(elem.Interface(), e.Entity)
-		if err != nil {
-			multiErr[index] = err
-			any = true
+		load(index, e.Entity)
+		if cacheKeys != nil {
+			if b, err := proto.Marshal(e.Entity); err == nil {
+				setKeys = append(setKeys, cacheKeys[index])
+				setValues = append(setValues, b)
+			}
 		}
 	}
+	if len(setKeys) > 0 {
+		c.fill(ctx, lease, setKeys, setValues)
+	}
 	for _, e := range resp.Missing {
 		k := protoToKey(e.Entity.Key)
 		multiErr[keyMap[k.String()]] = ErrNoSuchEntity
@@ -384,58 +519,170 @@ func get(ctx context.Context, keys []*Key, dst interface{}, opts *pb.ReadOptions
 // unexported fields of that struct will be skipped. If k is an incomplete key,
 // the returned key will be a unique key generated by the datastore.
 func Put(ctx context.Context, key *Key, src interface{}) (*Key, error) {
-	k, err := PutMulti(ctx, []*Key{key}, []interface{}{src})
-	if err != nil {
-		if me, ok := err.(MultiError); ok {
-			return nil, me[0]
-		}
-		return nil, err
-	}
-	return k[0], nil
+	return clientFromContext(ctx).Put(ctx, key, src)
 }
 
 // PutMulti is a batch version of Put.
 //
 // src must satisfy the same conditions as the dst argument to GetMulti.
+//
+// Large batches are split into several requests, as for GetMulti. If some of
+// those requests fail, PutMulti returns the keys of the entities that were
+// saved, along with a MultiError.
 func PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
-	mutation, err := putMutation(keys, src)
+	return clientFromContext(ctx).PutMulti(ctx, keys, src)
+}
+
+// Insert is like Put, but fails with ErrAlreadyExists if an entity is already
+// stored for key. An incomplete key always gets a new entity.
+func Insert(ctx context.Context, key *Key, src interface{}) (*Key, error) {
+	return clientFromContext(ctx).Insert(ctx, key, src)
+}
+
+// InsertMulti is a batch version of Insert. The entities whose keys are
+// already in use are not saved, and have ErrAlreadyExists in the returned
+// MultiError; the others are saved, as for PutMulti.
+func InsertMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
+	return clientFromContext(ctx).InsertMulti(ctx, keys, src)
+}
+
+// Update is like Put, but fails with ErrNoSuchEntity if no entity is already
+// stored for key. key must be complete.
+func Update(ctx context.Context, key *Key, src interface{}) error {
+	return clientFromContext(ctx).Update(ctx, key, src)
+}
+
+// UpdateMulti is a batch version of Update. The entities with no stored
+// entity to update are not saved, and have ErrNoSuchEntity in the returned
+// MultiError; the others are saved, as for PutMulti.
+func UpdateMulti(ctx context.Context, keys []*Key, src interface{}) error {
+	return clientFromContext(ctx).UpdateMulti(ctx, keys, src)
+}
+
+// putMode is how putMutation treats entities with complete keys.
+type putMode int
+
+const (
+	upsert putMode = iota
+	insert
+	update
+)
+
+func (c *Client) putMulti(ctx context.Context, mode putMode, keys []*Key, src interface{}) ([]*Key, error) {
+	entities, err := saveEntities(mode, keys, src)
 	if err != nil {
 		return nil, err
 	}
+	ret := make([]*Key, len(keys))
+	err = runBatches(len(keys), maxPutBatch, func(i, j int) error {
+		return c.putBatch(ctx, mode, keys[i:j], entities[i:j], ret[i:j])
+	})
+	c.uncache(ctx, keys)
+	if _, ok := err.(MultiError); err != nil && !ok {
+		return nil, err
+	}
+	return ret, err
+}
 
+// putBatch saves entities, whose keys are keys, setting ret to their final
+// keys if it succeeds. keys must fit in a single request.
+func (c *Client) putBatch(ctx context.Context, mode putMode, keys []*Key, entities []*pb.Entity, ret []*Key) error {
 	// Make the request.
 	req := &pb.CommitRequest{
-		Mutation: mutation,
+		Mutation: newPutMutation(mode, keys, entities),
 		Mode:     pb.CommitRequest_NON_TRANSACTIONAL.Enum(),
 	}
 	resp := &pb.CommitResponse{}
-	if err := call(ctx, "commit", req, resp); err != nil {
-		return nil, err
+	if err := c.call(ctx, "commit", req, resp); err != nil {
+		if e, ok := err.(*Error); ok && mayConflict(e, req.Mutation) {
+			return c.putConflicting(ctx, mode, keys, entities, ret, err)
+		}
+		return err
 	}
 
 	// Copy any newly minted keys into the returned keys.
-	newKeys := make(map[int]int) // Map of index in returned slice to index in response.
-	ret := make([]*Key, len(keys))
-	var idx int
+	newKeys := resp.MutationResult.InsertAutoIdKey
+	if len(newKeys) != len(req.Mutation.InsertAutoId) {
+		return errors.New("datastore: internal error: server returned the wrong number of keys")
+	}
 	for i, key := range keys {
 		if key.Incomplete() {
-			// This key will be in the mutation result.
-			newKeys[i] = idx
-			idx++
+			// This key is in the mutation result.
+			ret[i], newKeys = protoToKey(newKeys[0]), newKeys[1:]
 		} else {
 			ret[i] = key
 		}
 	}
-	if len(newKeys) != len(resp.MutationResult.InsertAutoIdKey) {
-		return nil, errors.New("datastore: internal error: server returned the wrong number of keys")
+	return nil
+}
+
+// putConflicting handles the failure, with err, of an insert or update of
+// entities. As the commit may have failed because some keys were or were not
+// in use, it looks up the keys to find which, and saves the other entities.
+// It returns a MultiError, or err if the lookup fails or no key caused the
+// failure.
+func (c *Client) putConflicting(ctx context.Context, mode putMode, keys []*Key, entities []*pb.Entity, ret []*Key, err error) error {
+	var lookup []*Key
+	for _, k := range keys {
+		if !k.Incomplete() {
+			lookup = append(lookup, k)
+		}
 	}
-	for retI, respI := range newKeys {
-		ret[retI] = protoToKey(resp.MutationResult.InsertAutoIdKey[respI])
+	found, lerr := c.lookupExisting(ctx, lookup)
+	if lerr != nil {
+		return err
+	}
+
+	errs := make(MultiError, len(keys))
+	var rest []int
+	for i, k := range keys {
+		switch {
+		case mode == insert && !k.Incomplete() && found[k.String()]:
+			errs[i] = ErrAlreadyExists
+		case mode == update && !found[k.String()]:
+			errs[i] = ErrNoSuchEntity
+		default:
+			rest = append(rest, i)
+		}
 	}
-	return ret, nil
+	if len(rest) == len(keys) {
+		// The keys are as they should be now, so something else failed.
+		return err
+	}
+	if len(rest) > 0 {
+		restKeys := make([]*Key, len(rest))
+		restEntities := make([]*pb.Entity, len(rest))
+		restRet := make([]*Key, len(rest))
+		for j, i := range rest {
+			restKeys[j], restEntities[j] = keys[i], entities[i]
+		}
+		err := c.putBatch(ctx, mode, restKeys, restEntities, restRet)
+		me, _ := err.(MultiError)
+		for j, i := range rest {
+			switch {
+			case me != nil:
+				errs[i] = me[j]
+			case err != nil:
+				errs[i] = err
+			}
+			if errs[i] == nil {
+				ret[i] = restRet[j]
+			}
+		}
+	}
+	return errs
 }
 
-func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
+func putMutation(mode putMode, keys []*Key, src interface{}) (*pb.Mutation, error) {
+	entities, err := saveEntities(mode, keys, src)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return newPutMutation(mode, keys, entities), nil
+}
+
+// saveEntities converts the elements of src, whose keys are keys, to protos.
+func saveEntities(mode putMode, keys []*Key, src interface{}) ([]*pb.Entity, error) {
 	v := reflect.ValueOf(src)
 	multiArgType, _ := checkMultiArg(v)
 	if multiArgType == multiArgTypeInvalid {
@@ -450,7 +697,14 @@ func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
 	if err := multiValid(keys); err != nil {
 		return nil, err
 	}
-	var upsert, insert []*pb.Entity
+	if mode == update {
+		for _, k := range keys {
+			if k.Incomplete() {
+				return nil, fmt.Errorf("datastore: can't update the incomplete key: %v", k)
+			}
+		}
+	}
+	entities := make([]*pb.Entity, len(keys))
 	for i, k := range keys {
 		val := reflect.ValueOf(src).Index(i)
 		// If src is an interface slice []interface{}{ent1, ent2}
@@ -465,41 +719,57 @@ func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
 		if err != nil {
 			return nil, fmt.Errorf("datastore: Error while saving %v: %v", k.String(), err)
 		}
-		if k.Incomplete() {
-			insert = append(insert, p)
-		} else {
-			upsert = append(upsert, p)
-		}
+		entities[i] = p
 	}
+	return entities, nil
+}
 
-	return &pb.Mutation{
-		InsertAutoId: insert,
-		Upsert:       upsert,
-	}, nil
+func newPutMutation(mode putMode, keys []*Key, entities []*pb.Entity) *pb.Mutation {
+	m := &pb.Mutation{}
+	for i, k := range keys {
+		e := entities[i]
+		switch {
+		case k.Incomplete():
+			m.InsertAutoId = append(m.InsertAutoId, e)
+		case mode == insert:
+			m.Insert = append(m.Insert, e)
+		case mode == update:
+			m.Update = append(m.Update, e)
+		default:
+			m.Upsert = append(m.Upsert, e)
+		}
+	}
+	return m
 }
 
 // Delete deletes the entity for the given key.
 func Delete(ctx context.Context, key *Key) error {
-	err := DeleteMulti(ctx, []*Key{key})
-	if me, ok := err.(MultiError); ok {
-		return me[0]
-	}
-	return err
+	return clientFromContext(ctx).Delete(ctx, key)
 }
 
 // DeleteMulti is a batch version of Delete.
+//
+// Large batches are split into several requests, as for GetMulti.
 func DeleteMulti(ctx context.Context, keys []*Key) error {
+	return clientFromContext(ctx).DeleteMulti(ctx, keys)
+}
+
+func (c *Client) deleteMulti(ctx context.Context, keys []*Key) error {
 	mutation, err := deleteMutation(keys)
 	if err != nil {
 		return err
 	}
 
-	req := &pb.CommitRequest{
-		Mutation: mutation,
-		Mode:     pb.CommitRequest_NON_TRANSACTIONAL.Enum(),
-	}
-	resp := &pb.CommitResponse{}
-	return call(ctx, "commit", req, resp)
+	err = runBatches(len(keys), maxDeleteBatch, func(i, j int) error {
+		req := &pb.CommitRequest{
+			Mutation: &pb.Mutation{Delete: mutation.Delete[i:j]},
+			Mode:     pb.CommitRequest_NON_TRANSACTIONAL.Enum(),
+		}
+		resp := &pb.CommitResponse{}
+		return c.call(ctx, "commit", req, resp)
+	})
+	c.uncache(ctx, keys)
+	return err
 }
 
 func deleteMutation(keys []*Key) (*pb.Mutation, error) {
@@ -515,3 +785,66 @@ func deleteMutation(keys []*Key) (*pb.Mutation, error) {
 		Delete: protoKeys,
 	}, nil
 }
+
+// The most entities that are sent in one request by GetMulti, PutMulti and
+// DeleteMulti, and the most requests each makes at once. They are variables
+// for testing.
+var (
+	maxGetBatch         = 1000
+	maxPutBatch         = 500
+	maxDeleteBatch      = 500
+	maxBatchConcurrency = 8
+)
+
+// runBatches calls f(i, j) for consecutive ranges of n elements, each at most
+// size elements long, up to maxBatchConcurrency at a time.
+//
+// If there is one range, runBatches returns f's error. Otherwise, it returns
+// a MultiError of n errors, or nil if every call succeeds. Each element of a
+// range is set to the matching element of a MultiError of the range's length
+// returned by f, or else to f's error.
+func runBatches(n, size int, f func(i, j int) error) error {
+	if n <= size {
+		return f(0, n)
+	}
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, maxBatchConcurrency)
+		errs = make(MultiError, n)
+		any  = false
+		mu   sync.Mutex
+	)
+	for i := 0; i < n; i += size {
+		j := i + size
+		if j > n {
+			j = n
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, j int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := f(i, j)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			any = true
+			if me, ok := err.(MultiError); ok && len(me) == j-i {
+				copy(errs[i:j], me)
+				return
+			}
+			for k := i; k < j; k++ {
+				errs[k] = err
+			}
+		}(i, j)
+	}
+	wg.Wait()
+	if any {
+		return errs
+	}
+	return nil
+}
@@ -18,10 +18,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/internal"
 )
 
 type (
@@ -284,6 +290,98 @@ type MutuallyRecursive1 struct {
 	R []MutuallyRecursive0
 }
 
+type Address struct {
+	City string
+	Tags []string
+}
+
+type EntityFields struct {
+	Home    Address                `datastore:",entity"`
+	Work    *Address               `datastore:",entity"`
+	Past    []Address              `datastore:"past,entity,noindex"`
+	Extra   map[string]interface{} `datastore:",entity"`
+	Missing *Address               `datastore:",entity"`
+}
+
+type RecursiveEntity struct {
+	I int
+	R []RecursiveEntity `datastore:",entity"`
+}
+
+type FlattenedAddresses struct {
+	Home Address
+	Past []struct {
+		City string
+	} `datastore:"past"`
+}
+
+type Color int
+
+const (
+	Red Color = iota
+	Green
+)
+
+func (c Color) MarshalPropertyValue() (interface{}, error) {
+	switch c {
+	case Red:
+		return "red", nil
+	case Green:
+		return "green", nil
+	}
+	return nil, fmt.Errorf("invalid color %d", c)
+}
+
+func (c *Color) UnmarshalPropertyValue(v interface{}) error {
+	switch v {
+	case "red":
+		*c = Red
+	case "green":
+		*c = Green
+	default:
+		return fmt.Errorf("invalid color %v", v)
+	}
+	return nil
+}
+
+// Money is a struct, but is stored as a single string value.
+type Money struct {
+	Units, Cents int64
+}
+
+func (m Money) MarshalPropertyValue() (interface{}, error) {
+	return fmt.Sprintf("%d.%02d", m.Units, m.Cents), nil
+}
+
+func (m *Money) UnmarshalPropertyValue(v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("cannot load %T as Money", v)
+	}
+	_, err := fmt.Sscanf(s, "%d.%d", &m.Units, &m.Cents)
+	return err
+}
+
+type Marshaled struct {
+	Color   Color
+	Colors  []Color
+	Price   Money
+	Refund  *Money
+	Nothing *Money
+}
+
+type TagOptions struct {
+	I    int               `datastore:",omitempty"`
+	S    string            `datastore:",omitempty"`
+	T    time.Time         `datastore:",omitempty"`
+	L    []string          `datastore:",omitempty"`
+	Home *Address          `datastore:",flatten,omitempty"`
+	Work *Address          `datastore:",flatten"`
+	M    map[string]int    `datastore:",json"`
+	J    []json.RawMessage `datastore:"j,json"`
+	B    bool
+}
+
 type Doubler struct {
 	S string
 	I int64
@@ -1181,6 +1279,180 @@ var testCases = []testCase{
 		"",
 		"",
 	},
+	{
+		"embedded entities",
+		&EntityFields{
+			Home:  Address{City: "Paris", Tags: []string{"a", "b"}},
+			Work:  &Address{City: "Lyon"},
+			Past:  []Address{{City: "Nice"}, {City: "Metz", Tags: []string{"c"}}},
+			Extra: map[string]interface{}{"N": int64(1), "L": []interface{}{"x", "y"}, "M": map[string]interface{}{"B": true}},
+		},
+		&EntityFields{
+			Home:  Address{City: "Paris", Tags: []string{"a", "b"}},
+			Work:  &Address{City: "Lyon"},
+			Past:  []Address{{City: "Nice"}, {City: "Metz", Tags: []string{"c"}}},
+			Extra: map[string]interface{}{"N": int64(1), "L": []interface{}{"x", "y"}, "M": map[string]interface{}{"B": true}},
+		},
+		"",
+		"",
+	},
+	{
+		"embedded entities to PropertyList",
+		&struct {
+			A Address `datastore:",entity,noindex"`
+		}{A: Address{City: "Paris"}},
+		&PropertyList{
+			Property{Name: "A", Value: &Entity{Properties: []Property{
+				{Name: "City", Value: "Paris", NoIndex: true},
+			}}, NoIndex: true},
+		},
+		"",
+		"",
+	},
+	{
+		"recursive embedded entities",
+		&RecursiveEntity{I: 1, R: []RecursiveEntity{{I: 2}, {I: 3, R: []RecursiveEntity{{I: 4}}}}},
+		&RecursiveEntity{I: 1, R: []RecursiveEntity{{I: 2}, {I: 3, R: []RecursiveEntity{{I: 4}}}}},
+		"",
+		"",
+	},
+	{
+		"embedded entities to flattened structs",
+		&EntityFields{
+			Home: Address{City: "Paris", Tags: []string{"a"}},
+			Past: []Address{{City: "Nice"}, {City: "Metz"}},
+		},
+		&FlattenedAddresses{
+			Home: Address{City: "Paris", Tags: []string{"a"}},
+			Past: []struct{ City string }{{"Nice"}, {"Metz"}},
+		},
+		"",
+		"no such struct field",
+	},
+	{
+		"embedded entity type mismatch",
+		&struct{ Home string }{Home: "Paris"},
+		&EntityFields{},
+		"",
+		"type mismatch",
+	},
+	{
+		"omitempty, flatten and json",
+		&TagOptions{
+			Work: &Address{City: "Lyon", Tags: []string{"a"}},
+			M:    map[string]int{"x": 1},
+		},
+		&PropertyList{
+			Property{Name: "Work.City", Value: "Lyon"},
+			Property{Name: "Work.Tags", Value: "a", Multiple: true},
+			Property{Name: "M", Value: []byte(`{"x":1}`), NoIndex: true},
+			Property{Name: "j", Value: []byte("null"), NoIndex: true},
+			Property{Name: "B", Value: false},
+		},
+		"",
+		"",
+	},
+	{
+		"omitempty, flatten and json round trip",
+		&TagOptions{
+			I:    1,
+			Home: &Address{City: "Paris"},
+			M:    map[string]int{"x": 1, "y": 2},
+			J:    []json.RawMessage{json.RawMessage(`{"a":[1,2]}`), json.RawMessage(`"b"`)},
+		},
+		&TagOptions{
+			I:    1,
+			Home: &Address{City: "Paris"},
+			M:    map[string]int{"x": 1, "y": 2},
+			J:    []json.RawMessage{json.RawMessage(`{"a":[1,2]}`), json.RawMessage(`"b"`)},
+		},
+		"",
+		"",
+	},
+	{
+		"json type mismatch",
+		&struct{ M string }{M: "x"},
+		&TagOptions{},
+		"",
+		"type mismatch",
+	},
+	{
+		"property value marshalers",
+		&Marshaled{
+			Color:  Green,
+			Colors: []Color{Red, Green},
+			Price:  Money{12, 5},
+			Refund: &Money{1, 50},
+		},
+		&PropertyList{
+			Property{Name: "Color", Value: "green"},
+			Property{Name: "Colors", Value: "red", Multiple: true},
+			Property{Name: "Colors", Value: "green", Multiple: true},
+			Property{Name: "Price", Value: "12.05"},
+			Property{Name: "Refund", Value: "1.50"},
+			Property{Name: "Nothing", Value: nil},
+		},
+		"",
+		"",
+	},
+	{
+		"property value marshalers round trip",
+		&Marshaled{
+			Color:  Green,
+			Colors: []Color{Red, Green},
+			Price:  Money{12, 5},
+			Refund: &Money{1, 50},
+		},
+		&Marshaled{
+			Color:  Green,
+			Colors: []Color{Red, Green},
+			Price:  Money{12, 5},
+			Refund: &Money{1, 50},
+		},
+		"",
+		"",
+	},
+	{
+		"property value marshaler save error",
+		&Marshaled{Color: 7},
+		nil,
+		"invalid color 7",
+		"",
+	},
+	{
+		"property value unmarshaler load error",
+		&struct{ Color string }{Color: "blue"},
+		&Marshaled{},
+		"",
+		"invalid color blue",
+	},
+	{
+		"flatten option on a non-struct",
+		&struct {
+			I *int `datastore:",flatten"`
+		}{},
+		nil,
+		"flatten option requires",
+		"",
+	},
+	{
+		"conflicting tag options",
+		&struct {
+			A Address `datastore:",entity,json"`
+		}{},
+		nil,
+		"conflicting struct tag options",
+		"",
+	},
+	{
+		"entity option on a non-struct",
+		&struct {
+			I int `datastore:",entity"`
+		}{},
+		nil,
+		"entity option requires",
+		"",
+	},
 }
 
 // checkErr returns the empty string if either both want and err are zero,
@@ -1357,3 +1629,291 @@ func TestQueryConstruction(t *testing.T) {
 		}
 	}
 }
+
+type Hooked struct {
+	First, Last string
+	Full        string `datastore:"-"`
+	Saves       int    `datastore:"-"`
+}
+
+func (h *Hooked) BeforeSave() error {
+	if h.First == "" {
+		return errors.New("no first name")
+	}
+	h.Saves++
+	return nil
+}
+
+func (h *Hooked) AfterLoad() error {
+	h.Full = h.First + " " + h.Last
+	return nil
+}
+
+func TestLoadSaveHooks(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	k1 := NewKey(ctx, "Hooked", "a", 0, nil)
+	k2 := NewKey(ctx, "Hooked", "b", 0, nil)
+
+	h := &Hooked{First: "Ada", Last: "Lovelace"}
+	if _, err := Put(ctx, k1, h); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if h.Saves != 1 {
+		t.Errorf("Put: BeforeSave called %d times, want 1", h.Saves)
+	}
+	if _, err := Put(ctx, k2, &Hooked{}); err == nil || !strings.Contains(err.Error(), "no first name") {
+		t.Errorf("Put of invalid entity: got %v, want BeforeSave's error", err)
+	}
+	hs := []*Hooked{{First: "Ada", Last: "Lovelace"}, {First: "Alan", Last: "Turing"}}
+	if _, err := PutMulti(ctx, []*Key{k1, k2}, hs); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	if hs[0].Saves != 1 || hs[1].Saves != 1 {
+		t.Errorf("PutMulti: BeforeSave not called once on each entity")
+	}
+
+	var got Hooked
+	if err := Get(ctx, k1, &got); err != nil || got.Full != "Ada Lovelace" {
+		t.Errorf("Get = %+v, %v; want Full set by AfterLoad", got, err)
+	}
+	multi := make([]Hooked, 2)
+	if err := GetMulti(ctx, []*Key{k1, k2}, multi); err != nil || multi[1].Full != "Alan Turing" {
+		t.Errorf("GetMulti = %+v, %v; want Full set by AfterLoad", multi, err)
+	}
+	var all []*Hooked
+	if _, err := NewQuery("Hooked").GetAll(ctx, &all); err != nil || len(all) != 2 || all[0].Full != "Ada Lovelace" {
+		t.Errorf("GetAll = %+v, %v; want Full set by AfterLoad", all, err)
+	}
+
+	_, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		var h Hooked
+		if err := tx.Get(k2, &h); err != nil {
+			return err
+		}
+		if h.Full != "Alan Turing" {
+			t.Errorf("Transaction.Get = %+v; want Full set by AfterLoad", h)
+		}
+		h.First = ""
+		_, err := tx.Put(k2, &h)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "no first name") {
+		t.Errorf("Transaction.Put of invalid entity: got %v, want BeforeSave's error", err)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	defer func(get, put, del int) {
+		maxGetBatch, maxPutBatch, maxDeleteBatch = get, put, del
+	}(maxGetBatch, maxPutBatch, maxDeleteBatch)
+	maxGetBatch, maxPutBatch, maxDeleteBatch = 3, 2, 4
+
+	const n = 10
+	var keys []*Key
+	var src []*counter
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			keys = append(keys, NewIncompleteKey(ctx, "Counter", nil))
+		} else {
+			keys = append(keys, NewKey(ctx, "Counter", "", int64(1000+i), nil))
+		}
+		src = append(src, &counter{N: int64(i)})
+	}
+	keys, err := PutMulti(ctx, keys, src)
+	if err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	got := make([]counter, n)
+	if err := GetMulti(ctx, keys, got); err != nil {
+		t.Fatalf("GetMulti: %v", err)
+	}
+	for i, c := range got {
+		if c.N != int64(i) {
+			t.Errorf("GetMulti: element %d is %+v, want N=%d", i, c, i)
+		}
+	}
+
+	// Errors from each batch are merged.
+	if err := DeleteMulti(ctx, keys[4:8]); err != nil {
+		t.Fatalf("DeleteMulti: %v", err)
+	}
+	err = GetMulti(ctx, keys, make([]counter, n))
+	me, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("GetMulti after DeleteMulti: got %v, want a MultiError", err)
+	}
+	for i, err := range me {
+		if want := i >= 4 && i < 8; (err == ErrNoSuchEntity) != want {
+			t.Errorf("GetMulti after DeleteMulti: element %d: got %v", i, err)
+		}
+	}
+
+	// A failed request fails each entity in its batch.
+	lists := make([]interface{}, 5)
+	for i := range lists {
+		lists[i] = &PropertyList{{Name: "N", Value: int64(i)}}
+	}
+	lists[3] = &PropertyList{{Name: "__reserved__", Value: int64(3)}}
+	keys = keys[:5]
+	keys, err = PutMulti(ctx, keys, lists)
+	me, ok = err.(MultiError)
+	if !ok {
+		t.Fatalf("PutMulti: got %v, want a MultiError", err)
+	}
+	for i := range lists {
+		if failed := i == 2 || i == 3; (me[i] != nil) != failed || (keys[i] == nil) != failed {
+			t.Errorf("PutMulti: element %d: got key %v, error %v", i, keys[i], me[i])
+		}
+	}
+}
+
+func TestInsertUpdate(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	k1 := NewKey(ctx, "Counter", "a", 0, nil)
+	k2 := NewKey(ctx, "Counter", "b", 0, nil)
+	k3 := NewKey(ctx, "Counter", "c", 0, nil)
+
+	if _, err := Insert(ctx, k1, &counter{N: 1}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := Insert(ctx, k1, &counter{N: 2}); err != ErrAlreadyExists {
+		t.Errorf("Insert of existing entity: got %v, want ErrAlreadyExists", err)
+	}
+	if err := Update(ctx, k2, &counter{N: 2}); err != ErrNoSuchEntity {
+		t.Errorf("Update of missing entity: got %v, want ErrNoSuchEntity", err)
+	}
+	if err := Update(ctx, k1, &counter{N: 3}); err != nil {
+		t.Errorf("Update: %v", err)
+	}
+
+	// Per-key failures don't stop the other entities being saved.
+	keys, err := InsertMulti(ctx, []*Key{k1, k2, NewIncompleteKey(ctx, "Counter", nil)},
+		[]*counter{{N: 4}, {N: 5}, {N: 6}})
+	me, ok := err.(MultiError)
+	if !ok || me[0] != ErrAlreadyExists || me[1] != nil || me[2] != nil {
+		t.Fatalf("InsertMulti: got %v, want ErrAlreadyExists for the first key only", err)
+	}
+	if keys[0] != nil || keys[1] != k2 || keys[2] == nil || keys[2].Incomplete() {
+		t.Errorf("InsertMulti returned keys %v", keys)
+	}
+	err = UpdateMulti(ctx, []*Key{k1, k3}, []*counter{{N: 7}, {N: 8}})
+	if me, ok := err.(MultiError); !ok || me[0] != nil || me[1] != ErrNoSuchEntity {
+		t.Fatalf("UpdateMulti: got %v, want ErrNoSuchEntity for the second key only", err)
+	}
+	got := make([]counter, 2)
+	if err := GetMulti(ctx, []*Key{k1, k2}, got); err != nil || got[0].N != 7 || got[1].N != 5 {
+		t.Errorf("GetMulti = %+v, %v; want N=7 and N=5", got, err)
+	}
+	if err := Update(ctx, NewIncompleteKey(ctx, "Counter", nil), &counter{}); err == nil {
+		t.Errorf("Update of incomplete key succeeded")
+	}
+
+	// In transactions, the commit fails.
+	_, err = RunInTransaction(ctx, func(tx *Transaction) error {
+		_, err := tx.Insert(k1, &counter{})
+		return err
+	})
+	if err != ErrAlreadyExists {
+		t.Errorf("Transaction.Insert of existing entity: got %v, want ErrAlreadyExists", err)
+	}
+	_, err = RunInTransaction(ctx, func(tx *Transaction) error {
+		return tx.Update(k3, &counter{})
+	})
+	if err != ErrNoSuchEntity {
+		t.Errorf("Transaction.Update of missing entity: got %v, want ErrNoSuchEntity", err)
+	}
+	var pk3, pNew *PendingKey
+	commit, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		if err := tx.Update(k1, &counter{N: 9}); err != nil {
+			return err
+		}
+		var err error
+		if pk3, err = tx.Put(k3, &counter{N: 10}); err != nil {
+			return err
+		}
+		pNew, err = tx.Insert(NewIncompleteKey(ctx, "Counter", nil), &counter{N: 11})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if k := commit.Key(pk3); !k.Equal(k3) {
+		t.Errorf("Commit.Key of a complete key = %v, want %v", k, k3)
+	}
+	if k := commit.Key(pNew); k == nil || k.Incomplete() {
+		t.Errorf("Commit.Key of an incomplete key = %v, want a complete key", k)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper made from a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestInsertUpdateErrors(t *testing.T) {
+	srvCtx, done := newTestServer(t)
+	defer done()
+	base := internal.HTTPClient(srvCtx).Transport
+
+	// Error bodies need not say why a commit failed, so Insert and Update
+	// must tell from the keys alone.
+	ctx := cloud.NewContext("proj", &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := base.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(strings.NewReader(http.StatusText(resp.StatusCode)))
+		}
+		return resp, err
+	})})
+	k1 := NewKey(ctx, "Counter", "a", 0, nil)
+	k2 := NewKey(ctx, "Counter", "b", 0, nil)
+	if _, err := Insert(ctx, k1, &counter{N: 1}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := Insert(ctx, k1, &counter{N: 2}); err != ErrAlreadyExists {
+		t.Errorf("Insert of existing entity: got %v, want ErrAlreadyExists", err)
+	}
+	if err := Update(ctx, k2, &counter{N: 2}); err != ErrNoSuchEntity {
+		t.Errorf("Update of missing entity: got %v, want ErrNoSuchEntity", err)
+	}
+	_, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		_, err := tx.Insert(k1, &counter{})
+		return err
+	})
+	if err != ErrAlreadyExists {
+		t.Errorf("Transaction.Insert of existing entity: got %v, want ErrAlreadyExists", err)
+	}
+	_, err = RunInTransaction(ctx, func(tx *Transaction) error {
+		return tx.Update(k2, &counter{})
+	})
+	if err != ErrNoSuchEntity {
+		t.Errorf("Transaction.Update of missing entity: got %v, want ErrNoSuchEntity", err)
+	}
+
+	// A bad endpoint's 404 is not about the entities: the lookup that would
+	// say so fails too, and the 404 is returned as it is.
+	requests := 0
+	bad := cloud.NewContext("proj", &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		u := *req.URL
+		u.Path = "/nowhere/" + path.Base(u.Path)
+		r := *req
+		r.URL = &u
+		return base.RoundTrip(&r)
+	})})
+	is404 := func(err error) bool {
+		e, ok := err.(*Error)
+		return ok && e.StatusCode == http.StatusNotFound
+	}
+	if err := Update(bad, k2, &counter{}); !is404(err) || requests != 2 {
+		t.Errorf("Update: got %v after %d requests, want the 404 after a commit and a lookup", err, requests)
+	}
+	requests = 0
+	if _, err := Insert(bad, k2, &counter{}); !is404(err) || requests != 1 {
+		t.Errorf("Insert: got %v after %d requests, want the 404 after 1", err, requests)
+	}
+}
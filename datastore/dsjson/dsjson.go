@@ -0,0 +1,358 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dsjson exports datastore entities as newline-delimited JSON, and
+// imports them back.
+//
+// Each line holds one entity, with its key and its properties in order:
+//
+//	{"key":{"namespace":"ns","path":[{"kind":"Parent","name":"p"},{"kind":"Kind","id":5}]},
+//	 "properties":[{"name":"N","type":"int","value":"1","multiple":true}, ...]}
+//
+// (shown here on two lines). Each property has a type, so that every
+// Property value survives export and import unchanged: "null", "int", "bool",
+// "string", "float", "key", "time", "blob" or "entity". Integers and floats
+// are JSON strings, so that they keep their full precision, and floats may be
+// "NaN", "+Inf" or "-Inf". Times are RFC 3339 strings, blobs are base64
+// strings, and keys and entities are objects like the ones above.
+package dsjson // import "google.golang.org/cloud/datastore/dsjson"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+// DefaultBatchSize is the number of entities Import saves with each call to
+// PutMulti, unless told otherwise.
+const DefaultBatchSize = 500
+
+type jsonEntity struct {
+	Key        *jsonKey       `json:"key,omitempty"`
+	Properties []jsonProperty `json:"properties"`
+}
+
+type jsonKey struct {
+	Namespace string        `json:"namespace,omitempty"`
+	Path      []jsonElement `json:"path"`
+}
+
+type jsonElement struct {
+	Kind string `json:"kind"`
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type jsonProperty struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	NoIndex  bool            `json:"noindex,omitempty"`
+	Multiple bool            `json:"multiple,omitempty"`
+}
+
+// Marshal returns the JSON encoding of an entity, without a trailing newline.
+func Marshal(key *datastore.Key, props []datastore.Property) ([]byte, error) {
+	e, err := toJSONEntity(key, props)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// Unmarshal decodes an entity encoded by Marshal.
+func Unmarshal(data []byte) (*datastore.Key, []datastore.Property, error) {
+	var e jsonEntity
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, nil, err
+	}
+	return fromJSONEntity(&e)
+}
+
+func toJSONEntity(key *datastore.Key, props []datastore.Property) (*jsonEntity, error) {
+	e := &jsonEntity{Key: toJSONKey(key), Properties: make([]jsonProperty, len(props))}
+	for i, p := range props {
+		typ, val, err := toJSONValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("dsjson: property %q: %v", p.Name, err)
+		}
+		e.Properties[i] = jsonProperty{
+			Name:     p.Name,
+			Type:     typ,
+			Value:    val,
+			NoIndex:  p.NoIndex,
+			Multiple: p.Multiple,
+		}
+	}
+	return e, nil
+}
+
+func toJSONKey(k *datastore.Key) *jsonKey {
+	if k == nil {
+		return nil
+	}
+	jk := &jsonKey{Namespace: k.Namespace()}
+	for ; k != nil; k = k.Parent() {
+		jk.Path = append([]jsonElement{{Kind: k.Kind(), ID: k.ID(), Name: k.Name()}}, jk.Path...)
+	}
+	return jk
+}
+
+func toJSONValue(v interface{}) (typ string, val json.RawMessage, err error) {
+	var x interface{}
+	switch v := v.(type) {
+	case nil:
+		return "null", nil, nil
+	case int64:
+		typ, x = "int", strconv.FormatInt(v, 10)
+	case bool:
+		typ, x = "bool", v
+	case string:
+		typ, x = "string", v
+	case float64:
+		typ, x = "float", strconv.FormatFloat(v, 'g', -1, 64)
+	case *datastore.Key:
+		typ, x = "key", toJSONKey(v)
+	case time.Time:
+		typ, x = "time", v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		typ, x = "blob", v
+	case *datastore.Entity:
+		if v == nil {
+			return "null", nil, nil
+		}
+		e, err := toJSONEntity(v.Key, v.Properties)
+		if err != nil {
+			return "", nil, err
+		}
+		typ, x = "entity", e
+	default:
+		return "", nil, fmt.Errorf("invalid value type %T", v)
+	}
+	val, err = json.Marshal(x)
+	return typ, val, err
+}
+
+func fromJSONEntity(e *jsonEntity) (*datastore.Key, []datastore.Property, error) {
+	key, err := fromJSONKey(e.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	props := make([]datastore.Property, len(e.Properties))
+	for i, p := range e.Properties {
+		v, err := fromJSONValue(p.Type, p.Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dsjson: property %q: %v", p.Name, err)
+		}
+		props[i] = datastore.Property{
+			Name:     p.Name,
+			Value:    v,
+			NoIndex:  p.NoIndex,
+			Multiple: p.Multiple,
+		}
+	}
+	return key, props, nil
+}
+
+func fromJSONKey(jk *jsonKey) (*datastore.Key, error) {
+	if jk == nil {
+		return nil, nil
+	}
+	if len(jk.Path) == 0 {
+		return nil, fmt.Errorf("dsjson: key with an empty path")
+	}
+	ctx := datastore.WithNamespace(context.Background(), jk.Namespace)
+	var k *datastore.Key
+	for _, el := range jk.Path {
+		if el.Kind == "" {
+			return nil, fmt.Errorf("dsjson: key path element with no kind")
+		}
+		k = datastore.NewKey(ctx, el.Kind, el.Name, el.ID, k)
+	}
+	return k, nil
+}
+
+func fromJSONValue(typ string, val json.RawMessage) (interface{}, error) {
+	if typ == "null" {
+		return nil, nil
+	}
+	if val == nil {
+		return nil, fmt.Errorf("%s property with no value", typ)
+	}
+	var s string
+	switch typ {
+	case "int":
+		if err := json.Unmarshal(val, &s); err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case "bool":
+		var b bool
+		err := json.Unmarshal(val, &b)
+		return b, err
+	case "string":
+		err := json.Unmarshal(val, &s)
+		return s, err
+	case "float":
+		if err := json.Unmarshal(val, &s); err != nil {
+			return nil, err
+		}
+		if s == "NaN" {
+			return math.NaN(), nil
+		}
+		return strconv.ParseFloat(s, 64)
+	case "key":
+		var jk jsonKey
+		if err := json.Unmarshal(val, &jk); err != nil {
+			return nil, err
+		}
+		return fromJSONKey(&jk)
+	case "time":
+		if err := json.Unmarshal(val, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case "blob":
+		var b []byte
+		if err := json.Unmarshal(val, &b); err != nil {
+			return nil, err
+		}
+		if b == nil {
+			b = []byte{}
+		}
+		return b, nil
+	case "entity":
+		var je jsonEntity
+		if err := json.Unmarshal(val, &je); err != nil {
+			return nil, err
+		}
+		key, props, err := fromJSONEntity(&je)
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Key: key, Properties: props}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+// Export writes the results of q to w, one line for each entity, and returns
+// the number of entities written. q must not be a keys-only or projection
+// query.
+func Export(ctx context.Context, c *datastore.Client, w io.Writer, q *datastore.Query) (int, error) {
+	bw := bufio.NewWriter(w)
+	n := 0
+	it := c.Run(ctx, q)
+	for {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		b, err := Marshal(k, props)
+		if err != nil {
+			return n, err
+		}
+		bw.Write(b)
+		if err := bw.WriteByte('\n'); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// ExportNamespace writes every entity of the namespace of ctx to w, as Export
+// does, one kind after another. Kinds whose names begin with "__", such as
+// the datastore's statistics, are skipped.
+func ExportNamespace(ctx context.Context, c *datastore.Client, w io.Writer) (int, error) {
+	kinds, err := c.Kinds(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, kind := range kinds {
+		if strings.HasPrefix(kind, "__") {
+			continue
+		}
+		n, err := Export(ctx, c, w, datastore.NewQuery(kind))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Import reads entities written by Export from r, and saves them with
+// PutMulti, batchSize entities at a time, or DefaultBatchSize if batchSize
+// is not positive. It returns the number of entities saved. The entities
+// keep the namespaces of their keys, even if c has a default namespace.
+func Import(ctx context.Context, c *datastore.Client, r io.Reader, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	var (
+		keys []*datastore.Key
+		src  []interface{}
+		n    int
+	)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if _, err := c.PutMulti(ctx, keys, src); err != nil {
+			return err
+		}
+		n += len(keys)
+		keys, src = nil, nil
+		return nil
+	}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if len(strings.TrimSpace(string(b))) > 0 {
+			key, props, uerr := Unmarshal(b)
+			if uerr != nil {
+				return n, fmt.Errorf("dsjson: line %d: %v", line, uerr)
+			}
+			if key == nil {
+				return n, fmt.Errorf("dsjson: line %d: entity has no key", line)
+			}
+			pl := datastore.PropertyList(props)
+			keys, src = append(keys, key), append(src, &pl)
+			if len(keys) == batchSize {
+				if err := flush(); err != nil {
+					return n, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return n, flush()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsjson
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+	"google.golang.org/cloud/datastore/dstest"
+)
+
+// testProperties returns properties with every type of value.
+func testProperties(ctx context.Context) []datastore.Property {
+	parent := datastore.NewKey(datastore.WithNamespace(ctx, "ns"), "Parent", "p", 0, nil)
+	return []datastore.Property{
+		{Name: "Null", Value: nil},
+		{Name: "Int", Value: int64(math.MaxInt64)},
+		{Name: "Ints", Value: int64(-1), Multiple: true},
+		{Name: "Ints", Value: int64(math.MinInt64), Multiple: true},
+		{Name: "Bool", Value: true, NoIndex: true},
+		{Name: "String", Value: "héllo\n\"world\""},
+		{Name: "Float", Value: 0.1},
+		{Name: "Inf", Value: math.Inf(-1)},
+		{Name: "Key", Value: datastore.NewKey(datastore.WithNamespace(ctx, "ns"), "Child", "", 42, parent)},
+		{Name: "Time", Value: time.Unix(1234567890, 123456000).UTC()},
+		{Name: "Blob", Value: []byte{0, 1, 2, 255}, NoIndex: true},
+		{Name: "Entity", NoIndex: true, Value: &datastore.Entity{Properties: []datastore.Property{
+			{Name: "A", Value: "a"},
+			{Name: "B", NoIndex: true, Value: &datastore.Entity{
+				Key:        datastore.NewKey(ctx, "Inner", "i", 0, nil),
+				Properties: []datastore.Property{{Name: "C", Value: int64(3), Multiple: true}},
+			}},
+		}}},
+	}
+}
+
+// equalProperties reports whether two property lists are the same, comparing
+// times with Equal, as their locations may differ.
+func equalProperties(a, b []datastore.Property) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if t, ok := x.Value.(time.Time); ok {
+			u, ok := y.Value.(time.Time)
+			if !ok || !t.Equal(u) {
+				return false
+			}
+			x.Value, y.Value = nil, nil
+		}
+		if ex, ok := x.Value.(*datastore.Entity); ok {
+			ey, ok := y.Value.(*datastore.Entity)
+			if !ok || !ex.Key.Equal(ey.Key) || !equalProperties(ex.Properties, ey.Properties) {
+				return false
+			}
+			x.Value, y.Value = nil, nil
+		}
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	key := datastore.NewKey(datastore.WithNamespace(ctx, "ns"), "Kind", "k", 0,
+		datastore.NewKey(datastore.WithNamespace(ctx, "ns"), "Parent", "", 7, nil))
+	props := append(testProperties(ctx), datastore.Property{Name: "NaN", Value: math.NaN()})
+	b, err := Marshal(key, props)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if bytes.Contains(b, []byte("\n")) {
+		t.Errorf("Marshal returned more than one line: %s", b)
+	}
+	gotKey, got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !gotKey.Equal(key) {
+		t.Errorf("Unmarshal key = %v, want %v", gotKey, key)
+	}
+	nan := got[len(got)-1].Value.(float64)
+	if !math.IsNaN(nan) {
+		t.Errorf("NaN became %v", nan)
+	}
+	if !equalProperties(got[:len(got)-1], props[:len(props)-1]) {
+		t.Errorf("Unmarshal properties:\ngot  %+v\nwant %+v", got, props)
+	}
+
+	for _, bad := range []string{
+		`{"key":{"path":[]},"properties":[]}`,
+		`{"properties":[{"name":"X","type":"int","value":1}]}`,
+		`{"properties":[{"name":"X","type":"complex","value":"1"}]}`,
+		`{"properties":[{"name":"X","type":"int"}]}`,
+	} {
+		if _, _, err := Unmarshal([]byte(bad)); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", bad)
+		}
+	}
+}
+
+func newClient(t *testing.T, srv *dstest.Server, project string) *datastore.Client {
+	c, err := datastore.NewClient(context.Background(), project,
+		datastore.WithHTTPClient(http.DefaultClient),
+		datastore.WithEndpoint(srv.Endpoint()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+func TestExportImport(t *testing.T) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	src, dst := newClient(t, srv, "src"), newClient(t, srv, "dst")
+
+	// Save some entities of two kinds, and one in another namespace.
+	props := testProperties(ctx)
+	var keys []*datastore.Key
+	var entities []interface{}
+	for i := 0; i < 5; i++ {
+		kind := "A"
+		if i%2 == 1 {
+			kind = "B"
+		}
+		keys = append(keys, datastore.NewKey(ctx, kind, "", int64(i+1), datastore.NewKey(ctx, "Parent", "p", 0, nil)))
+		pl := datastore.PropertyList(props)
+		entities = append(entities, &pl)
+	}
+	keys = append(keys, datastore.NewKey(datastore.WithNamespace(ctx, "other"), "A", "x", 0, nil))
+	entities = append(entities, &datastore.PropertyList{{Name: "N", Value: int64(1)}})
+	if _, err := src.PutMulti(ctx, keys, entities); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportNamespace(ctx, src, &buf)
+	if err != nil || n != 5 {
+		t.Fatalf("ExportNamespace = %d, %v; want 5", n, err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 5 {
+		t.Errorf("export has %d lines, want 5", lines)
+	}
+	n, err = Export(datastore.WithNamespace(ctx, "other"), src, &buf, datastore.NewQuery("A"))
+	if err != nil || n != 1 {
+		t.Fatalf("Export of namespace other = %d, %v; want 1", n, err)
+	}
+	exported := buf.String()
+
+	n, err = Import(ctx, dst, &buf, 2)
+	if err != nil || n != 6 {
+		t.Fatalf("Import = %d, %v; want 6", n, err)
+	}
+	for i, k := range keys[:5] {
+		var got datastore.PropertyList
+		if err := dst.Get(ctx, k, &got); err != nil {
+			t.Fatalf("Get(%v): %v", k, err)
+		}
+		if !equalProperties(got, props) {
+			t.Errorf("imported entity %d:\ngot  %+v\nwant %+v", i, got, props)
+		}
+	}
+
+	// Exporting the copy gives the same file.
+	buf.Reset()
+	if _, err := ExportNamespace(ctx, dst, &buf); err != nil {
+		t.Fatalf("ExportNamespace: %v", err)
+	}
+	if _, err := Export(datastore.WithNamespace(ctx, "other"), dst, &buf, datastore.NewQuery("A")); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if buf.String() != exported {
+		t.Errorf("export of imported entities differs:\ngot  %s\nwant %s", buf.String(), exported)
+	}
+
+	if _, err := Import(ctx, dst, strings.NewReader("{}\n"), 0); err == nil {
+		t.Errorf("Import of an entity without a key succeeded")
+	}
+	if _, err := Import(ctx, dst, strings.NewReader("\n\nnot json\n"), 0); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Import of a bad line: got %v, want an error for line 3", err)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dsmigrate rewrites every entity of a datastore kind, for schema
+// changes.
+//
+// Run reads the keys of a kind in batches, and applies a Transform to each
+// entity in its own transaction, so that concurrent writes are not
+// clobbered. After each batch it can checkpoint a cursor, from which a
+// failed migration can be resumed.
+package dsmigrate // import "google.golang.org/cloud/datastore/dsmigrate"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+// DefaultBatchSize is the number of entities Run migrates at a time, unless
+// told otherwise.
+const DefaultBatchSize = 50
+
+// A Transform changes the properties of the entity with the given key, and
+// reports whether it changed them. Entities it reports unchanged are not
+// saved. An error leaves the entity unchanged, and is reported in the Result.
+//
+// A Transform may be called more than once for an entity, if its
+// transaction has to be retried, so it should not have side effects.
+type Transform func(key *datastore.Key, props *datastore.PropertyList) (changed bool, err error)
+
+var typeOfKey = reflect.TypeOf((*datastore.Key)(nil))
+
+// StructTransform returns a Transform that loads each entity into a new
+// struct, and saves the struct if it is changed. f must be a function of the
+// form
+//
+//	func(key *datastore.Key, dst *S) (changed bool, err error)
+//
+// for some struct type S; StructTransform panics otherwise. An entity that
+// does not fit in S fails with a *datastore.ErrFieldMismatch, rather than losing the
+// properties that S has no field for.
+func StructTransform(f interface{}) Transform {
+	fv := reflect.ValueOf(f)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 2 ||
+		ft.In(0) != typeOfKey || ft.In(1).Kind() != reflect.Ptr || ft.In(1).Elem().Kind() != reflect.Struct ||
+		ft.Out(0).Kind() != reflect.Bool || ft.Out(1) != reflect.TypeOf((*error)(nil)).Elem() {
+		panic(fmt.Sprintf("dsmigrate: StructTransform needs a func(*datastore.Key, *S) (bool, error), not %v", ft))
+	}
+	return func(key *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		dst := reflect.New(ft.In(1).Elem())
+		if err := datastore.LoadStruct(dst.Interface(), *props); err != nil {
+			return false, err
+		}
+		out := fv.Call([]reflect.Value{reflect.ValueOf(key), dst})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return false, err
+		}
+		if !out[0].Bool() {
+			return false, nil
+		}
+		p, err := datastore.SaveStruct(dst.Interface())
+		if err != nil {
+			return false, err
+		}
+		*props = p
+		return true, nil
+	}
+}
+
+// Options configure Run. The zero value, or a nil *Options, migrates the
+// whole kind, DefaultBatchSize entities at a time.
+type Options struct {
+	// BatchSize is the number of entities migrated at a time, concurrently.
+	BatchSize int
+
+	// DryRun is whether to apply the Transform without saving the results.
+	// The Result reports which entities would change.
+	DryRun bool
+
+	// Start is the cursor to resume from, as given to an earlier
+	// migration's Checkpoint. The zero Cursor starts from the beginning.
+	Start datastore.Cursor
+
+	// Checkpoint, if not nil, is called after each batch with a cursor
+	// from which the migration resumes after that batch, and the counts so
+	// far. If it returns an error, Run stops, returning that error.
+	Checkpoint func(c datastore.Cursor, r *Result) error
+}
+
+// Result holds the counts of entities migrated by Run.
+type Result struct {
+	Changed   int // the number of entities changed, or that would be in a dry run
+	Unchanged int // the number of entities left unchanged, including deleted ones
+	Failed    int // the number of entities that could not be migrated
+
+	// Failures holds the error for each failed entity.
+	Failures []Failure
+}
+
+// A Failure records why an entity could not be migrated.
+type Failure struct {
+	Key *datastore.Key
+	Err error
+}
+
+// Run applies f to every entity of kind in the namespace of ctx, saving the
+// entities it changes. Each entity is read, transformed and saved in its own
+// transaction, retried as the client's retry policy allows.
+//
+// Entities that fail are counted in the Result, and do not stop the
+// migration. Run returns an error if it cannot read the kind's keys, or if
+// the Checkpoint returns one; the Result holds the counts up to then.
+func Run(ctx context.Context, c *datastore.Client, kind string, f Transform, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	q := datastore.NewQuery(kind).KeysOnly()
+	if opts.Start.String() != "" {
+		q = q.Start(opts.Start)
+	}
+
+	r := &Result{}
+	it := c.Run(ctx, q)
+	for done := false; !done; {
+		var keys []*datastore.Key
+		for len(keys) < batchSize {
+			k, err := it.Next(nil)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return r, err
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		migrateBatch(ctx, c, keys, f, opts.DryRun, r)
+		if opts.Checkpoint != nil {
+			cursor, err := it.Cursor()
+			if err != nil {
+				return r, err
+			}
+			if err := opts.Checkpoint(cursor, r); err != nil {
+				return r, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// errUnchanged ends the transaction of an entity left unchanged.
+var errUnchanged = errors.New("dsmigrate: unchanged")
+
+// migrateBatch migrates the entities with the given keys concurrently, adding
+// the outcomes to r.
+func migrateBatch(ctx context.Context, c *datastore.Client, keys []*datastore.Key, f Transform, dryRun bool, r *Result) {
+	var opts []datastore.TransactionOption
+	if dryRun {
+		opts = append(opts, datastore.ReadOnly)
+	}
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, k := range keys {
+		wg.Add(1)
+		go func(i int, k *datastore.Key) {
+			defer wg.Done()
+			_, errs[i] = c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+				var props datastore.PropertyList
+				if err := tx.Get(k, &props); err != nil {
+					if err == datastore.ErrNoSuchEntity {
+						// Deleted since its key was read.
+						return errUnchanged
+					}
+					return err
+				}
+				changed, err := f(k, &props)
+				if err != nil {
+					return err
+				}
+				if !changed {
+					return errUnchanged
+				}
+				if dryRun {
+					return nil
+				}
+				_, err = tx.Put(k, &props)
+				return err
+			}, opts...)
+		}(i, k)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		switch err {
+		case nil:
+			r.Changed++
+		case errUnchanged:
+			r.Unchanged++
+		default:
+			r.Failed++
+			r.Failures = append(r.Failures, Failure{keys[i], err})
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsmigrate
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+	"google.golang.org/cloud/datastore/dstest"
+)
+
+type Item struct {
+	N     int64
+	Label string
+}
+
+// setup starts a server, saves items with IDs 1 to n and N equal to their
+// IDs, and returns a client for it.
+func setup(t *testing.T, n int) (*datastore.Client, []*datastore.Key, func()) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ctx := context.Background()
+	c, err := datastore.NewClient(ctx, "proj",
+		datastore.WithHTTPClient(http.DefaultClient),
+		datastore.WithEndpoint(srv.Endpoint()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	var keys []*datastore.Key
+	var items []*Item
+	for i := 1; i <= n; i++ {
+		keys = append(keys, c.NewKey(ctx, "Item", "", int64(i), nil))
+		items = append(items, &Item{N: int64(i)})
+	}
+	if _, err := c.PutMulti(ctx, keys, items); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	return c, keys, srv.Close
+}
+
+// labelEven labels items with even N, and fails for N = 5.
+var labelEven = StructTransform(func(key *datastore.Key, it *Item) (bool, error) {
+	if it.N == 5 {
+		return false, errors.New("five")
+	}
+	if it.N%2 != 0 || it.Label != "" {
+		return false, nil
+	}
+	it.Label = "even"
+	return true, nil
+})
+
+func labels(t *testing.T, c *datastore.Client, keys []*datastore.Key) int {
+	items := make([]Item, len(keys))
+	if err := c.GetMulti(context.Background(), keys, items); err != nil {
+		t.Fatalf("GetMulti: %v", err)
+	}
+	n := 0
+	for _, it := range items {
+		if it.Label != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRun(t *testing.T) {
+	c, keys, done := setup(t, 10)
+	defer done()
+	ctx := context.Background()
+
+	r, err := Run(ctx, c, "Item", labelEven, &Options{BatchSize: 3, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if r.Changed != 5 || r.Unchanged != 4 || r.Failed != 1 {
+		t.Errorf("dry run: got %+v, want 5 changed, 4 unchanged, 1 failed", r)
+	}
+	if n := labels(t, c, keys); n != 0 {
+		t.Errorf("after a dry run, %d items are labeled, want 0", n)
+	}
+
+	r, err = Run(ctx, c, "Item", labelEven, &Options{BatchSize: 3})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if r.Changed != 5 || r.Unchanged != 4 || r.Failed != 1 {
+		t.Errorf("Run: got %+v, want 5 changed, 4 unchanged, 1 failed", r)
+	}
+	if len(r.Failures) != 1 || r.Failures[0].Key.ID() != 5 || r.Failures[0].Err.Error() != "five" {
+		t.Errorf("Run: failures are %+v, want item 5 with error five", r.Failures)
+	}
+	if n := labels(t, c, keys); n != 5 {
+		t.Errorf("after Run, %d items are labeled, want 5", n)
+	}
+
+	// Running again changes nothing.
+	r, err = Run(ctx, c, "Item", labelEven, nil)
+	if err != nil || r.Changed != 0 || r.Unchanged != 9 {
+		t.Errorf("second Run = %+v, %v; want 9 unchanged", r, err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	c, keys, done := setup(t, 10)
+	defer done()
+	ctx := context.Background()
+
+	// Stop after the second batch.
+	var saved datastore.Cursor
+	stop := errors.New("stop")
+	batches := 0
+	opts := &Options{BatchSize: 4, Checkpoint: func(cur datastore.Cursor, r *Result) error {
+		batches++
+		saved = cur
+		if batches == 2 {
+			return stop
+		}
+		return nil
+	}}
+	r, err := Run(ctx, c, "Item", labelEven, opts)
+	if err != stop || r.Changed+r.Unchanged+r.Failed != 8 {
+		t.Fatalf("interrupted Run = %+v, %v; want 8 entities, then the Checkpoint's error", r, err)
+	}
+
+	// Resume from the last checkpoint, through its string form.
+	cur, err := datastore.DecodeCursor(saved.String())
+	if err != nil {
+		t.Fatalf("DecodeCursor: %v", err)
+	}
+	r, err = Run(ctx, c, "Item", labelEven, &Options{Start: cur})
+	if err != nil || r.Changed+r.Unchanged+r.Failed != 2 || r.Changed != 1 {
+		t.Errorf("resumed Run = %+v, %v; want 2 entities, 1 changed", r, err)
+	}
+	if n := labels(t, c, keys); n != 5 {
+		t.Errorf("after resuming, %d items are labeled, want 5", n)
+	}
+}
+
+func TestPropertyListTransform(t *testing.T) {
+	c, keys, done := setup(t, 3)
+	defer done()
+	ctx := context.Background()
+
+	// Rename N to Count, a change a struct could not make.
+	rename := func(key *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		changed := false
+		for i := range *props {
+			if (*props)[i].Name == "N" {
+				(*props)[i].Name = "Count"
+				changed = true
+			}
+		}
+		return changed, nil
+	}
+	r, err := Run(ctx, c, "Item", rename, nil)
+	if err != nil || r.Changed != 3 {
+		t.Fatalf("Run = %+v, %v; want 3 changed", r, err)
+	}
+	var props datastore.PropertyList
+	if err := c.Get(ctx, keys[1], &props); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	found := false
+	for _, p := range props {
+		if p.Name == "N" {
+			t.Errorf("property N is still present")
+		}
+		if p.Name == "Count" && p.Value == int64(2) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got %+v, want Count = 2", props)
+	}
+
+	// A struct that no longer fits the entities fails rather than losing data.
+	r, err = Run(ctx, c, "Item", labelEven, nil)
+	if err != nil || r.Failed != 3 {
+		t.Errorf("struct Run of renamed entities = %+v, %v; want 3 failed", r, err)
+	}
+}
+
+func TestStructTransformPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("StructTransform of a bad function did not panic")
+		}
+	}()
+	StructTransform(func(it *Item) bool { return false })
+}
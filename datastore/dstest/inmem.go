@@ -0,0 +1,519 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package dstest contains test helpers for working with the datastore package.
+
+To use a Server, create it, and then use a context made by its NewContext
+method with the datastore package:
+
+	srv, err := dstest.NewServer()
+	...
+	defer srv.Close()
+	ctx := srv.NewContext("my-project")
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Kind", nil), &e)
+	...
+
+A datastore.Client can be pointed at the server with its Endpoint method:
+
+	client, err := datastore.NewClient(ctx, "my-project",
+		datastore.WithHTTPClient(http.DefaultClient),
+		datastore.WithEndpoint(srv.Endpoint()))
+*/
+package dstest // import "google.golang.org/cloud/datastore/dstest"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// Server is an in-memory Cloud Datastore fake, serving the v1beta2 HTTP API.
+// It is unauthenticated, and only a rough approximation.
+// Each dataset (project) it is sent requests for is independent.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr string
+
+	l net.Listener
+	s *server
+}
+
+// NewServer creates a new Server, listening for HTTP requests at the
+// address named by its Addr field.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr: l.Addr().String(),
+		l:    l,
+		s: &server{
+			datasets: make(map[string]*dataset),
+		},
+	}
+	go http.Serve(l, s.s)
+	return s, nil
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.l.Close()
+}
+
+// NewContext returns a context for use with the datastore package,
+// whose requests are sent to the server for the given project.
+func (s *Server) NewContext(projID string) context.Context {
+	return cloud.NewContext(projID, &http.Client{Transport: redirect(s.Addr)})
+}
+
+// Endpoint returns the base URL of the server's API, for use with
+// datastore.WithEndpoint.
+func (s *Server) Endpoint() string {
+	return "http://" + s.Addr + "/datastore/v1beta2/datasets/"
+}
+
+// redirect is an http.RoundTripper that sends requests to another host,
+// keeping their paths.
+type redirect string
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req2 := new(http.Request)
+	*req2 = *req
+	u := *req.URL
+	u.Scheme, u.Host = "http", string(r)
+	req2.URL = &u
+	return http.DefaultTransport.RoundTrip(req2)
+}
+
+// server is the real implementation of the fake.
+type server struct {
+	mu       sync.Mutex
+	datasets map[string]*dataset // keyed by dataset ID
+}
+
+type dataset struct {
+	entities map[string]*pb.Entity // keyed by keyString; values are never modified
+	groups   map[string]int64      // entity group root keyString -> version of its last write
+	version  int64                 // incremented by each commit
+	nextID   int64                 // the last allocated ID
+	txns     map[string]*transaction
+}
+
+type transaction struct {
+	serializable bool
+	version      int64                 // dataset version when the transaction began
+	snapshot     map[string]*pb.Entity // entities when the transaction began
+	read         map[string]bool       // entity groups read
+}
+
+// apiError is an error to report to the client as an HTTP response.
+type apiError struct {
+	code   int
+	reason string
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func errorf(code int, reason, format string, args ...interface{}) *apiError {
+	return &apiError{code: code, reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) *apiError {
+	return errorf(http.StatusBadRequest, "INVALID_ARGUMENT", format, args...)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Paths look like .../datasets/<dataset>/<method>.
+	parts := strings.Split(r.URL.Path, "/")
+	if r.Method != "POST" || len(parts) < 3 || parts[len(parts)-3] != "datasets" {
+		writeError(w, errorf(http.StatusNotFound, "NOT_FOUND", "no such method %s %s", r.Method, r.URL.Path))
+		return
+	}
+	dsID, method := parts[len(parts)-2], parts[len(parts)-1]
+
+	var req, resp proto.Message
+	var do func(*dataset) error
+	switch method {
+	case "lookup":
+		in, out := new(pb.LookupRequest), new(pb.LookupResponse)
+		req, resp, do = in, out, func(ds *dataset) error { return ds.lookup(in, out) }
+	case "runQuery":
+		in, out := new(pb.RunQueryRequest), new(pb.RunQueryResponse)
+		req, resp, do = in, out, func(ds *dataset) error { return ds.runQuery(in, out) }
+	case "beginTransaction":
+		in, out := new(pb.BeginTransactionRequest), new(pb.BeginTransactionResponse)
+		req, resp, do = in, out, func(ds *dataset) error { return ds.beginTransaction(in, out) }
+	case "commit":
+		in, out := new(pb.CommitRequest), new(pb.CommitResponse)
+		req, resp, do = in, out, func(ds *dataset) error { return ds.commit(in, out) }
+	case "rollback":
+		in, out := new(pb.RollbackRequest), new(pb.RollbackResponse)
+		req, resp, do = in, out, func(ds *dataset) error { return ds.rollback(in) }
+	case "allocateIds":
+		in, out := new(pb.AllocateIdsRequest), new(pb.AllocateIdsResponse)
+		req, resp, do = in, out, func(ds *dataset) error { return ds.allocateIDs(in, out) }
+	default:
+		writeError(w, errorf(http.StatusNotFound, "NOT_FOUND", "no such method %q", method))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, badRequest("reading request: %v", err))
+		return
+	}
+	if err := proto.Unmarshal(body, req); err != nil {
+		writeError(w, badRequest("bad request: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	ds, ok := s.datasets[dsID]
+	if !ok {
+		ds = &dataset{
+			entities: make(map[string]*pb.Entity),
+			groups:   make(map[string]int64),
+			txns:     make(map[string]*transaction),
+		}
+		s.datasets[dsID] = ds
+	}
+	err = do(ds)
+	s.mu.Unlock()
+	if err != nil {
+		if e, ok := err.(*apiError); ok {
+			writeError(w, e)
+		} else {
+			writeError(w, errorf(http.StatusInternalServerError, "INTERNAL", "%v", err))
+		}
+		return
+	}
+
+	out, err := proto.Marshal(resp)
+	if err != nil {
+		writeError(w, errorf(http.StatusInternalServerError, "INTERNAL", "marshaling response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(out)
+}
+
+// writeError writes an error in the JSON format used by Google APIs.
+func writeError(w http.ResponseWriter, e *apiError) {
+	type item struct {
+		Domain  string `json:"domain"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	var body struct {
+		Error struct {
+			Errors  []item `json:"errors"`
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Errors = []item{{Domain: "global", Reason: e.reason, Message: e.msg}}
+	body.Error.Code = e.code
+	body.Error.Message = e.msg
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(e.code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// keyString returns a string uniquely identifying a key, for use as a map key.
+func keyString(k *pb.Key) string {
+	var buf bytes.Buffer
+	buf.WriteString(k.GetPartitionId().GetNamespace())
+	for _, el := range k.PathElement {
+		fmt.Fprintf(&buf, "\x00%s\x00", el.GetKind())
+		if el.Id != nil {
+			fmt.Fprintf(&buf, "i%d", el.GetId())
+		} else {
+			fmt.Fprintf(&buf, "s%s", el.GetName())
+		}
+	}
+	return buf.String()
+}
+
+// groupString returns the keyString of the root of a key's entity group.
+func groupString(k *pb.Key) string {
+	return keyString(&pb.Key{PartitionId: k.PartitionId, PathElement: k.PathElement[:1]})
+}
+
+// checkKey checks that a key is valid, and complete if required.
+func checkKey(k *pb.Key, complete bool) error {
+	if k == nil || len(k.PathElement) == 0 {
+		return badRequest("empty key")
+	}
+	for i, el := range k.PathElement {
+		if el.GetKind() == "" {
+			return badRequest("key path element with no kind")
+		}
+		if el.Id != nil && el.Name != nil {
+			return badRequest("key path element with both an ID and a name")
+		}
+		if el.Id != nil && el.GetId() == 0 || el.Name != nil && el.GetName() == "" {
+			return badRequest("key path element with an empty ID or name")
+		}
+		last := i == len(k.PathElement)-1
+		if (!last || complete) && el.Id == nil && el.Name == nil {
+			return badRequest("incomplete key %v", k)
+		}
+	}
+	return nil
+}
+
+// readSource returns the entities to read, which are a transaction's snapshot
+// if the options name one.
+func (ds *dataset) readSource(opts *pb.ReadOptions) (map[string]*pb.Entity, *transaction, error) {
+	if opts.GetTransaction() == nil {
+		return ds.entities, nil, nil
+	}
+	if opts.GetReadConsistency() == pb.ReadOptions_EVENTUAL {
+		return nil, nil, badRequest("eventually consistent reads are not allowed in a transaction")
+	}
+	tx, ok := ds.txns[string(opts.Transaction)]
+	if !ok {
+		return nil, nil, badRequest("invalid transaction")
+	}
+	return tx.snapshot, tx, nil
+}
+
+func (ds *dataset) lookup(req *pb.LookupRequest, resp *pb.LookupResponse) error {
+	src, tx, err := ds.readSource(req.ReadOptions)
+	if err != nil {
+		return err
+	}
+	for _, k := range req.Key {
+		if err := checkKey(k, true); err != nil {
+			return err
+		}
+	}
+	for _, k := range req.Key {
+		if tx != nil {
+			tx.read[groupString(k)] = true
+		}
+		if e, ok := src[keyString(k)]; ok {
+			resp.Found = append(resp.Found, &pb.EntityResult{Entity: e})
+		} else {
+			resp.Missing = append(resp.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}})
+		}
+	}
+	return nil
+}
+
+func (ds *dataset) beginTransaction(req *pb.BeginTransactionRequest, resp *pb.BeginTransactionResponse) error {
+	tx := &transaction{
+		serializable: req.GetIsolationLevel() == pb.BeginTransactionRequest_SERIALIZABLE,
+		version:      ds.version,
+		snapshot:     make(map[string]*pb.Entity, len(ds.entities)),
+		read:         make(map[string]bool),
+	}
+	for k, e := range ds.entities {
+		tx.snapshot[k] = e
+	}
+	var id []byte
+	for id == nil || ds.txns[string(id)] != nil {
+		id = make([]byte, 8)
+		binary.BigEndian.PutUint64(id, uint64(rand.Int63()))
+	}
+	ds.txns[string(id)] = tx
+	resp.Transaction = id
+	return nil
+}
+
+func (ds *dataset) rollback(req *pb.RollbackRequest) error {
+	if _, ok := ds.txns[string(req.Transaction)]; !ok {
+		return badRequest("invalid transaction")
+	}
+	delete(ds.txns, string(req.Transaction))
+	return nil
+}
+
+func (ds *dataset) allocateIDs(req *pb.AllocateIdsRequest, resp *pb.AllocateIdsResponse) error {
+	for _, k := range req.Key {
+		if err := checkKey(k, false); err != nil {
+			return err
+		}
+		if el := k.PathElement[len(k.PathElement)-1]; el.Id != nil || el.Name != nil {
+			return badRequest("key %v is complete", k)
+		}
+	}
+	for _, k := range req.Key {
+		resp.Key = append(resp.Key, ds.allocateID(k))
+	}
+	return nil
+}
+
+// allocateID returns a copy of an incomplete key, completed with a new ID.
+func (ds *dataset) allocateID(k *pb.Key) *pb.Key {
+	ds.nextID++
+	k = proto.Clone(k).(*pb.Key)
+	k.PathElement[len(k.PathElement)-1].Id = proto.Int64(ds.nextID)
+	return k
+}
+
+func (ds *dataset) commit(req *pb.CommitRequest, resp *pb.CommitResponse) error {
+	var tx *transaction
+	switch req.GetMode() {
+	case pb.CommitRequest_TRANSACTIONAL:
+		if req.Transaction == nil {
+			return badRequest("transactional commit with no transaction")
+		}
+		var ok bool
+		if tx, ok = ds.txns[string(req.Transaction)]; !ok {
+			return badRequest("invalid transaction")
+		}
+	case pb.CommitRequest_NON_TRANSACTIONAL:
+		if req.Transaction != nil {
+			return badRequest("non-transactional commit with a transaction")
+		}
+	}
+
+	// Check the mutation before changing anything.
+	m := req.Mutation
+	if m == nil {
+		m = &pb.Mutation{}
+	}
+	groups := make(map[string]bool)
+	for _, e := range append(append(append([]*pb.Entity(nil), m.Upsert...), m.Update...), m.Insert...) {
+		if err := checkKey(e.Key, true); err != nil {
+			return err
+		}
+		if err := checkEntity(e); err != nil {
+			return err
+		}
+		groups[groupString(e.Key)] = true
+	}
+	for _, e := range m.InsertAutoId {
+		if err := checkKey(e.Key, false); err != nil {
+			return err
+		}
+		if el := e.Key.PathElement[len(e.Key.PathElement)-1]; el.Id != nil || el.Name != nil {
+			return badRequest("insert_auto_id of complete key %v", e.Key)
+		}
+		if err := checkEntity(e); err != nil {
+			return err
+		}
+		groups[groupString(e.Key)] = true
+	}
+	for _, k := range m.Delete {
+		if err := checkKey(k, true); err != nil {
+			return err
+		}
+		groups[groupString(k)] = true
+	}
+
+	if tx != nil {
+		// The transaction is over, whether or not it commits.
+		delete(ds.txns, string(req.Transaction))
+		if tx.serializable {
+			for g := range tx.read {
+				groups[g] = true
+			}
+		}
+		for g := range groups {
+			if ds.groups[g] > tx.version {
+				return errorf(http.StatusConflict, "ABORTED", "too much contention on these datastore entities. please try again.")
+			}
+		}
+	}
+
+	type write struct {
+		key string
+		e   *pb.Entity // nil to delete
+	}
+	var writes []write
+	exists := func(k string) bool {
+		for i := len(writes) - 1; i >= 0; i-- {
+			if writes[i].key == k {
+				return writes[i].e != nil
+			}
+		}
+		_, ok := ds.entities[k]
+		return ok
+	}
+	for _, e := range m.Upsert {
+		writes = append(writes, write{keyString(e.Key), e})
+	}
+	for _, e := range m.Update {
+		k := keyString(e.Key)
+		if !exists(k) {
+			return errorf(http.StatusNotFound, "NOT_FOUND", "no entity to update: %v", e.Key)
+		}
+		writes = append(writes, write{k, e})
+	}
+	for _, e := range m.Insert {
+		k := keyString(e.Key)
+		if exists(k) {
+			return errorf(http.StatusConflict, "ALREADY_EXISTS", "entity already exists: %v", e.Key)
+		}
+		writes = append(writes, write{k, e})
+	}
+	for _, k := range m.Delete {
+		writes = append(writes, write{keyString(k), nil})
+	}
+
+	// Apply the mutation.
+	ds.version++
+	resp.MutationResult = &pb.MutationResult{IndexUpdates: proto.Int32(0)}
+	for _, w := range writes {
+		if w.e == nil {
+			delete(ds.entities, w.key)
+		} else {
+			ds.entities[w.key] = proto.Clone(w.e).(*pb.Entity)
+		}
+	}
+	for _, e := range m.InsertAutoId {
+		e = proto.Clone(e).(*pb.Entity)
+		e.Key = ds.allocateID(e.Key)
+		ds.entities[keyString(e.Key)] = e
+		resp.MutationResult.InsertAutoIdKey = append(resp.MutationResult.InsertAutoIdKey, e.Key)
+	}
+	for g := range groups {
+		ds.groups[g] = ds.version
+	}
+	*resp.MutationResult.IndexUpdates = int32(len(writes) + len(m.InsertAutoId))
+	return nil
+}
+
+// checkEntity checks the properties of an entity being written.
+func checkEntity(e *pb.Entity) error {
+	for _, p := range e.Property {
+		if p.GetName() == "" {
+			return badRequest("property with no name in %v", e.Key)
+		}
+		if strings.HasPrefix(p.GetName(), "__") && strings.HasSuffix(p.GetName(), "__") {
+			return badRequest("property name %q is reserved", p.GetName())
+		}
+		if p.Value == nil {
+			return badRequest("property %q has no value", p.GetName())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/datastore"
+)
+
+type Person struct {
+	Name string
+	Age  int64
+	Tags []string
+}
+
+func newTestContext(t *testing.T) (context.Context, func()) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv.NewContext("proj"), srv.Close
+}
+
+// putPeople stores some people as children of a parent key, which is returned.
+func putPeople(t *testing.T, ctx context.Context) *datastore.Key {
+	parent := datastore.NewKey(ctx, "Group", "g", 0, nil)
+	people := []*Person{
+		{Name: "alice", Age: 30, Tags: []string{"a", "z"}},
+		{Name: "bob", Age: 25, Tags: []string{"b"}},
+		{Name: "carol", Age: 35, Tags: []string{"a", "c"}},
+		{Name: "dave", Age: 25},
+	}
+	var keys []*datastore.Key
+	for _, p := range people {
+		keys = append(keys, datastore.NewKey(ctx, "Person", p.Name, 0, parent))
+	}
+	if _, err := datastore.PutMulti(ctx, keys, people); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	return parent
+}
+
+func names(people []*Person) []string {
+	var s []string
+	for _, p := range people {
+		s = append(s, p.Name)
+	}
+	return s
+}
+
+func TestGetPutDelete(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+
+	k, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Person", nil), &Person{Name: "alice", Age: 30})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if k.Incomplete() {
+		t.Fatalf("Put returned incomplete key %v", k)
+	}
+	var p Person
+	if err := datastore.Get(ctx, k, &p); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want := (Person{Name: "alice", Age: 30}); !reflect.DeepEqual(p, want) {
+		t.Errorf("Get = %+v, want %+v", p, want)
+	}
+	if err := datastore.Delete(ctx, k); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := datastore.Get(ctx, k, &p); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Get after Delete: got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	parent := putPeople(t, ctx)
+	datastore.Put(ctx, datastore.NewKey(ctx, "Person", "erin", 0, nil), &Person{Name: "erin", Age: 40})
+
+	tests := []struct {
+		desc string
+		q    *datastore.Query
+		want []string
+	}{
+		{"all", datastore.NewQuery("Person"), []string{"alice", "bob", "carol", "dave", "erin"}}, // Group keys sort first
+		{"ancestor", datastore.NewQuery("Person").Ancestor(parent), []string{"alice", "bob", "carol", "dave"}},
+		{"equality", datastore.NewQuery("Person").Filter("Age =", 25), []string{"bob", "dave"}},
+		{"inequality", datastore.NewQuery("Person").Filter("Age >", 25).Filter("Age <=", 35), []string{"alice", "carol"}},
+		{"multi-valued", datastore.NewQuery("Person").Filter("Tags =", "a"), []string{"alice", "carol"}},
+		{"order", datastore.NewQuery("Person").Order("-Age").Order("Name"), []string{"erin", "carol", "alice", "bob", "dave"}},
+		{"multi-valued order", datastore.NewQuery("Person").Order("-Tags"), []string{"alice", "carol", "bob"}},
+		{"offset and limit", datastore.NewQuery("Person").Order("Name").Offset(1).Limit(2), []string{"bob", "carol"}},
+	}
+	for _, tc := range tests {
+		var got []*Person
+		if _, err := tc.q.GetAll(ctx, &got); err != nil {
+			t.Errorf("%s: GetAll: %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(names(got), tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.desc, names(got), tc.want)
+		}
+	}
+
+	n, err := datastore.NewQuery("Person").Filter("Age =", 25).Count(ctx)
+	if err != nil || n != 2 {
+		t.Errorf("Count = %d, %v; want 2", n, err)
+	}
+
+	keys, err := datastore.NewQuery("Person").Ancestor(parent).KeysOnly().GetAll(ctx, nil)
+	if err != nil || len(keys) != 4 || keys[0].Name() != "alice" {
+		t.Errorf("keys-only GetAll = %v, %v; want 4 keys, starting with alice", keys, err)
+	}
+
+	for _, q := range []*datastore.Query{
+		datastore.NewQuery("Person").Filter("Age >", 25).Filter("Name >", "a"),
+		datastore.NewQuery("Person").Filter("Age >", 25).Order("Name"),
+		datastore.NewQuery("").Filter("Age =", 25),
+	} {
+		if _, err := q.GetAll(ctx, &[]*Person{}); err == nil {
+			t.Errorf("GetAll of invalid query %+v succeeded", q)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	putPeople(t, ctx)
+
+	var got []*Person
+	if _, err := datastore.NewQuery("Person").Project("Tags").Order("Tags").GetAll(ctx, &got); err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	var tags []string
+	for _, p := range got {
+		if p.Name != "" || len(p.Tags) != 1 {
+			t.Errorf("projected entity %+v, want only one tag", p)
+		}
+		tags = append(tags, p.Tags...)
+	}
+	if want := []string{"a", "a", "b", "c", "z"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("projected tags = %q, want %q", tags, want)
+	}
+
+	got = nil
+	if _, err := datastore.NewQuery("Person").Project("Age").Distinct().GetAll(ctx, &got); err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("distinct ages: got %d results, want 3", len(got))
+	}
+}
+
+func TestCursors(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	putPeople(t, ctx)
+
+	q := datastore.NewQuery("Person").Order("Name")
+	it := q.Limit(2).Run(ctx)
+	var p Person
+	for {
+		if _, err := it.Next(&p); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatalf("Cursor: %v", err)
+	}
+	// Round-trip the cursor, as a caller resuming later would.
+	c, err = datastore.DecodeCursor(c.String())
+	if err != nil {
+		t.Fatalf("DecodeCursor: %v", err)
+	}
+	var rest []*Person
+	if _, err := q.Start(c).GetAll(ctx, &rest); err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if want := []string{"carol", "dave"}; !reflect.DeepEqual(names(rest), want) {
+		t.Errorf("after cursor, got %q, want %q", names(rest), want)
+	}
+	var first []*Person
+	if _, err := q.End(c).GetAll(ctx, &first); err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(names(first), want) {
+		t.Errorf("before cursor, got %q, want %q", names(first), want)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	parent := putPeople(t, ctx)
+	alice := datastore.NewKey(ctx, "Person", "alice", 0, parent)
+
+	// Reads in a transaction see a snapshot.
+	tx, err := datastore.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	if _, err := datastore.Put(ctx, alice, &Person{Name: "alice", Age: 31}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var p Person
+	if err := tx.Get(alice, &p); err != nil || p.Age != 30 {
+		t.Errorf("Get in transaction = %+v, %v; want age 30", p, err)
+	}
+	tx.Rollback()
+
+	// A transaction conflicts with writes to its entity groups since it began.
+	tx, err = datastore.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	if err := tx.Get(alice, &p); err != nil {
+		t.Fatalf("Get in transaction: %v", err)
+	}
+	if _, err := tx.Put(alice, &Person{Name: "alice", Age: p.Age + 1}); err != nil {
+		t.Fatalf("Put in transaction: %v", err)
+	}
+	bob := datastore.NewKey(ctx, "Person", "bob", 0, parent)
+	if _, err := datastore.Put(ctx, bob, &Person{Name: "bob", Age: 26}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := tx.Commit(); err != datastore.ErrConcurrentTransaction {
+		t.Errorf("Commit after conflicting write: got %v, want ErrConcurrentTransaction", err)
+	}
+
+	// Without a conflict, the commit applies.
+	tx, err = datastore.NewTransaction(ctx, datastore.Serializable)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	var people []*Person
+	if _, err := datastore.NewQuery("Person").Ancestor(parent).Transaction(tx).GetAll(ctx, &people); err != nil {
+		t.Fatalf("GetAll in transaction: %v", err)
+	}
+	if _, err := tx.Put(alice, &Person{Name: "alice", Age: 50}); err != nil {
+		t.Fatalf("Put in transaction: %v", err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := datastore.Get(ctx, alice, &p); err != nil || p.Age != 50 {
+		t.Errorf("Get after Commit = %+v, %v; want age 50", p, err)
+	}
+
+	// Queries in transactions must have ancestors.
+	tx, err = datastore.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := datastore.NewQuery("Person").Transaction(tx).GetAll(ctx, &people); err == nil {
+		t.Errorf("non-ancestor query in transaction succeeded")
+	}
+}
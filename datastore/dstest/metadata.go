@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// The metadata pseudo-kinds, whose entities describe the others.
+const (
+	namespaceKind = "__namespace__"
+	kindKind      = "__kind__"
+	propertyKind  = "__property__"
+)
+
+// isMetadataKind reports whether a query's kind is a pseudo-kind, including
+// ones that are not supported.
+func isMetadataKind(kind string) bool {
+	return strings.HasPrefix(kind, "__") && strings.HasSuffix(kind, "__")
+}
+
+// metadata returns the entities of the metadata pseudo-kind kind, describing
+// the entities in src, keyed as src is. Their keys are in namespace, so that
+// queries in that namespace find them. Unsupported pseudo-kinds have no
+// entities.
+func metadata(src map[string]*pb.Entity, kind, namespace string) map[string]*pb.Entity {
+	out := make(map[string]*pb.Entity)
+	add := func(e *pb.Entity) {
+		e.Key.PartitionId = &pb.PartitionId{Namespace: proto.String(namespace)}
+		out[keyString(e.Key)] = e
+	}
+	switch kind {
+	case namespaceKind:
+		for _, e := range src {
+			el := &pb.Key_PathElement{Kind: proto.String(namespaceKind)}
+			if ns := e.Key.GetPartitionId().GetNamespace(); ns != "" {
+				el.Name = proto.String(ns)
+			} else {
+				// The default namespace has an ID, as keys cannot have
+				// empty names.
+				el.Id = proto.Int64(1)
+			}
+			add(&pb.Entity{Key: &pb.Key{PathElement: []*pb.Key_PathElement{el}}})
+		}
+	case kindKind:
+		for _, e := range src {
+			if e.Key.GetPartitionId().GetNamespace() != namespace {
+				continue
+			}
+			add(&pb.Entity{Key: &pb.Key{PathElement: []*pb.Key_PathElement{
+				{Kind: proto.String(kindKind), Name: proto.String(entityKind(e))},
+			}}})
+		}
+	case propertyKind:
+		// Collect the representations of each kind's indexed properties.
+		reprs := make(map[[2]string]map[string]bool)
+		for _, e := range src {
+			if e.Key.GetPartitionId().GetNamespace() != namespace {
+				continue
+			}
+			for _, p := range e.Property {
+				for _, v := range indexedValues(e, p.GetName()) {
+					id := [2]string{entityKind(e), p.GetName()}
+					if reprs[id] == nil {
+						reprs[id] = make(map[string]bool)
+					}
+					reprs[id][representation(v)] = true
+				}
+			}
+		}
+		for id, m := range reprs {
+			var names []string
+			for r := range m {
+				names = append(names, r)
+			}
+			sort.Strings(names)
+			list := &pb.Value{}
+			for _, r := range names {
+				list.ListValue = append(list.ListValue, &pb.Value{StringValue: proto.String(r), Indexed: proto.Bool(true)})
+			}
+			add(&pb.Entity{
+				Key: &pb.Key{PathElement: []*pb.Key_PathElement{
+					{Kind: proto.String(kindKind), Name: proto.String(id[0])},
+					{Kind: proto.String(propertyKind), Name: proto.String(id[1])},
+				}},
+				Property: []*pb.Property{{Name: proto.String("property_representation"), Value: list}},
+			})
+		}
+	}
+	return out
+}
+
+// entityKind returns the kind of an entity.
+func entityKind(e *pb.Entity) string {
+	return e.Key.PathElement[len(e.Key.PathElement)-1].GetKind()
+}
+
+// representation returns the name of the datastore's representation of an
+// indexed value, as reported by __property__ entities.
+func representation(v *pb.Value) string {
+	switch {
+	case v.IntegerValue != nil, v.TimestampMicrosecondsValue != nil:
+		return "INT64"
+	case v.BooleanValue != nil:
+		return "BOOLEAN"
+	case v.DoubleValue != nil:
+		return "DOUBLE"
+	case v.KeyValue != nil:
+		return "REFERENCE"
+	case v.StringValue != nil, v.BlobValue != nil, v.BlobKeyValue != nil:
+		return "STRING"
+	}
+	return "NULL"
+}
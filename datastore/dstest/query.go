@@ -0,0 +1,588 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+const (
+	keyProperty     = "__key__"
+	scatterProperty = "__scatter__"
+)
+
+// result is one result of a query.
+type result struct {
+	e *pb.Entity // the entity, its projection, or just its key
+
+	// vals holds the value of each sort order, followed by the projected values.
+	// The values of multi-valued properties used by sort orders are
+	// the smallest for ascending orders and the largest for descending ones.
+	vals []*pb.Value
+}
+
+func (ds *dataset) runQuery(req *pb.RunQueryRequest, resp *pb.RunQueryResponse) error {
+	if req.GqlQuery != nil {
+		return badRequest("GQL queries are not supported")
+	}
+	q := req.Query
+	if q == nil {
+		return badRequest("no query")
+	}
+	src, tx, err := ds.readSource(req.ReadOptions)
+	if err != nil {
+		return err
+	}
+
+	var kind string
+	switch len(q.Kind) {
+	case 0:
+	case 1:
+		kind = q.Kind[0].GetName()
+	default:
+		return badRequest("queries may only have one kind")
+	}
+
+	// Check the filters, finding any ancestor.
+	filters, err := flattenFilter(q.Filter)
+	if err != nil {
+		return err
+	}
+	var ancestor *pb.Key
+	var ineqProp string
+	for _, f := range filters {
+		name := f.GetProperty().GetName()
+		if f.Value == nil {
+			return badRequest("filter on %q has no value", name)
+		}
+		if kind == "" && name != keyProperty {
+			return badRequest("kindless queries may only filter on %s", keyProperty)
+		}
+		switch f.GetOperator() {
+		case pb.PropertyFilter_HAS_ANCESTOR:
+			if name != keyProperty || f.Value.KeyValue == nil {
+				return badRequest("ancestor filters must be on %s, with a key value", keyProperty)
+			}
+			if ancestor != nil {
+				return badRequest("queries may only have one ancestor")
+			}
+			if err := checkKey(f.Value.KeyValue, true); err != nil {
+				return err
+			}
+			ancestor = f.Value.KeyValue
+			continue
+		case pb.PropertyFilter_EQUAL:
+		case pb.PropertyFilter_LESS_THAN, pb.PropertyFilter_LESS_THAN_OR_EQUAL,
+			pb.PropertyFilter_GREATER_THAN, pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			if ineqProp != "" && ineqProp != name {
+				return badRequest("inequality filters may only be on one property")
+			}
+			ineqProp = name
+		default:
+			return badRequest("unknown filter operator %v", f.GetOperator())
+		}
+		if name == keyProperty && f.Value.KeyValue == nil {
+			return badRequest("filters on %s must have key values", keyProperty)
+		}
+	}
+	for i, o := range q.Order {
+		name := o.GetProperty().GetName()
+		if kind == "" && (name != keyProperty || o.GetDirection() != pb.PropertyOrder_ASCENDING) {
+			return badRequest("kindless queries may only be ordered by ascending %s", keyProperty)
+		}
+		if i == 0 && ineqProp != "" && name != ineqProp {
+			return badRequest("the first sort order must be on the property with inequality filters, %q", ineqProp)
+		}
+	}
+	if tx != nil {
+		if ancestor == nil {
+			return badRequest("only ancestor queries are allowed in transactions")
+		}
+		tx.read[groupString(ancestor)] = true
+	}
+
+	var projection []string
+	for _, p := range q.Projection {
+		projection = append(projection, p.GetProperty().GetName())
+	}
+	keysOnly := len(projection) == 1 && projection[0] == keyProperty
+	if !keysOnly {
+		for _, name := range projection {
+			if name == keyProperty {
+				return badRequest("%s may only be projected alone", keyProperty)
+			}
+		}
+	}
+	for _, g := range q.GroupBy {
+		found := false
+		for _, name := range projection {
+			found = found || name == g.GetName()
+		}
+		if !found || keysOnly {
+			return badRequest("group by property %q must be projected", g.GetName())
+		}
+	}
+
+	namespace := req.GetPartitionId().GetNamespace()
+	if namespace == "" && ancestor != nil {
+		namespace = ancestor.GetPartitionId().GetNamespace()
+	}
+
+	if isMetadataKind(kind) {
+		src = metadata(src, kind, namespace)
+	}
+
+	// Find the results.
+	var results []*result
+	for _, e := range src {
+		k := e.Key
+		if k.GetPartitionId().GetNamespace() != namespace {
+			continue
+		}
+		if kind != "" && k.PathElement[len(k.PathElement)-1].GetKind() != kind {
+			continue
+		}
+		if ancestor != nil && !hasAncestor(k, ancestor) {
+			continue
+		}
+		if !matchesAll(e, filters) {
+			continue
+		}
+		var vals []*pb.Value
+		for _, o := range q.Order {
+			v := orderValue(e, o)
+			if v == nil {
+				// Entities without an indexed value are not in the index.
+				break
+			}
+			vals = append(vals, v)
+		}
+		if len(vals) < len(q.Order) {
+			continue
+		}
+		switch {
+		case keysOnly:
+			results = append(results, &result{e: &pb.Entity{Key: k}, vals: vals})
+		case len(projection) > 0:
+			results = append(results, project(e, projection, q.Order, vals)...)
+		default:
+			results = append(results, &result{e: e, vals: vals})
+		}
+	}
+	sort.Sort(byOrder{results, q.Order})
+
+	if len(q.GroupBy) > 0 && len(results) > 0 {
+		results = distinct(results, projection, q.GroupBy)
+	}
+
+	// Apply the cursors, offset and limit.
+	nVals := len(q.Order)
+	if !keysOnly {
+		nVals += len(projection)
+	}
+	if len(q.StartCursor) > 0 {
+		c, err := decodeCursor(q.StartCursor, nVals)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(results), func(i int) bool { return compareResults(results[i], c, q.Order) > 0 })
+		results = results[i:]
+	}
+	if len(q.EndCursor) > 0 {
+		c, err := decodeCursor(q.EndCursor, nVals)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(results), func(i int) bool { return compareResults(results[i], c, q.Order) > 0 })
+		results = results[:i]
+	}
+	endCursor := q.StartCursor
+	if endCursor == nil {
+		endCursor = []byte{} // the beginning
+	}
+	var skipped int32
+	for skipped < q.GetOffset() && len(results) > 0 {
+		endCursor = encodeCursor(results[0])
+		results = results[1:]
+		skipped++
+	}
+	more := pb.QueryResultBatch_NO_MORE_RESULTS
+	if q.Limit != nil && int(q.GetLimit()) < len(results) {
+		results = results[:q.GetLimit()]
+		more = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	}
+
+	resultType := pb.EntityResult_FULL
+	switch {
+	case keysOnly:
+		resultType = pb.EntityResult_KEY_ONLY
+	case len(projection) > 0:
+		resultType = pb.EntityResult_PROJECTION
+	}
+	batch := &pb.QueryResultBatch{
+		EntityResultType: resultType.Enum(),
+		MoreResults:      more.Enum(),
+	}
+	if skipped > 0 {
+		batch.SkippedResults = proto.Int32(skipped)
+	}
+	for _, r := range results {
+		batch.EntityResult = append(batch.EntityResult, &pb.EntityResult{Entity: r.e})
+		endCursor = encodeCursor(r)
+	}
+	batch.EndCursor = endCursor
+	resp.Batch = batch
+	return nil
+}
+
+// flattenFilter returns the property filters that make up a filter.
+func flattenFilter(f *pb.Filter) ([]*pb.PropertyFilter, error) {
+	switch {
+	case f == nil:
+		return nil, nil
+	case f.PropertyFilter != nil:
+		return []*pb.PropertyFilter{f.PropertyFilter}, nil
+	case f.CompositeFilter != nil:
+		if f.CompositeFilter.GetOperator() != pb.CompositeFilter_AND {
+			return nil, badRequest("unknown composite filter operator %v", f.CompositeFilter.GetOperator())
+		}
+		var filters []*pb.PropertyFilter
+		for _, sub := range f.CompositeFilter.Filter {
+			fs, err := flattenFilter(sub)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, fs...)
+		}
+		return filters, nil
+	}
+	return nil, badRequest("empty filter")
+}
+
+// indexedValues returns the indexed values of a property of an entity.
+// Multi-valued properties have one for each indexed value in their list.
+func indexedValues(e *pb.Entity, name string) []*pb.Value {
+	switch name {
+	case keyProperty:
+		return []*pb.Value{{KeyValue: e.Key}}
+	case scatterProperty:
+		// Unlike the datastore, which samples entities, every entity has
+		// a scatter value, taken from a hash of its key.
+		h := fnv.New64a()
+		h.Write([]byte(keyString(e.Key)))
+		return []*pb.Value{{BlobValue: h.Sum(nil)}}
+	}
+	var vals []*pb.Value
+	for _, p := range e.Property {
+		if p.GetName() != name {
+			continue
+		}
+		list := p.Value.ListValue
+		if len(list) == 0 {
+			list = []*pb.Value{p.Value}
+		}
+		for _, v := range list {
+			if v.GetIndexed() && v.EntityValue == nil && len(v.ListValue) == 0 {
+				vals = append(vals, v)
+			}
+		}
+	}
+	return vals
+}
+
+// matchesAll reports whether an entity matches every filter except ancestor ones.
+// A filter on a multi-valued property matches if any of its values do.
+func matchesAll(e *pb.Entity, filters []*pb.PropertyFilter) bool {
+	for _, f := range filters {
+		if f.GetOperator() == pb.PropertyFilter_HAS_ANCESTOR {
+			continue
+		}
+		matched := false
+		for _, v := range indexedValues(e, f.GetProperty().GetName()) {
+			c := compareValues(v, f.Value)
+			switch f.GetOperator() {
+			case pb.PropertyFilter_LESS_THAN:
+				matched = c < 0
+			case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+				matched = c <= 0
+			case pb.PropertyFilter_GREATER_THAN:
+				matched = c > 0
+			case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+				matched = c >= 0
+			case pb.PropertyFilter_EQUAL:
+				matched = c == 0
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// orderValue returns the value an entity is sorted by for an order,
+// or nil if the entity has no indexed value for it.
+func orderValue(e *pb.Entity, o *pb.PropertyOrder) *pb.Value {
+	var best *pb.Value
+	desc := o.GetDirection() == pb.PropertyOrder_DESCENDING
+	for _, v := range indexedValues(e, o.GetProperty().GetName()) {
+		if best == nil {
+			best = v
+			continue
+		}
+		c := compareValues(v, best)
+		if (c < 0 && !desc) || (c > 0 && desc) {
+			best = v
+		}
+	}
+	return best
+}
+
+// project returns the projections of an entity; there is one for each
+// combination of the values of its multi-valued projected properties.
+// Orders on projected properties use the projected value.
+func project(e *pb.Entity, projection []string, orders []*pb.PropertyOrder, vals []*pb.Value) []*result {
+	results := []*result{{e: &pb.Entity{Key: e.Key}, vals: vals}}
+	for _, name := range projection {
+		var next []*result
+		for _, r := range results {
+			for _, v := range indexedValues(e, name) {
+				rv := append(append([]*pb.Value(nil), r.vals...), v)
+				for i, o := range orders {
+					if o.GetProperty().GetName() == name {
+						rv[i] = v
+					}
+				}
+				re := &pb.Entity{
+					Key:      e.Key,
+					Property: append(append([]*pb.Property(nil), r.e.Property...), &pb.Property{Name: proto.String(name), Value: v}),
+				}
+				next = append(next, &result{e: re, vals: rv})
+			}
+		}
+		results = next
+	}
+	return results
+}
+
+// distinct returns the first of each group of results
+// with the same values for the group by properties.
+func distinct(results []*result, projection []string, groupBy []*pb.PropertyReference) []*result {
+	nOrders := len(results[0].vals) - len(projection)
+	seen := make(map[string]bool)
+	var out []*result
+	for _, r := range results {
+		var group []*pb.Value
+		for _, g := range groupBy {
+			for i, name := range projection {
+				if name == g.GetName() {
+					group = append(group, r.vals[nOrders+i])
+				}
+			}
+		}
+		b, _ := proto.Marshal(&pb.Value{ListValue: group})
+		if !seen[string(b)] {
+			seen[string(b)] = true
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+type byOrder struct {
+	results []*result
+	orders  []*pb.PropertyOrder
+}
+
+func (b byOrder) Len() int           { return len(b.results) }
+func (b byOrder) Swap(i, j int)      { b.results[i], b.results[j] = b.results[j], b.results[i] }
+func (b byOrder) Less(i, j int) bool { return compareResults(b.results[i], b.results[j], b.orders) < 0 }
+
+// compareResults compares results by the sort orders, then by key,
+// then by any projected values.
+func compareResults(a, b *result, orders []*pb.PropertyOrder) int {
+	for i, o := range orders {
+		c := compareValues(a.vals[i], b.vals[i])
+		if o.GetDirection() == pb.PropertyOrder_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if c := compareKeys(a.e.Key, b.e.Key); c != 0 {
+		return c
+	}
+	for i := len(orders); i < len(a.vals) && i < len(b.vals); i++ {
+		if c := compareValues(a.vals[i], b.vals[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// encodeCursor returns a cursor for the position just after a result.
+func encodeCursor(r *result) []byte {
+	v := &pb.Value{ListValue: append([]*pb.Value{{KeyValue: r.e.Key}}, r.vals...)}
+	b, err := proto.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// decodeCursor returns the result whose position a cursor holds.
+func decodeCursor(b []byte, nVals int) (*result, error) {
+	v := new(pb.Value)
+	if err := proto.Unmarshal(b, v); err != nil || len(v.ListValue) != nVals+1 || v.ListValue[0].KeyValue == nil {
+		return nil, badRequest("invalid cursor")
+	}
+	return &result{e: &pb.Entity{Key: v.ListValue[0].KeyValue}, vals: v.ListValue[1:]}, nil
+}
+
+// typeRank returns the position of a value's type in the order of values.
+// Integers and timestamps are compared with each other, as are strings and blobs.
+func typeRank(v *pb.Value) int {
+	switch {
+	case v.IntegerValue != nil, v.TimestampMicrosecondsValue != nil:
+		return 1
+	case v.BooleanValue != nil:
+		return 2
+	case v.StringValue != nil, v.BlobValue != nil, v.BlobKeyValue != nil:
+		return 3
+	case v.DoubleValue != nil:
+		return 4
+	case v.KeyValue != nil:
+		return 5
+	}
+	return 0 // null
+}
+
+// compareValues compares two indexed values, in the order the datastore uses.
+func compareValues(a, b *pb.Value) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch ra {
+	case 1:
+		return compareInts(intValue(a), intValue(b))
+	case 2:
+		switch {
+		case a.GetBooleanValue() == b.GetBooleanValue():
+			return 0
+		case b.GetBooleanValue():
+			return -1
+		}
+		return 1
+	case 3:
+		return bytes.Compare(bytesValue(a), bytesValue(b))
+	case 4:
+		x, y := a.GetDoubleValue(), b.GetDoubleValue()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case 5:
+		return compareKeys(a.KeyValue, b.KeyValue)
+	}
+	return 0
+}
+
+func intValue(v *pb.Value) int64 {
+	if v.IntegerValue != nil {
+		return v.GetIntegerValue()
+	}
+	return v.GetTimestampMicrosecondsValue()
+}
+
+func bytesValue(v *pb.Value) []byte {
+	switch {
+	case v.StringValue != nil:
+		return []byte(v.GetStringValue())
+	case v.BlobKeyValue != nil:
+		return []byte(v.GetBlobKeyValue())
+	}
+	return v.BlobValue
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareKeys compares keys by namespace, then path. Within a path element,
+// IDs sort before names, and ancestors sort before their descendants.
+func compareKeys(a, b *pb.Key) int {
+	if c := compareStrings(a.GetPartitionId().GetNamespace(), b.GetPartitionId().GetNamespace()); c != 0 {
+		return c
+	}
+	for i := 0; i < len(a.PathElement) && i < len(b.PathElement); i++ {
+		x, y := a.PathElement[i], b.PathElement[i]
+		if c := compareStrings(x.GetKind(), y.GetKind()); c != 0 {
+			return c
+		}
+		switch {
+		case x.Id != nil && y.Id != nil:
+			if c := compareInts(x.GetId(), y.GetId()); c != 0 {
+				return c
+			}
+		case x.Id != nil:
+			return -1
+		case y.Id != nil:
+			return 1
+		default:
+			if c := compareStrings(x.GetName(), y.GetName()); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(int64(len(a.PathElement)), int64(len(b.PathElement)))
+}
+
+// hasAncestor reports whether a key is, or is a descendant of, an ancestor key.
+func hasAncestor(k, ancestor *pb.Key) bool {
+	if len(k.PathElement) < len(ancestor.PathElement) {
+		return false
+	}
+	trimmed := &pb.Key{PartitionId: k.PartitionId, PathElement: k.PathElement[:len(ancestor.PathElement)]}
+	return compareKeys(trimmed, ancestor) == 0
+}
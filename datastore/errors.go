@@ -17,7 +17,9 @@
 package datastore
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 )
 
 // MultiError is returned by batch operations when there are errors with
@@ -45,3 +47,82 @@ func (m MultiError) Error() string {
 	}
 	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
 }
+
+// Error is returned when the datastore responds to a request with an error.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Reason is the canonical reason for the error, such as "NOT_FOUND" or
+	// "ABORTED", or "" if the response did not give one.
+	Reason string
+	// Message describes the error.
+	Message string
+	// Body is the body of the response.
+	Body string
+
+	err error // the error reading Body, if any
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.err != nil:
+		return e.err.Error()
+	case e.Reason != "":
+		return fmt.Sprintf("datastore: %s (http status code %d): %s", e.Reason, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("error during call, http status code: %v %s", e.StatusCode, e.Body)
+}
+
+// newError returns the error for a response with the given status code and
+// body, which is parsed if it is in the JSON format used by Google APIs.
+func newError(code int, body []byte, err error) *Error {
+	e := &Error{StatusCode: code, err: err}
+	if err != nil {
+		return e
+	}
+	e.Body = string(body)
+	var v struct {
+		Error struct {
+			Message string
+			Errors  []struct {
+				Reason  string
+				Message string
+			}
+		}
+	}
+	if json.Unmarshal(body, &v) == nil {
+		e.Message = v.Error.Message
+		if len(v.Error.Errors) > 0 {
+			e.Reason = v.Error.Errors[0].Reason
+			if e.Message == "" {
+				e.Message = v.Error.Errors[0].Message
+			}
+		}
+	}
+	return e
+}
+
+// IsNotFound reports whether err says that an entity, or whatever else a
+// request named, does not exist.
+func IsNotFound(err error) bool {
+	if err == ErrNoSuchEntity {
+		return true
+	}
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsContention reports whether err says that a request failed because it
+// conflicted with a concurrent one, and may succeed if tried again: it is
+// ErrConcurrentTransaction, or an HTTP 409 Conflict, as returned by a read in
+// a transaction that lost the contention for an entity.
+//
+// An insert of an entity that already exists also fails with a 409, but
+// Insert, and Commit of a transaction, return ErrAlreadyExists for it instead.
+func IsContention(err error) bool {
+	if err == ErrConcurrentTransaction {
+		return true
+	}
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusConflict
+}
@@ -216,3 +216,59 @@ func ExampleTransaction() {
 	}
 
 }
+
+func ExampleRunInTransaction() {
+	ctx := Example_auth()
+
+	// Increment a counter, retrying if another transaction changes it first.
+	type Counter struct {
+		Count int
+	}
+
+	key := datastore.NewKey(ctx, "counter", "CounterA", 0, nil)
+
+	_, err := datastore.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var c Counter
+		if err := tx.Get(key, &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		c.Count++
+		_, err := tx.Put(key, &c)
+		return err
+	}, datastore.MaxAttempts(5))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func ExampleRunSplits() {
+	ctx := Example_auth()
+
+	type Article struct {
+		Text string
+	}
+
+	// Read every Article in 8 parallel parts.
+	q := datastore.NewQuery("Article")
+	points, err := q.SplitPoints(ctx, 8)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = datastore.RunSplits(ctx, q.SplitAt(points), func(i int, it *datastore.Iterator) error {
+		for {
+			var a Article
+			_, err := it.Next(&a)
+			if err == datastore.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// Process a. To resume after a crash, save i and it.Cursor()
+			// along with the split points.
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// A Filter is a condition on query results, built with functions such as Eq,
+// Gt, And and Or, and added to a query with Query.Where.
+//
+// Filters made with Or and In cannot be sent to the datastore. Queries using
+// them run one query for each alternative, concurrently, and merge the
+// results, removing duplicates and keeping the query's sort orders.
+type Filter interface {
+	// dnf returns the filter in disjunctive normal form: a list of
+	// alternatives, each of which is a list of filters to AND together.
+	dnf() ([][]filter, error)
+}
+
+func (f filter) dnf() ([][]filter, error) {
+	if f.FieldName == "" {
+		return nil, errors.New("datastore: empty filter property name")
+	}
+	return [][]filter{{f}}, nil
+}
+
+// Eq returns a filter matching entities whose property name equals value.
+func Eq(name string, value interface{}) Filter { return filter{name, equal, value} }
+
+// Lt returns a filter matching entities whose property name is less than value.
+func Lt(name string, value interface{}) Filter { return filter{name, lessThan, value} }
+
+// Le returns a filter matching entities whose property name is less than or
+// equal to value.
+func Le(name string, value interface{}) Filter { return filter{name, lessEq, value} }
+
+// Gt returns a filter matching entities whose property name is greater than
+// value.
+func Gt(name string, value interface{}) Filter { return filter{name, greaterThan, value} }
+
+// Ge returns a filter matching entities whose property name is greater than or
+// equal to value.
+func Ge(name string, value interface{}) Filter { return filter{name, greaterEq, value} }
+
+// KeyRange returns a filter matching entities whose keys are at least start
+// and less than end. A nil start or end leaves that end of the range open.
+func KeyRange(start, end *Key) Filter {
+	var fs []Filter
+	if start != nil {
+		fs = append(fs, Ge(keyFieldName, start))
+	}
+	if end != nil {
+		fs = append(fs, Lt(keyFieldName, end))
+	}
+	return And(fs...)
+}
+
+type and []Filter
+
+// And returns a filter matching entities that match every one of filters.
+func And(filters ...Filter) Filter { return and(filters) }
+
+func (a and) dnf() ([][]filter, error) {
+	d := [][]filter{nil}
+	for _, f := range a {
+		fd, err := f.dnf()
+		if err != nil {
+			return nil, err
+		}
+		var next [][]filter
+		for _, x := range d {
+			for _, y := range fd {
+				next = append(next, append(append([]filter(nil), x...), y...))
+			}
+		}
+		d = next
+	}
+	return d, nil
+}
+
+type or []Filter
+
+// Or returns a filter matching entities that match any of filters.
+// It is evaluated by the client, as described for Filter.
+func Or(filters ...Filter) Filter { return or(filters) }
+
+func (o or) dnf() ([][]filter, error) {
+	if len(o) == 0 {
+		return nil, errors.New("datastore: Or or In filter with no alternatives")
+	}
+	var d [][]filter
+	for _, f := range o {
+		fd, err := f.dnf()
+		if err != nil {
+			return nil, err
+		}
+		d = append(d, fd...)
+	}
+	return d, nil
+}
+
+// In returns a filter matching entities whose property name equals any of
+// values. It is evaluated by the client, as described for Filter.
+func In(name string, values ...interface{}) Filter {
+	o := make(or, len(values))
+	for i, v := range values {
+		o[i] = Eq(name, v)
+	}
+	return o
+}
+
+// runMerged runs a query with Or or In filters as one query for each
+// alternative, and returns an iterator over the merged results.
+func (c *Client) runMerged(ctx context.Context, q *Query) *Iterator {
+	t := &Iterator{client: c, ctx: ctx, q: q, merged: true}
+	if q.start != nil || q.end != nil {
+		t.err = errors.New("datastore: cursors cannot be used with Or or In filters")
+		return t
+	}
+	// Each query must return enough results to fill the offset and limit
+	// once they are merged.
+	limit := int64(-1)
+	if q.limit >= 0 {
+		limit = int64(q.offset) + int64(q.limit)
+		if limit > math.MaxInt32 {
+			limit = math.MaxInt32
+		}
+	}
+	type result struct {
+		i   int
+		es  []*pb.Entity
+		err error
+	}
+	rc := make(chan result, len(q.or))
+	for i, alt := range q.or {
+		sub := q.clone()
+		sub.or = nil
+		sub.filter = append(sub.filter, alt...)
+		sub.offset, sub.limit = 0, int32(limit)
+		if limit < 0 {
+			// The results are sorted once merged, so without a limit the
+			// queries need no sort orders, nor the indexes they use.
+			sub.order = nil
+		}
+		go func(i int, sub *Query) {
+			var es []*pb.Entity
+			it := c.run(ctx, sub)
+			for {
+				_, e, err := it.next()
+				if err == Done {
+					break
+				}
+				if err != nil {
+					rc <- result{i, nil, err}
+					return
+				}
+				es = append(es, e)
+			}
+			rc <- result{i, es, nil}
+		}(i, sub)
+	}
+	all := make([][]*pb.Entity, len(q.or))
+	for range q.or {
+		r := <-rc
+		if r.err != nil && t.err == nil {
+			t.err = r.err
+		}
+		all[r.i] = r.es
+	}
+	if t.err != nil {
+		return t
+	}
+
+	// Remove duplicates. Projection queries may return an entity more than
+	// once, with different values, so those are compared in full.
+	seen := make(map[string]bool)
+	for _, es := range all {
+		for _, e := range es {
+			var id []byte
+			if len(q.projection) > 0 {
+				id, _ = proto.Marshal(e)
+			} else {
+				id, _ = proto.Marshal(e.Key)
+			}
+			if !seen[string(id)] {
+				seen[string(id)] = true
+				t.results = append(t.results, e)
+			}
+		}
+	}
+	sort.Stable(byOrder{t.results, q.order})
+
+	if int(q.offset) >= len(t.results) {
+		t.results = nil
+	} else {
+		t.results = t.results[q.offset:]
+	}
+	if q.limit >= 0 && int(q.limit) < len(t.results) {
+		t.results = t.results[:q.limit]
+	}
+	return t
+}
+
+// byOrder sorts entities as the datastore would for a query's sort orders,
+// breaking ties by key.
+type byOrder struct {
+	es     []*pb.Entity
+	orders []order
+}
+
+func (b byOrder) Len() int      { return len(b.es) }
+func (b byOrder) Swap(i, j int) { b.es[i], b.es[j] = b.es[j], b.es[i] }
+
+func (b byOrder) Less(i, j int) bool {
+	for _, o := range b.orders {
+		c := compareValues(orderValue(b.es[i], o), orderValue(b.es[j], o))
+		if o.Direction == descending {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return compareKeys(b.es[i].Key, b.es[j].Key) < 0
+}
+
+// orderValue returns the value of e that a sort order applies to. For a
+// multiple-valued property, that is the smallest value of an ascending order,
+// and the largest value of a descending one.
+func orderValue(e *pb.Entity, o order) *pb.Value {
+	if o.FieldName == keyFieldName {
+		return &pb.Value{KeyValue: e.Key}
+	}
+	for _, p := range e.Property {
+		if p.GetName() != o.FieldName {
+			continue
+		}
+		if len(p.Value.ListValue) == 0 {
+			return p.Value
+		}
+		v := p.Value.ListValue[0]
+		for _, x := range p.Value.ListValue[1:] {
+			c := compareValues(x, v)
+			if (o.Direction == ascending && c < 0) || (o.Direction == descending && c > 0) {
+				v = x
+			}
+		}
+		return v
+	}
+	return nil
+}
+
+// typeRank orders the types of values, as the datastore does when values of
+// different types are compared.
+func typeRank(v *pb.Value) int {
+	switch {
+	case v == nil:
+		return 0
+	case v.IntegerValue != nil, v.TimestampMicrosecondsValue != nil:
+		return 1
+	case v.BooleanValue != nil:
+		return 2
+	case v.StringValue != nil, v.BlobValue != nil, v.BlobKeyValue != nil:
+		return 3
+	case v.DoubleValue != nil:
+		return 4
+	case v.KeyValue != nil:
+		return 5
+	}
+	return 0
+}
+
+func compareValues(a, b *pb.Value) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch ra {
+	case 1:
+		return compareInts(a.GetIntegerValue()+a.GetTimestampMicrosecondsValue(),
+			b.GetIntegerValue()+b.GetTimestampMicrosecondsValue())
+	case 2:
+		if a.GetBooleanValue() == b.GetBooleanValue() {
+			return 0
+		}
+		if b.GetBooleanValue() {
+			return -1
+		}
+		return 1
+	case 3:
+		return bytes.Compare(byteValue(a), byteValue(b))
+	case 4:
+		x, y := a.GetDoubleValue(), b.GetDoubleValue()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case 5:
+		return compareKeys(a.KeyValue, b.KeyValue)
+	}
+	return 0
+}
+
+func byteValue(v *pb.Value) []byte {
+	switch {
+	case v.StringValue != nil:
+		return []byte(*v.StringValue)
+	case v.BlobKeyValue != nil:
+		return []byte(*v.BlobKeyValue)
+	}
+	return v.BlobValue
+}
+
+// compareKeys orders keys by namespace, then path. Path elements are ordered
+// by kind, then ID or name, with IDs before names.
+func compareKeys(a, b *pb.Key) int {
+	if c := compareStrings(a.GetPartitionId().GetNamespace(), b.GetPartitionId().GetNamespace()); c != 0 {
+		return c
+	}
+	ea, eb := a.GetPathElement(), b.GetPathElement()
+	for i := 0; i < len(ea) && i < len(eb); i++ {
+		x, y := ea[i], eb[i]
+		if c := compareStrings(x.GetKind(), y.GetKind()); c != 0 {
+			return c
+		}
+		switch {
+		case x.Name == nil && y.Name != nil:
+			return -1
+		case x.Name != nil && y.Name == nil:
+			return 1
+		case x.Name != nil:
+			if c := compareStrings(x.GetName(), y.GetName()); c != 0 {
+				return c
+			}
+		default:
+			if c := compareInts(x.GetId(), y.GetId()); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(int64(len(ea)), int64(len(eb)))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// A GQLArg binds a named binding site in a GQL query, such as @since, to a
+// value.
+type GQLArg struct {
+	Name  string
+	Value interface{}
+}
+
+// NewGQLQuery creates a new Query from a GQL query string, which may contain
+// literals. Arguments of type GQLArg bind named binding sites, such as
+// @since, and the other arguments bind the numbered binding sites @1, @2 and
+// so on, in order.
+//
+// An argument's value may be of any type valid for a Property's Value, or a
+// Cursor. For example:
+//
+//	q := datastore.NewGQLQuery("SELECT * FROM Post WHERE Author = @1 AND PublishedAt > @since",
+//		"gopher", datastore.GQLArg{Name: "since", Value: yesterday})
+//
+// The query is defined by the GQL, so the Query methods that add constraints,
+// such as Filter, Order and Limit, cannot be used with it; Transaction can.
+// The datastore cannot continue a GQL query from
+// one batch of results to the next, so iterating past the first batch
+// returns an error. Use a cursor argument in the query's OFFSET clause,
+// bound to Iterator.Cursor, to fetch the next batch.
+func NewGQLQuery(gql string, args ...interface{}) *Query {
+	q := &Query{
+		limit: -1,
+		gql: &pb.GqlQuery{
+			QueryString:  proto.String(gql),
+			AllowLiteral: proto.Bool(true),
+		},
+	}
+	for i, arg := range args {
+		name := ""
+		if a, ok := arg.(GQLArg); ok {
+			if a.Name == "" {
+				q.err = fmt.Errorf("datastore: GQL argument %d has no name", i+1)
+				return q
+			}
+			name, arg = a.Name, a.Value
+		}
+		qa, err := gqlArg(arg)
+		if err != nil {
+			q.err = fmt.Errorf("datastore: bad GQL argument %d: %v", i+1, err)
+			return q
+		}
+		if name != "" {
+			qa.Name = proto.String(name)
+			q.gql.NameArg = append(q.gql.NameArg, qa)
+		} else {
+			q.gql.NumberArg = append(q.gql.NumberArg, qa)
+		}
+	}
+	return q
+}
+
+func gqlArg(v interface{}) (*pb.GqlQueryArg, error) {
+	if c, ok := v.(Cursor); ok {
+		if c.cc == nil {
+			// The zero Cursor is the start of the results.
+			return &pb.GqlQueryArg{Cursor: []byte{}}, nil
+		}
+		return &pb.GqlQueryArg{Cursor: c.cc}, nil
+	}
+	val, errStr := interfaceToProto(v)
+	if errStr != "" {
+		return nil, errors.New(errStr)
+	}
+	return &pb.GqlQueryArg{Value: val}, nil
+}
+
+// gqlToProto sets req to run q, a GQL query.
+func (q *Query) gqlToProto(req *pb.RunQueryRequest) error {
+	if q.kind != "" || q.ancestor != nil || len(q.filter) > 0 || q.or != nil || len(q.order) > 0 ||
+		len(q.projection) > 0 || q.distinct || q.keysOnly || q.limit >= 0 || q.offset != 0 ||
+		q.start != nil || q.end != nil || q.typ != nil {
+		return errors.New("datastore: GQL queries cannot be further constrained by Query methods")
+	}
+	req.GqlQuery = q.gql
+	return nil
+}
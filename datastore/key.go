@@ -251,25 +251,25 @@ func NewIncompleteKey(ctx context.Context, kind string, parent *Key) *Key {
 // the key returned is incomplete.
 // parent must either be a complete key or nil.
 func NewKey(ctx context.Context, kind, name string, id int64, parent *Key) *Key {
-	return &Key{
-		kind:      kind,
-		name:      name,
-		id:        id,
-		parent:    parent,
-		namespace: ctxNamespace(ctx),
-	}
+	// Making a key needs no project or HTTP client, so ctx need not be made
+	// by cloud.NewContext, and a Client with no configuration will do.
+	return (&Client{}).NewKey(ctx, kind, name, id, parent)
 }
 
 // AllocateIDs accepts a slice of incomplete keys and returns a
 // slice of complete keys that are guaranteed to be valid in the datastore
 func AllocateIDs(ctx context.Context, keys []*Key) ([]*Key, error) {
+	return clientFromContext(ctx).AllocateIDs(ctx, keys)
+}
+
+func (c *Client) allocateIDs(ctx context.Context, keys []*Key) ([]*Key, error) {
 	if keys == nil {
 		return nil, nil
 	}
 
 	req := &pb.AllocateIdsRequest{Key: multiKeyToProto(keys)}
 	res := &pb.AllocateIdsResponse{}
-	if err := call(ctx, "allocateIds", req, res); err != nil {
+	if err := c.call(ctx, "allocateIds", req, res); err != nil {
 		return nil, err
 	}
 
@@ -15,6 +15,7 @@
 package datastore
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"time"
@@ -46,6 +47,8 @@ func typeMismatchReason(p Property, v reflect.Value) string {
 		entityType = "time.Time"
 	case []byte:
 		entityType = "[]byte"
+	case *Entity:
+		entityType = "*datastore.Entity"
 	}
 
 	return fmt.Sprintf("type mismatch: %s versus %v", entityType, v.Type())
@@ -60,6 +63,7 @@ type propertyLoader struct {
 func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p Property, prev map[string]struct{}) string {
 	var sliceOk bool
 	var v reflect.Value
+	var tag structTag
 	// Traverse a struct's struct-typed fields.
 	for name := p.Name; ; {
 		decoder, ok := codec.byName[name]
@@ -74,6 +78,7 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 			return "cannot set struct field"
 		}
 
+		tag = codec.byIndex[decoder.index]
 		if decoder.substructCodec == nil {
 			break
 		}
@@ -91,6 +96,13 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 			sliceOk = true
 		} else {
 			structValue = v
+			if v.Kind() == reflect.Ptr {
+				// A struct pointer with the "flatten" option.
+				if v.IsNil() {
+					v.Set(reflect.New(v.Type().Elem()))
+				}
+				structValue = v.Elem()
+			}
 		}
 		// Strip the "I." from "I.X".
 		name = name[len(codec.byIndex[decoder.index].name):]
@@ -98,7 +110,7 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 	}
 
 	var slice reflect.Value
-	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 && !tag.json && !isValueMarshaler(v.Type()) {
 		slice = v
 		v = reflect.New(v.Type().Elem()).Elem()
 	} else if _, ok := prev[p.Name]; ok && !sliceOk {
@@ -110,6 +122,25 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 
 	prev[p.Name] = struct{}{}
 
+	if tag.json {
+		return loadJSONValue(v, p)
+	}
+	if tag.entity || isValueMarshaler(v.Type()) {
+		var errStr string
+		if tag.entity {
+			errStr = loadEntityValue(v, p)
+		} else {
+			errStr = loadMarshaledValue(v, p)
+		}
+		if errStr != "" {
+			return errStr
+		}
+		if slice.IsValid() {
+			slice.Set(reflect.Append(slice, v))
+		}
+		return ""
+	}
+
 	pValue := p.Value
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -180,13 +211,140 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 	return ""
 }
 
+// loadJSONValue loads a field with the "json" option from the JSON encoding
+// in p.
+func loadJSONValue(v reflect.Value, p Property) string {
+	v.Set(reflect.Zero(v.Type()))
+	if p.Value == nil {
+		return ""
+	}
+	b, ok := p.Value.([]byte)
+	if !ok {
+		return typeMismatchReason(p, v)
+	}
+	if err := json.Unmarshal(b, v.Addr().Interface()); err != nil {
+		return fmt.Sprintf("cannot decode JSON: %v", err)
+	}
+	return ""
+}
+
+// loadMarshaledValue loads p into v, whose type or pointer type implements
+// PropertyValueUnmarshaler.
+func loadMarshaledValue(v reflect.Value, p Property) string {
+	if v.Kind() == reflect.Ptr && v.Type().Implements(typeOfValueUnmarshaler) {
+		if p.Value == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return ""
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+	} else {
+		v = v.Addr()
+	}
+	u, ok := v.Interface().(PropertyValueUnmarshaler)
+	if !ok {
+		return fmt.Sprintf("%v does not implement PropertyValueUnmarshaler", v.Type().Elem())
+	}
+	if err := u.UnmarshalPropertyValue(p.Value); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// loadEntityValue loads an embedded entity into v, a struct, struct pointer
+// or map[string]interface{}.
+func loadEntityValue(v reflect.Value, p Property) string {
+	if p.Value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return ""
+	}
+	e, ok := p.Value.(*Entity)
+	if !ok {
+		return typeMismatchReason(p, v)
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		v.Set(reflect.ValueOf(entityToMap(e)))
+		return ""
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	codec, err := getStructCodec(v.Type())
+	if err != nil {
+		return err.Error()
+	}
+	if err := (structPLS{v, codec}).Load(e.Properties); err != nil {
+		if fm, ok := err.(*ErrFieldMismatch); ok {
+			return fmt.Sprintf("field %q: %s", fm.FieldName, fm.Reason)
+		}
+		return err.Error()
+	}
+	return ""
+}
+
+// entityToMap converts an embedded entity to a map. Nested embedded entities
+// become nested maps, and multiple-valued properties become []interface{}.
+func entityToMap(e *Entity) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, p := range e.Properties {
+		val := p.Value
+		if sub, ok := val.(*Entity); ok {
+			val = entityToMap(sub)
+		}
+		if p.Multiple {
+			s, _ := m[p.Name].([]interface{})
+			m[p.Name] = append(s, val)
+		} else {
+			m[p.Name] = val
+		}
+	}
+	return m
+}
+
+// flattenEntities replaces each embedded entity value that has no field of
+// its own in codec with its properties, named as if the entity had been saved
+// as a flattened nested struct. This lets entities with embedded values, such
+// as those written by other clients, load into structs without the "entity"
+// option.
+func flattenEntities(codec *structCodec, props []Property) []Property {
+	out := make([]Property, 0, len(props))
+	for _, p := range props {
+		e, ok := p.Value.(*Entity)
+		if _, isField := codec.byName[p.Name]; !ok || isField {
+			out = append(out, p)
+			continue
+		}
+		sub := make([]Property, 0, len(e.Properties))
+		for _, q := range e.Properties {
+			q.Name = p.Name + "." + q.Name
+			q.Multiple = q.Multiple || p.Multiple
+			sub = append(sub, q)
+		}
+		out = append(out, flattenEntities(codec, sub)...)
+	}
+	return out
+}
+
 // loadEntity loads an EntityProto into PropertyLoadSaver or struct pointer.
 func loadEntity(dst interface{}, src *pb.Entity) (err error) {
 	props := protoToProperties(src)
 	if e, ok := dst.(PropertyLoadSaver); ok {
 		return e.Load(props)
 	}
-	return LoadStruct(dst, props)
+	err = LoadStruct(dst, props)
+	if _, ok := err.(*ErrFieldMismatch); err != nil && !ok {
+		return err
+	}
+	if a, ok := dst.(AfterLoader); ok {
+		if aerr := a.AfterLoad(); aerr != nil {
+			return aerr
+		}
+	}
+	return err
 }
 
 func (s structPLS) Load(props []Property) error {
@@ -194,7 +352,7 @@ func (s structPLS) Load(props []Property) error {
 	var l propertyLoader
 
 	prev := make(map[string]struct{})
-	for _, p := range props {
+	for _, p := range flattenEntities(s.codec, props) {
 		if errStr := l.load(s.codec, s.v, p, prev); errStr != "" {
 			// We don't return early, as we try to load as many properties as possible.
 			// It is valid to load an entity into a struct that cannot fully represent it.
@@ -251,7 +409,6 @@ func protoToProperties(src *pb.Entity) []Property {
 // propValue returns a Go value that combines the raw PropertyValue with a
 // meaning. For example, an Int64Value with GD_WHEN becomes a time.Time.
 func propValue(v *pb.Value) interface{} {
-	//TODO(PSG-Luna): Support EntityValue
 	//TODO(PSG-Luna): GeoPoint seems gone from the v1 proto, reimplement it once it's readded
 	switch {
 	case v.IntegerValue != nil:
@@ -270,6 +427,12 @@ func propValue(v *pb.Value) interface{} {
 		return *v.DoubleValue
 	case v.KeyValue != nil:
 		return protoToKey(v.KeyValue)
+	case v.EntityValue != nil:
+		e := &Entity{Properties: protoToProperties(v.EntityValue)}
+		if v.EntityValue.Key != nil {
+			e.Key = protoToKey(v.EntityValue.Key)
+		}
+		return e
 	}
 	return nil
 }
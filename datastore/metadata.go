@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import "golang.org/x/net/context"
+
+// The metadata pseudo-kinds, whose entities describe a dataset's namespaces,
+// kinds and properties.
+const (
+	namespaceKind = "__namespace__"
+	kindKind      = "__kind__"
+	propertyKind  = "__property__"
+)
+
+// Namespaces returns the names of the dataset's namespaces. The default
+// namespace is the empty string.
+func Namespaces(ctx context.Context) ([]string, error) {
+	return clientFromContext(ctx).Namespaces(ctx)
+}
+
+func (c *Client) namespaces(ctx context.Context) ([]string, error) {
+	// The default namespace's key has an ID rather than a name, so its
+	// Name is the empty string, as wanted.
+	return c.keyNames(ctx, NewQuery(namespaceKind))
+}
+
+// Kinds returns the names of the kinds in the namespace of ctx.
+func Kinds(ctx context.Context) ([]string, error) {
+	return clientFromContext(ctx).Kinds(ctx)
+}
+
+func (c *Client) kinds(ctx context.Context) ([]string, error) {
+	return c.keyNames(ctx, NewQuery(kindKind))
+}
+
+func (c *Client) keyNames(ctx context.Context, q *Query) ([]string, error) {
+	keys, err := c.getAll(ctx, q.KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name()
+	}
+	return names, nil
+}
+
+// KindProperties returns the indexed properties of the given kind, in the
+// namespace of ctx. The result maps each property name to the names of the
+// representations its values are stored with, such as "STRING" or "INT64".
+// Times are represented as "INT64", and keys as "REFERENCE".
+func KindProperties(ctx context.Context, kind string) (map[string][]string, error) {
+	return clientFromContext(ctx).KindProperties(ctx, kind)
+}
+
+func (c *Client) kindProperties(ctx context.Context, kind string) (map[string][]string, error) {
+	q := NewQuery(propertyKind).Ancestor(c.NewKey(ctx, kindKind, kind, 0, nil))
+	var props []struct {
+		Repr []string `datastore:"property_representation"`
+	}
+	keys, err := c.getAll(ctx, q, &props)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]string, len(keys))
+	for i, k := range keys {
+		m[k.Name()] = props[i].Repr
+	}
+	return m, nil
+}
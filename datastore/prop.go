@@ -43,6 +43,7 @@ type Property struct {
 	//	- *Key
 	//	- time.Time
 	//	- []byte (up to 1 megabyte in length)
+	//	- *Entity (representing a nested struct or map)
 	// This set is smaller than the set of valid struct field types that the
 	// datastore can load and save. A Property Value cannot be a slice (apart
 	// from []byte); use multiple Properties instead. Also, a Value's type
@@ -72,20 +73,76 @@ type Property struct {
 	Multiple bool
 }
 
+// An Entity is the value type for a nested struct or map, stored as an
+// embedded entity rather than flattened into the enclosing entity.
+// This type is only used for a Property's Value.
+type Entity struct {
+	// Key is the embedded entity's key. It is usually nil.
+	Key        *Key
+	Properties []Property
+}
+
 // PropertyLoadSaver can be converted from and to a slice of Properties.
 type PropertyLoadSaver interface {
 	Load([]Property) error
 	Save() ([]Property, error)
 }
 
+// BeforeSaver is implemented by struct pointers that need to prepare or
+// validate themselves before being saved by the default struct codec, for
+// example to fill in a computed field. If BeforeSave returns an error, the
+// entity is not saved. It is not called for a PropertyLoadSaver.
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+// AfterLoader is implemented by struct pointers that need to finish or
+// validate themselves after being loaded by the default struct codec.
+// AfterLoad is called even if loading returned an *ErrFieldMismatch, and
+// an error from AfterLoad takes precedence over that one. It is not called
+// for a PropertyLoadSaver.
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+// PropertyValueMarshaler is implemented by types, such as UUIDs, decimals and
+// enums, that store themselves in a struct field as a single property value
+// of their own choosing. MarshalPropertyValue returns a value of one of the
+// types listed for Property.Value, or nil.
+type PropertyValueMarshaler interface {
+	MarshalPropertyValue() (interface{}, error)
+}
+
+// PropertyValueUnmarshaler is implemented by types that load themselves from a
+// single property value, usually one returned by their MarshalPropertyValue
+// method.
+type PropertyValueUnmarshaler interface {
+	UnmarshalPropertyValue(v interface{}) error
+}
+
 // PropertyList converts a []Property to implement PropertyLoadSaver.
 type PropertyList []Property
 
 var (
 	typeOfPropertyLoadSaver = reflect.TypeOf((*PropertyLoadSaver)(nil)).Elem()
 	typeOfPropertyList      = reflect.TypeOf(PropertyList(nil))
+
+	typeOfValueMarshaler   = reflect.TypeOf((*PropertyValueMarshaler)(nil)).Elem()
+	typeOfValueUnmarshaler = reflect.TypeOf((*PropertyValueUnmarshaler)(nil)).Elem()
 )
 
+// isValueMarshaler returns whether t, or a pointer to t, implements
+// PropertyValueMarshaler or PropertyValueUnmarshaler. Fields of such types
+// are stored as single values, even if they are structs or slices.
+func isValueMarshaler(t reflect.Type) bool {
+	for _, i := range []reflect.Type{typeOfValueMarshaler, typeOfValueUnmarshaler} {
+		if t.Implements(i) || reflect.PtrTo(t).Implements(i) {
+			return true
+		}
+	}
+	return false
+}
+
 // Load loads all of the provided properties into l.
 // It does not first reset *l to an empty slice.
 func (l *PropertyList) Load(p []Property) error {
@@ -129,9 +186,24 @@ func validPropertyName(name string) bool {
 // If a field has no tag, or the tag has an empty name, then the structTag's
 // name is just the field name. A "-" name means that the datastore ignores
 // that field.
+//
+// The options are comma-separated. The "noindex" option means the field is
+// not indexed. The "omitempty" option means the field is not saved if it has
+// its type's zero value, or is an empty slice or map, or a zero time.Time.
+// The "entity" option means a field holding a struct, a struct pointer or a
+// map[string]interface{}, or a slice of them, is stored as embedded entity
+// values rather than flattened into dotted property names. The "flatten"
+// option asks for the dotted property names; that is the default for struct
+// fields, but struct pointer fields need the option, and a nil pointer saves
+// no properties. The "json" option means the field is stored as a single,
+// unindexed []byte value holding its JSON encoding.
 type structTag struct {
-	name    string
-	noIndex bool
+	name      string
+	noIndex   bool
+	omitEmpty bool
+	entity    bool
+	flatten   bool
+	json      bool
 }
 
 // structCodec describes how to convert a struct to and from a sequence of
@@ -197,8 +269,26 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 		if i := strings.Index(name, ","); i != -1 {
 			name, opts = name[:i], name[i+1:]
 		}
+		tag := structTag{}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "noindex":
+				tag.noIndex = true
+			case "omitempty":
+				tag.omitEmpty = true
+			case "entity":
+				tag.entity = true
+			case "flatten":
+				tag.flatten = true
+			case "json":
+				tag.json = true
+			}
+		}
+		if (tag.entity && tag.flatten) || (tag.json && (tag.entity || tag.flatten)) {
+			return nil, fmt.Errorf("datastore: field %q: conflicting struct tag options %q", f.Name, opts)
+		}
 		if name == "" {
-			if !f.Anonymous {
+			if !f.Anonymous || tag.entity || tag.json {
 				name = f.Name
 			}
 		} else if name == "-" {
@@ -208,17 +298,41 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 			return nil, fmt.Errorf("datastore: struct tag has invalid property name: %q", name)
 		}
 
+		if tag.entity || tag.json {
+			if tag.entity {
+				if err := checkEntityField(f.Type); err != nil {
+					return nil, fmt.Errorf("datastore: field %q: %v", f.Name, err)
+				}
+				c.hasSlice = c.hasSlice || f.Type.Kind() == reflect.Slice
+			}
+			if _, ok := c.byName[name]; ok {
+				return nil, fmt.Errorf("datastore: struct tag has repeated property name: %q", name)
+			}
+			c.byName[name] = fieldCodec{index: i}
+			tag.name = name
+			c.byIndex[i] = tag
+			continue
+		}
+
 		substructType, fIsSlice := reflect.Type(nil), false
-		switch f.Type.Kind() {
-		case reflect.Struct:
+		switch {
+		case isValueMarshaler(f.Type):
+		case f.Type.Kind() == reflect.Struct:
 			substructType = f.Type
-		case reflect.Slice:
-			if f.Type.Elem().Kind() == reflect.Struct {
-				substructType = f.Type.Elem()
+		case f.Type.Kind() == reflect.Ptr && tag.flatten:
+			if e := f.Type.Elem(); e.Kind() == reflect.Struct && e != typeOfTime && !isValueMarshaler(e) {
+				substructType = e
+			}
+		case f.Type.Kind() == reflect.Slice:
+			if e := f.Type.Elem(); e.Kind() == reflect.Struct && !isValueMarshaler(e) {
+				substructType = e
 			}
 			fIsSlice = f.Type != typeOfByteSlice
 			c.hasSlice = c.hasSlice || fIsSlice
 		}
+		if tag.flatten && (substructType == nil || substructType == typeOfTime) {
+			return nil, fmt.Errorf("datastore: field %q: flatten option requires a struct, struct pointer or struct slice type, not %v", f.Name, f.Type)
+		}
 
 		if substructType != nil && substructType != typeOfTime {
 			if name != "" {
@@ -250,15 +364,35 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 			c.byName[name] = fieldCodec{index: i}
 		}
 
-		c.byIndex[i] = structTag{
-			name:    name,
-			noIndex: opts == "noindex",
-		}
+		tag.name = name
+		c.byIndex[i] = tag
 	}
 	c.complete = true
 	return c, nil
 }
 
+var typeOfEntityMap = reflect.TypeOf(map[string]interface{}(nil))
+
+// checkEntityField returns an error if a field of type t cannot be stored as
+// embedded entities. The field's struct types need not have complete codecs
+// yet, so a struct may contain itself by way of an embedded entity.
+func checkEntityField(t reflect.Type) error {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == typeOfEntityMap:
+		return nil
+	case t.Kind() == reflect.Struct && t != typeOfTime:
+		_, err := getStructCodecLocked(t)
+		return err
+	}
+	return fmt.Errorf("entity option requires a struct, struct pointer or map[string]interface{} type, not %v", t)
+}
+
 // structPLS adapts a struct to be a PropertyLoadSaver.
 type structPLS struct {
 	v     reflect.Value
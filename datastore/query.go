@@ -90,8 +90,11 @@ type Query struct {
 	kind       string
 	ancestor   *Key
 	filter     []filter
+	or         [][]filter // alternatives from Or and In filters, each AND'ed with filter
 	order      []order
 	projection []string
+	typ        reflect.Type // if non-nil, the struct type property names must belong to
+	gql        *pb.GqlQuery // if non-nil, the query is defined by GQL rather than the fields above
 
 	distinct bool
 	keysOnly bool
@@ -197,6 +200,83 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	return q
 }
 
+// Where returns a derivative query with the filter f added. Filters are
+// AND'ed together, along with those added by Query.Filter.
+func (q *Query) Where(f Filter) *Query {
+	q = q.clone()
+	d, err := f.dnf()
+	if err != nil {
+		q.err = err
+		return q
+	}
+	if len(d) == 1 {
+		q.filter = append(q.filter, d[0]...)
+		return q
+	}
+	if q.or == nil {
+		q.or = d
+		return q
+	}
+	var or [][]filter
+	for _, x := range q.or {
+		for _, y := range d {
+			or = append(or, append(append([]filter(nil), x...), y...))
+		}
+	}
+	q.or = or
+	return q
+}
+
+// Typed returns a derivative query whose filters, sort orders and
+// projections, including those added later, may only name "__key__" or the
+// properties of the struct type of src, which must be a struct or struct
+// pointer. Running a query that names any other property returns an error,
+// so that a misspelled name is reported instead of matching no entities.
+func (q *Query) Typed(src interface{}) *Query {
+	q = q.clone()
+	t := reflect.TypeOf(src)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		q.err = ErrInvalidEntityType
+		return q
+	}
+	if _, err := getStructCodec(t); err != nil {
+		q.err = err
+		return q
+	}
+	q.typ = t
+	return q
+}
+
+// checkName returns an error if q is typed, and name is not "__key__" or
+// one of the type's properties.
+func (q *Query) checkName(name string) error {
+	if q.typ == nil || name == keyFieldName {
+		return nil
+	}
+	codec, err := getStructCodec(q.typ)
+	if err != nil {
+		return err
+	}
+	// Properties of embedded entities are named by the entity's field.
+	for n := name; ; {
+		if _, ok := codec.byName[n]; ok {
+			return nil
+		}
+		i := strings.LastIndex(n, ".")
+		if i < 0 {
+			break
+		}
+		n = n[:i]
+		if fc, ok := codec.byName[n]; ok && codec.byIndex[fc.index].entity {
+			return nil
+		}
+	}
+	return fmt.Errorf("datastore: %v has no property %q", q.typ, name)
+}
+
 // Order returns a derivative query with a field-based sort order. Orders are
 // applied in the order they are added. The default order is ascending; to sort
 // in descending order prefix the fieldName with a minus sign (-).
@@ -314,6 +394,16 @@ func (q *Query) End(c Cursor) *Query {
 
 // toProto converts the query to a protocol buffer.
 func (q *Query) toProto(req *pb.RunQueryRequest) error {
+	if t := q.trans; t != nil {
+		if t.id == nil {
+			return errExpiredTransaction
+		}
+		req.ReadOptions = &pb.ReadOptions{Transaction: t.id}
+	}
+	if q.gql != nil {
+		return q.gqlToProto(req)
+	}
+
 	dst := pb.Query{}
 	if len(q.projection) != 0 && q.keysOnly {
 		return errors.New("datastore: query cannot both project and be keys-only")
@@ -322,8 +412,14 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 	if q.kind != "" {
 		dst.Kind = []*pb.KindExpression{&pb.KindExpression{Name: proto.String(q.kind)}}
 	}
+	if q.or != nil {
+		return errors.New("datastore: internal error: query with Or or In filters sent to the datastore")
+	}
 	if q.projection != nil {
 		for _, propertyName := range q.projection {
+			if err := q.checkName(propertyName); err != nil {
+				return err
+			}
 			dst.Projection = append(dst.Projection, &pb.PropertyExpression{Property: &pb.PropertyReference{Name: proto.String(propertyName)}})
 		}
 
@@ -342,6 +438,9 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 		if qf.FieldName == "" {
 			return errors.New("datastore: empty query filter field name")
 		}
+		if err := q.checkName(qf.FieldName); err != nil {
+			return err
+		}
 		v, errStr := interfaceToProto(reflect.ValueOf(qf.Value).Interface())
 		if errStr != "" {
 			return errors.New("datastore: bad query filter value type: " + errStr)
@@ -379,6 +478,9 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 		if qo.FieldName == "" {
 			return errors.New("datastore: empty query order field name")
 		}
+		if err := q.checkName(qo.FieldName); err != nil {
+			return err
+		}
 		xo := &pb.PropertyOrder{
 			Property:  &pb.PropertyReference{Name: proto.String(qo.FieldName)},
 			Direction: sortDirectionToProto[qo.Direction],
@@ -397,19 +499,16 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 	dst.StartCursor = q.start
 	dst.EndCursor = q.end
 
-	if t := q.trans; t != nil {
-		if t.id == nil {
-			return errExpiredTransaction
-		}
-		req.ReadOptions = &pb.ReadOptions{Transaction: t.id}
-	}
-
 	req.Query = &dst
 	return nil
 }
 
 // Count returns the number of results for the query.
 func (q *Query) Count(ctx context.Context) (int, error) {
+	return clientFromContext(ctx).Count(ctx, q)
+}
+
+func (c *Client) count(ctx context.Context, q *Query) (int, error) {
 	// Check that the query is well-formed.
 	if q.err != nil {
 		return 0, q.err
@@ -418,14 +517,21 @@ func (q *Query) Count(ctx context.Context) (int, error) {
 	// Run a copy of the query, with keysOnly true (if we're not a projection,
 	// since the two are incompatible).
 	newQ := q.clone()
-	newQ.keysOnly = len(newQ.projection) == 0
+	newQ.keysOnly = len(newQ.projection) == 0 && newQ.gql == nil
+	if newQ.or != nil {
+		// The results of queries with Or or In filters are merged by the
+		// client, so count the merged results.
+		t := c.runMerged(ctx, newQ)
+		return len(t.results), t.err
+	}
 	req := &pb.RunQueryRequest{}
 
 	if err := newQ.toProto(req); err != nil {
 		return 0, err
 	}
+	c.setNamespace(ctx, req)
 	res := &pb.RunQueryResponse{}
-	if err := call(ctx, "runQuery", req, res); err != nil {
+	if err := c.call(ctx, "runQuery", req, res); err != nil {
 		return 0, err
 	}
 	var n int
@@ -435,16 +541,32 @@ func (q *Query) Count(ctx context.Context) (int, error) {
 		if b.GetMoreResults() != pb.QueryResultBatch_NOT_FINISHED {
 			break
 		}
+		if q.gql != nil {
+			return 0, errGQLNextBatch
+		}
 		var err error
 		// TODO(jbd): Support count queries that have a limit and an offset.
-		if err = callNext(ctx, req, res, 0, 0); err != nil {
+		if err = c.callNext(ctx, req, res, 0, 0); err != nil {
 			return 0, err
 		}
 	}
 	return int(n), nil
 }
 
-func callNext(ctx context.Context, req *pb.RunQueryRequest, res *pb.RunQueryResponse, offset, limit int32) error {
+// errGQLNextBatch is returned when a GQL query's results do not fit in a
+// single batch, as the datastore cannot continue GQL queries.
+var errGQLNextBatch = errors.New("datastore: GQL query has more than one batch of results; use a cursor argument to fetch the next batch")
+
+// setNamespace sets the namespace of a query request to that of the keys the
+// client makes with ctx, so that queries without an ancestor are limited to
+// it too.
+func (c *Client) setNamespace(ctx context.Context, req *pb.RunQueryRequest) {
+	if ns := c.ns(ctx); ns != "" {
+		req.PartitionId = &pb.PartitionId{Namespace: proto.String(ns)}
+	}
+}
+
+func (c *Client) callNext(ctx context.Context, req *pb.RunQueryRequest, res *pb.RunQueryResponse, offset, limit int32) error {
 	if res.GetBatch().EndCursor == nil {
 		return errors.New("datastore: internal error: server did not return a cursor")
 	}
@@ -456,7 +578,7 @@ func callNext(ctx context.Context, req *pb.RunQueryRequest, res *pb.RunQueryResp
 		req.Query.Offset = proto.Int32(offset)
 	}
 	res.Reset()
-	return call(ctx, "runQuery", req, res)
+	return c.call(ctx, "runQuery", req, res)
 }
 
 // GetAll runs the query in the given context and returns all keys that match
@@ -474,6 +596,10 @@ func callNext(ctx context.Context, req *pb.RunQueryRequest, res *pb.RunQueryResp
 //
 // If q is a ``keys-only'' query, GetAll ignores dst and only returns the keys.
 func (q *Query) GetAll(ctx context.Context, dst interface{}) ([]*Key, error) {
+	return clientFromContext(ctx).GetAll(ctx, q, dst)
+}
+
+func (c *Client) getAll(ctx context.Context, q *Query, dst interface{}) ([]*Key, error) {
 	var (
 		dv               reflect.Value
 		mat              multiArgType
@@ -493,7 +619,7 @@ func (q *Query) GetAll(ctx context.Context, dst interface{}) ([]*Key, error) {
 	}
 
 	var keys []*Key
-	for t := q.Run(ctx); ; {
+	for t := c.run(ctx, q); ; {
 		k, e, err := t.next()
 		if err == Done {
 			break
@@ -539,12 +665,21 @@ func (q *Query) GetAll(ctx context.Context, dst interface{}) ([]*Key, error) {
 	return keys, errFieldMismatch
 }
 
-// Run runs the query in the given context.
+// Run runs the query in the given context. It returns only entities in the
+// context's namespace; see WithNamespace.
 func (q *Query) Run(ctx context.Context) *Iterator {
+	return clientFromContext(ctx).Run(ctx, q)
+}
+
+func (c *Client) run(ctx context.Context, q *Query) *Iterator {
 	if q.err != nil {
 		return &Iterator{err: q.err}
 	}
+	if q.or != nil {
+		return c.runMerged(ctx, q)
+	}
 	t := &Iterator{
+		client: c,
 		ctx:    ctx,
 		limit:  q.limit,
 		q:      q,
@@ -555,16 +690,21 @@ func (q *Query) Run(ctx context.Context) *Iterator {
 		t.err = err
 		return t
 	}
-	if err := call(ctx, "runQuery", &t.req, &t.res); err != nil {
+	c.setNamespace(ctx, &t.req)
+	if err := c.call(ctx, "runQuery", &t.req, &t.res); err != nil {
 		t.err = err
 		return t
 	}
 	b := t.res.GetBatch()
+	if q.gql != nil {
+		// Any offset is in the GQL, and was applied by the datastore.
+		return t
+	}
 	offset := q.offset - b.GetSkippedResults()
 	for offset > 0 && b.GetMoreResults() == pb.QueryResultBatch_NOT_FINISHED {
 		t.prevCC = b.GetEndCursor()
 		var err error
-		if err = callNext(t.ctx, &t.req, &t.res, offset, t.limit); err != nil {
+		if err = c.callNext(t.ctx, &t.req, &t.res, offset, t.limit); err != nil {
 			t.err = err
 			break
 		}
@@ -583,8 +723,9 @@ func (q *Query) Run(ctx context.Context) *Iterator {
 
 // Iterator is the result of running a query.
 type Iterator struct {
-	ctx context.Context
-	err error
+	client *Client
+	ctx    context.Context
+	err    error
 	// req is the request we sent previously, we need to keep track of it to resend it
 	req pb.RunQueryRequest
 	// res is the result of the most recent RunQuery or Next API call.
@@ -599,6 +740,10 @@ type Iterator struct {
 	// prevCC is the compiled cursor that marks the end of the previous batch
 	// of results.
 	prevCC []byte
+	// merged is whether the query had Or or In filters, and so was run as
+	// several queries whose results were merged into results.
+	merged  bool
+	results []*pb.Entity
 }
 
 // Done is returned when a query iteration has completed.
@@ -626,6 +771,16 @@ func (t *Iterator) next() (*Key, *pb.Entity, error) {
 		return nil, nil, t.err
 	}
 
+	if t.merged {
+		if t.i == len(t.results) {
+			t.err = Done
+			return nil, nil, t.err
+		}
+		e := t.results[t.i]
+		t.i++
+		return protoToKey(e.Key), e, nil
+	}
+
 	// Issue datastore_v3/Next RPCs as necessary.
 	b := t.res.GetBatch()
 	for t.i == len(b.EntityResult) {
@@ -633,8 +788,12 @@ func (t *Iterator) next() (*Key, *pb.Entity, error) {
 			t.err = Done
 			return nil, nil, t.err
 		}
+		if t.q.gql != nil {
+			t.err = errGQLNextBatch
+			return nil, nil, t.err
+		}
 		t.prevCC = b.GetEndCursor()
-		if err := callNext(t.ctx, &t.req, &t.res, 0, t.limit); err != nil {
+		if err := t.client.callNext(t.ctx, &t.req, &t.res, 0, t.limit); err != nil {
 			t.err = err
 			return nil, nil, t.err
 		}
@@ -670,6 +829,9 @@ func (t *Iterator) Cursor() (Cursor, error) {
 	if t.err != nil && t.err != Done {
 		return Cursor{}, t.err
 	}
+	if t.merged {
+		return Cursor{}, errors.New("datastore: cursors cannot be used with Or or In filters")
+	}
 	// If we are at either end of the current batch of results,
 	// return the compiled cursor at that end.
 	b := t.res.Batch
@@ -690,6 +852,9 @@ func (t *Iterator) Cursor() (Cursor, error) {
 	if t.i == len(b.EntityResult) {
 		return Cursor{b.EndCursor}, nil
 	}
+	if t.q.gql != nil {
+		return Cursor{}, errors.New("datastore: a GQL query's cursor is only available at the end of a batch of results")
+	}
 	// Otherwise, re-run the query offset to this iterator's position, starting from
 	// the most recent compiled cursor. This is done on a best-effort basis, as it
 	// is racy; if a concurrent process has added or removed entities, then the
@@ -699,7 +864,7 @@ func (t *Iterator) Cursor() (Cursor, error) {
 	q.offset = skipped + int32(t.i)
 	q.limit = 0
 	q.keysOnly = len(q.projection) == 0
-	t1 := q.Run(t.ctx)
+	t1 := t.client.run(t.ctx, q)
 	_, _, err := t1.next()
 	if err != Done {
 		if err == nil {
@@ -16,14 +16,20 @@ package datastore
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
 	"google.golang.org/cloud"
+	"google.golang.org/cloud/internal"
 	pb "google.golang.org/cloud/internal/datastore"
 )
 
@@ -488,3 +494,384 @@ func TestFilterParser(t *testing.T) {
 		}
 	}
 }
+
+type Animal struct {
+	Name string
+	Legs int64
+	Tags []string
+	Home struct {
+		City string
+	} `datastore:",entity"`
+}
+
+func putAnimals(t *testing.T, ctx context.Context) {
+	animals := []*Animal{
+		{Name: "ant", Legs: 6, Tags: []string{"small"}},
+		{Name: "bird", Legs: 2, Tags: []string{"small", "flying"}},
+		{Name: "cat", Legs: 4},
+		{Name: "dog", Legs: 4, Tags: []string{"loud"}},
+		{Name: "eel", Legs: 0},
+	}
+	var keys []*Key
+	for _, a := range animals {
+		keys = append(keys, NewKey(ctx, "Animal", a.Name, 0, nil))
+	}
+	if _, err := PutMulti(ctx, keys, animals); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+}
+
+func animalNames(animals []*Animal) []string {
+	var s []string
+	for _, a := range animals {
+		s = append(s, a.Name)
+	}
+	return s
+}
+
+func TestTypedFilters(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	putAnimals(t, ctx)
+	q := NewQuery("Animal")
+
+	tests := []struct {
+		desc string
+		q    *Query
+		want []string
+	}{
+		{"Eq", q.Where(Eq("Legs", 4)), []string{"cat", "dog"}},
+		{"And", q.Where(And(Gt("Legs", 0), Le("Legs", 4))), []string{"bird", "cat", "dog"}},
+		{"KeyRange", q.Where(KeyRange(NewKey(ctx, "Animal", "bird", 0, nil), NewKey(ctx, "Animal", "dog", 0, nil))),
+			[]string{"bird", "cat"}},
+		{"In", q.Where(In("Legs", 2, 6)), []string{"ant", "bird"}},
+		{"In with order", q.Where(In("Legs", 2, 6, 0)).Order("-Legs"), []string{"ant", "bird", "eel"}},
+		{"Or removes duplicates", q.Where(Or(Eq("Tags", "small"), Lt("Legs", 4))).Order("Name"),
+			[]string{"ant", "bird", "eel"}},
+		{"Or of Ands", q.Where(Or(And(Eq("Legs", 4), Eq("Tags", "loud")), Eq("Legs", 0))),
+			[]string{"dog", "eel"}},
+		{"Or with offset and limit", q.Where(In("Legs", 0, 4, 6)).Order("Name").Offset(1).Limit(2),
+			[]string{"cat", "dog"}},
+		{"Ors AND'ed together", q.Where(In("Legs", 2, 4)).Where(In("Tags", "small", "loud")),
+			[]string{"bird", "dog"}},
+	}
+	for _, tc := range tests {
+		var got []*Animal
+		if _, err := tc.q.GetAll(ctx, &got); err != nil {
+			t.Errorf("%s: GetAll: %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(animalNames(got), tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.desc, animalNames(got), tc.want)
+		}
+	}
+
+	if n, err := q.Where(In("Tags", "small", "flying")).Count(ctx); n != 2 || err != nil {
+		t.Errorf("Count = %d, %v; want 2", n, err)
+	}
+	if _, err := q.Where(Or()).Count(ctx); err == nil {
+		t.Errorf("Count with empty Or succeeded")
+	}
+}
+
+func TestTypedQuery(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	putAnimals(t, ctx)
+	q := NewQuery("Animal").Typed(&Animal{})
+
+	for _, q := range []*Query{
+		q.Where(Eq("Legs", 4)),
+		q.Filter("Tags =", "small").Order("Name"),
+		q.Where(Eq("Home.City", "Paris")),
+		q.Order(keyFieldName),
+	} {
+		if _, err := q.GetAll(ctx, &[]*Animal{}); err != nil {
+			t.Errorf("GetAll(%+v): %v", q, err)
+		}
+	}
+	for _, q := range []*Query{
+		q.Where(Eq("Leggs", 4)),
+		q.Order("-Nmae"),
+		q.Project("Tag"),
+		q.Where(In("Nmae", "ant", "bird")),
+	} {
+		if _, err := q.GetAll(ctx, &[]*Animal{}); err == nil || !strings.Contains(err.Error(), "has no property") {
+			t.Errorf("GetAll(%+v): got %v, want an error about the property", q, err)
+		}
+	}
+	if q := NewQuery("Animal").Typed(3); q.err != ErrInvalidEntityType {
+		t.Errorf("Typed(3): got %v, want ErrInvalidEntityType", q.err)
+	}
+}
+
+func TestGQLQuery(t *testing.T) {
+	since := time.Unix(1e9, 0)
+	cursor := Cursor{[]byte("cursor")}
+	k := &Key{kind: "Gopher", id: 6}
+	q := NewGQLQuery("SELECT * FROM Gopher WHERE Name = @1 AND Height > @2 AND Born > @since AND __key__ != @k OFFSET @c",
+		"George", 3, GQLArg{Name: "since", Value: since}, GQLArg{Name: "k", Value: k}, GQLArg{Name: "c", Value: cursor})
+	want := &pb.RunQueryRequest{
+		GqlQuery: &pb.GqlQuery{
+			QueryString:  proto.String("SELECT * FROM Gopher WHERE Name = @1 AND Height > @2 AND Born > @since AND __key__ != @k OFFSET @c"),
+			AllowLiteral: proto.Bool(true),
+			NameArg: []*pb.GqlQueryArg{
+				{Name: proto.String("since"), Value: &pb.Value{TimestampMicrosecondsValue: proto.Int64(1e15)}},
+				{Name: proto.String("k"), Value: &pb.Value{KeyValue: key1}},
+				{Name: proto.String("c"), Cursor: []byte("cursor")},
+			},
+			NumberArg: []*pb.GqlQueryArg{
+				{Value: &pb.Value{StringValue: proto.String("George")}},
+				{Value: &pb.Value{IntegerValue: proto.Int64(3)}},
+			},
+		},
+	}
+
+	more := true
+	ctx := cloud.NewContext("queryTest", &http.Client{
+		Transport: &fakeTransport{Handler: func(in proto.Message, out proto.Message) error {
+			if !proto.Equal(in, want) {
+				return fmt.Errorf("got request %v, want %v", in, want)
+			}
+			res := out.(*pb.RunQueryResponse)
+			if err := fakeRunQuery(&pb.RunQueryRequest{Query: &pb.Query{
+				Kind: []*pb.KindExpression{{Name: proto.String("Gopher")}},
+			}}, res); err != nil {
+				return err
+			}
+			if more {
+				res.Batch.MoreResults = pb.QueryResultBatch_NOT_FINISHED.Enum()
+				res.Batch.EndCursor = []byte("end")
+			}
+			return nil
+		}}})
+
+	var got []Gopher
+	if _, err := q.GetAll(ctx, &got); err != errGQLNextBatch {
+		t.Errorf("GetAll of a query with more batches: got %v, want errGQLNextBatch", err)
+	}
+	it := q.Run(ctx)
+	for i := 0; i < 2; i++ {
+		if _, err := it.Next(nil); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+	if c, err := it.Cursor(); err != nil || string(c.cc) != "end" {
+		t.Errorf("Cursor = %q, %v; want the batch's end cursor", c.cc, err)
+	}
+
+	more = false
+	got = nil
+	if _, err := q.GetAll(ctx, &got); err != nil || len(got) != 2 || got[0].Name != "George" {
+		t.Errorf("GetAll = %+v, %v; want 2 gophers", got, err)
+	}
+	if n, err := q.Count(ctx); n != 2 || err != nil {
+		t.Errorf("Count = %d, %v; want 2", n, err)
+	}
+
+	for _, q := range []*Query{
+		q.Limit(3),
+		q.Filter("Name =", "George"),
+		NewGQLQuery("SELECT * FROM Gopher WHERE x = @1", make(chan int)),
+		NewGQLQuery("SELECT * FROM Gopher WHERE x = @x", GQLArg{Value: 1}),
+	} {
+		if _, err := q.Count(ctx); err == nil {
+			t.Errorf("Count(%+v) succeeded", q)
+		}
+	}
+}
+
+func TestQueryNamespace(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	nsCtx := WithNamespace(ctx, "ns")
+	for _, c := range []context.Context{ctx, ctx, nsCtx} {
+		if _, err := Put(c, NewIncompleteKey(c, "Counter", nil), &counter{}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	// Queries without an ancestor are limited to the context's namespace.
+	for _, tc := range []struct {
+		ctx  context.Context
+		ns   string
+		want int
+	}{
+		{ctx, "", 2},
+		{nsCtx, "ns", 1},
+		{WithNamespace(ctx, "empty"), "empty", 0},
+	} {
+		q := NewQuery("Counter")
+		if n, err := q.Count(tc.ctx); n != tc.want || err != nil {
+			t.Errorf("Count in namespace %q = %d, %v; want %d", tc.ns, n, err, tc.want)
+		}
+		keys, err := q.KeysOnly().GetAll(tc.ctx, nil)
+		if err != nil || len(keys) != tc.want {
+			t.Errorf("GetAll in namespace %q = %d keys, %v; want %d", tc.ns, len(keys), err, tc.want)
+		}
+		for _, k := range keys {
+			if k.Namespace() != tc.ns {
+				t.Errorf("GetAll in namespace %q returned key %v", tc.ns, k)
+			}
+		}
+	}
+
+	// A client's queries are in its default namespace, unless the context
+	// has one.
+	c, err := NewClient(ctx, "proj", WithHTTPClient(internal.HTTPClient(ctx)), WithDefaultNamespace("ns"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if n, err := c.Count(ctx, NewQuery("Counter")); n != 1 || err != nil {
+		t.Errorf("Client.Count = %d, %v; want 1", n, err)
+	}
+	if n, err := c.Count(WithNamespace(ctx, "empty"), NewQuery("Counter")); n != 0 || err != nil {
+		t.Errorf("Client.Count with a context namespace = %d, %v; want 0", n, err)
+	}
+}
+
+func TestSplitQuery(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	const total = 200
+	var keys []*Key
+	var counters []*counter
+	for i := 0; i < total; i++ {
+		keys = append(keys, NewKey(ctx, "Counter", "", int64(i+1), nil))
+		counters = append(counters, &counter{N: int64(i % 2)})
+	}
+	if _, err := PutMulti(ctx, keys, counters); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	q := NewQuery("Counter")
+	points, err := q.SplitPoints(ctx, 4)
+	if err != nil {
+		t.Fatalf("SplitPoints: %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("SplitPoints returned %d keys, want 3", len(points))
+	}
+	qs := q.Filter("N =", 1).SplitAt(points)
+	var mu sync.Mutex
+	seen := make(map[int64]int)
+	sizes := make([]int, len(qs))
+	err = RunSplits(ctx, qs, func(i int, it *Iterator) error {
+		for {
+			var c counter
+			k, err := it.Next(&c)
+			if err == Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			seen[k.ID()]++
+			sizes[i]++
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("RunSplits: %v", err)
+	}
+	if len(seen) != total/2 {
+		t.Errorf("got %d distinct entities, want %d", len(seen), total/2)
+	}
+	for id, n := range seen {
+		if n != 1 || id%2 != 0 {
+			t.Errorf("entity %d seen %d times, want once, and only for even IDs", id, n)
+		}
+	}
+	for i, n := range sizes {
+		if n == 0 {
+			t.Errorf("split %d is empty; sizes are %v", i, sizes)
+		}
+	}
+
+	// A split can be resumed from a cursor.
+	it := qs[1].Run(ctx)
+	if _, err := it.Next(nil); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatalf("Cursor: %v", err)
+	}
+	n, err := qs[1].Start(c).Count(ctx)
+	if err != nil || n != sizes[1]-1 {
+		t.Errorf("Count after cursor = %d, %v; want %d", n, err, sizes[1]-1)
+	}
+
+	// Errors are reported for each split.
+	err = RunSplits(ctx, qs, func(i int, it *Iterator) error {
+		if i == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if me, ok := err.(MultiError); !ok || me[2] == nil || me[0] != nil {
+		t.Errorf("RunSplits with a failing split returned %v, want a MultiError for split 2", err)
+	}
+
+	if points, err := q.SplitPoints(ctx, 1); points != nil || err != nil {
+		t.Errorf("SplitPoints(1) = %v, %v; want no points", points, err)
+	}
+	for _, q := range []*Query{
+		NewQuery(""),
+		NewQuery("Counter").Filter("N >", 0),
+		NewQuery("Counter").Order("N"),
+		NewQuery("Counter").Limit(10),
+	} {
+		if _, err := q.SplitPoints(ctx, 4); err == nil {
+			t.Errorf("SplitPoints of %+v succeeded", q)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	putAnimals(t, ctx)
+	other := WithNamespace(ctx, "other")
+	mixed := []interface{}{
+		&PropertyList{{Name: "X", Value: int64(1)}, {Name: "T", Value: time.Unix(1, 0)}},
+		&PropertyList{{Name: "X", Value: "one"}, {Name: "K", Value: NewKey(ctx, "Animal", "ant", 0, nil)}, {Name: "B", Value: []byte("x"), NoIndex: true}},
+	}
+	keys := []*Key{NewIncompleteKey(other, "Mixed", nil), NewIncompleteKey(other, "Mixed", nil)}
+	if _, err := PutMulti(other, keys, mixed); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	if got, err := Namespaces(ctx); err != nil || !reflect.DeepEqual(got, []string{"", "other"}) {
+		t.Errorf("Namespaces = %q, %v; want [\"\" other]", got, err)
+	}
+	if got, err := Kinds(ctx); err != nil || !reflect.DeepEqual(got, []string{"Animal"}) {
+		t.Errorf("Kinds = %q, %v; want [Animal]", got, err)
+	}
+	if got, err := Kinds(other); err != nil || !reflect.DeepEqual(got, []string{"Mixed"}) {
+		t.Errorf("Kinds in namespace other = %q, %v; want [Mixed]", got, err)
+	}
+
+	got, err := KindProperties(ctx, "Animal")
+	want := map[string][]string{
+		"Legs": {"INT64"},
+		"Name": {"STRING"},
+		"Tags": {"STRING"},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("KindProperties(Animal) = %v, %v; want %v", got, err, want)
+	}
+	got, err = KindProperties(other, "Mixed")
+	want = map[string][]string{
+		"K": {"REFERENCE"},
+		"T": {"INT64"},
+		"X": {"INT64", "STRING"},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("KindProperties(Mixed) = %v, %v; want %v", got, err, want)
+	}
+	if got, err := KindProperties(ctx, "Mixed"); err != nil || len(got) != 0 {
+		t.Errorf("KindProperties(Mixed) in the default namespace = %v, %v; want none", got, err)
+	}
+}
@@ -15,9 +15,11 @@
 package datastore
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -31,6 +33,11 @@ func saveEntity(key *Key, src interface{}) (*pb.Entity, error) {
 	if e, ok := src.(PropertyLoadSaver); ok {
 		props, err = e.Save()
 	} else {
+		if b, ok := src.(BeforeSaver); ok {
+			if err := b.BeforeSave(); err != nil {
+				return nil, err
+			}
+		}
 		props, err = SaveStruct(src)
 	}
 	if err != nil {
@@ -46,6 +53,18 @@ func saveStructProperty(props *[]Property, name string, noIndex, multiple bool,
 		Multiple: multiple,
 	}
 
+	if m, ok := valueMarshaler(v); ok {
+		if m != nil {
+			x, err := m.MarshalPropertyValue()
+			if err != nil {
+				return err
+			}
+			p.Value = x
+		}
+		*props = append(*props, p)
+		return nil
+	}
+
 	switch x := v.Interface().(type) {
 	case *Key, time.Time:
 		p.Value = x
@@ -102,9 +121,32 @@ func (s structPLS) save(props *[]Property, prefix string, noIndex, multiple bool
 		if !v.IsValid() || !v.CanSet() {
 			continue
 		}
+		if t.omitEmpty && isEmptyValue(v) {
+			continue
+		}
 		noIndex1 := noIndex || t.noIndex
+		if t.json {
+			b, err := json.Marshal(v.Interface())
+			if err != nil {
+				return fmt.Errorf("datastore: field %q: %v", name, err)
+			}
+			*props = append(*props, Property{Name: name, Value: b, NoIndex: true, Multiple: multiple})
+			continue
+		}
+		if t.flatten && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				continue
+			}
+			v = v.Elem()
+		}
+		if t.entity {
+			if err := saveEntityField(props, name, noIndex1, multiple, v); err != nil {
+				return err
+			}
+			continue
+		}
 		// For slice fields that aren't []byte, save each element.
-		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 && !isValueMarshaler(v.Type()) {
 			for j := 0; j < v.Len(); j++ {
 				if err := saveStructProperty(props, name, noIndex1, true, v.Index(j)); err != nil {
 					return err
@@ -120,6 +162,129 @@ func (s structPLS) save(props *[]Property, prefix string, noIndex, multiple bool
 	return nil
 }
 
+// valueMarshaler returns the PropertyValueMarshaler for v, if v or its address
+// implements the interface. It returns a nil marshaler for a nil pointer.
+func valueMarshaler(v reflect.Value) (PropertyValueMarshaler, bool) {
+	if m, ok := v.Interface().(PropertyValueMarshaler); ok {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil, true
+		}
+		return m, true
+	}
+	if v.CanAddr() {
+		m, ok := v.Addr().Interface().(PropertyValueMarshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
+// isEmptyValue returns whether v is the zero value of its type, an empty
+// slice or map, or a zero time.Time, for the "omitempty" option.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t.IsZero()
+		}
+	}
+	return false
+}
+
+// saveEntityField saves a field with the "entity" option as embedded entity
+// values, one for each element if the field is a slice.
+func saveEntityField(props *[]Property, name string, noIndex, multiple bool, v reflect.Value) error {
+	vals := []reflect.Value{v}
+	if v.Kind() == reflect.Slice {
+		vals, multiple = nil, true
+		for j := 0; j < v.Len(); j++ {
+			vals = append(vals, v.Index(j))
+		}
+	}
+	for _, v := range vals {
+		e, err := toEntity(v, noIndex)
+		if err != nil {
+			return err
+		}
+		p := Property{
+			Name:     name,
+			NoIndex:  true, // Embedded entities cannot be indexed; their properties can.
+			Multiple: multiple,
+		}
+		if e != nil {
+			p.Value = e
+		}
+		*props = append(*props, p)
+	}
+	return nil
+}
+
+// toEntity converts a struct, struct pointer or map[string]interface{} to an
+// embedded entity. A nil pointer or map becomes a nil *Entity.
+func toEntity(v reflect.Value, noIndex bool) (*Entity, error) {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Map {
+		if v.IsNil() {
+			return nil, nil
+		}
+	}
+	if v.Kind() == reflect.Map {
+		return mapToEntity(v.Interface().(map[string]interface{}), noIndex)
+	}
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	codec, err := getStructCodec(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	e := &Entity{}
+	if err := (structPLS{v, codec}).save(&e.Properties, "", noIndex, false); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// mapToEntity converts a map to an embedded entity. Nested maps become nested
+// embedded entities, and []interface{} values become multiple properties.
+// Keys are sorted, so that saving the same map gives the same entity.
+func mapToEntity(m map[string]interface{}, noIndex bool) (*Entity, error) {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e := &Entity{}
+	for _, name := range names {
+		vals, multiple := []interface{}{m[name]}, false
+		if x, ok := m[name].([]interface{}); ok {
+			vals, multiple = x, true
+		}
+		for _, val := range vals {
+			p := Property{Name: name, Value: val, NoIndex: noIndex, Multiple: multiple}
+			if x, ok := val.(map[string]interface{}); ok {
+				sub, err := mapToEntity(x, noIndex)
+				if err != nil {
+					return nil, err
+				}
+				p.Value, p.NoIndex = sub, true
+			}
+			e.Properties = append(e.Properties, p)
+		}
+	}
+	return e, nil
+}
+
 func propertiesToProto(key *Key, props []Property) (*pb.Entity, error) {
 	e := &pb.Entity{
 		Key: keyToProto(key),
@@ -127,10 +292,20 @@ func propertiesToProto(key *Key, props []Property) (*pb.Entity, error) {
 	indexedProps := 0
 	prevMultiple := make(map[string]*pb.Property)
 	for _, p := range props {
+		var sub *pb.Entity
+		if e, ok := p.Value.(*Entity); ok {
+			var err error
+			if sub, err = propertiesToProto(e.Key, e.Properties); err != nil {
+				return nil, err
+			}
+			// Embedded entities are never indexed themselves.
+			p.NoIndex, p.Value = true, nil
+		}
 		val, err := interfaceToProto(p.Value)
 		if err != "" {
 			return nil, fmt.Errorf("datastore: %s for a Property with Name %q", err, p.Name)
 		}
+		val.EntityValue = sub
 		if !p.NoIndex {
 			rVal := reflect.ValueOf(p.Value)
 			if rVal.Kind() == reflect.Slice && rVal.Type().Elem().Kind() != reflect.Uint8 {
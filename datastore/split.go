@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// scatterFieldName is the name of a property that the datastore gives
+	// a random sample of entities, so that sorting by it samples a kind.
+	scatterFieldName = "__scatter__"
+
+	// scatterOversampling is how many keys are sampled for each split point,
+	// to even out the sizes of the splits.
+	scatterOversampling = 32
+)
+
+// SplitPoints returns up to n-1 keys that split the entities of q's kind into
+// n ranges of about the same size, using the datastore's "__scatter__" sample
+// of the kind. Pass them to SplitAt to make the queries for those ranges.
+// Fewer keys are returned for small kinds.
+//
+// The keys can be saved, for example with Key.Encode, so that a job resuming
+// from per-split cursors splits its query the same way again.
+//
+// q must have a kind, and must not have inequality filters, sort orders,
+// Or or In filters, cursors, an offset or a limit.
+func (q *Query) SplitPoints(ctx context.Context, n int) ([]*Key, error) {
+	return clientFromContext(ctx).SplitPoints(ctx, q, n)
+}
+
+func (c *Client) splitPoints(ctx context.Context, q *Query, n int) ([]*Key, error) {
+	switch {
+	case q.err != nil:
+		return nil, q.err
+	case n < 1:
+		return nil, errors.New("datastore: SplitPoints needs at least one split")
+	case q.kind == "":
+		return nil, errors.New("datastore: cannot split a kindless query")
+	case q.gql != nil:
+		return nil, errors.New("datastore: cannot split a GQL query")
+	case len(q.order) > 0, q.or != nil, q.start != nil, q.end != nil, q.offset != 0, q.limit >= 0:
+		return nil, errors.New("datastore: cannot split a query with sort orders, Or or In filters, cursors, an offset or a limit")
+	}
+	for _, f := range q.filter {
+		if f.Op != equal {
+			return nil, errors.New("datastore: cannot split a query with inequality filters")
+		}
+	}
+	if n == 1 {
+		return nil, nil
+	}
+
+	sample := NewQuery(q.kind).Order(scatterFieldName).KeysOnly().Limit((n - 1) * scatterOversampling)
+	keys, err := c.getAll(ctx, sample, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Sort(byKey(keys))
+	var points []*Key
+	for i := 1; i < n; i++ {
+		k := keys[i*len(keys)/n]
+		if len(points) == 0 || !points[len(points)-1].Equal(k) {
+			points = append(points, k)
+		}
+	}
+	return points, nil
+}
+
+// byKey sorts keys in the datastore's order.
+type byKey []*Key
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return compareKeys(keyToProto(b[i]), keyToProto(b[j])) < 0 }
+
+// SplitAt returns len(points)+1 derivative queries, each limited to the
+// entities whose keys fall in one of the ranges between the sorted keys in
+// points. Together they return the same entities as q, with no overlap.
+func (q *Query) SplitAt(points []*Key) []*Query {
+	qs := make([]*Query, len(points)+1)
+	var start *Key
+	for i := range qs {
+		var end *Key
+		if i < len(points) {
+			end = points[i]
+		}
+		qs[i] = q.Where(KeyRange(start, end))
+		start = end
+	}
+	return qs
+}
+
+// RunSplits runs the queries qs concurrently, usually the splits of a larger
+// query made by SplitAt. It calls f from a separate goroutine for each query,
+// with the query's index and an iterator over its results, which f reads
+// with Next. To be able to resume a failed job, f can record the iterator's
+// Cursor after each result; a new job resumes query i with qs[i].Start(c).
+//
+// RunSplits returns once every call to f has returned. If any of them return
+// an error, RunSplits returns a MultiError holding each of their errors.
+func RunSplits(ctx context.Context, qs []*Query, f func(i int, it *Iterator) error) error {
+	return clientFromContext(ctx).RunSplits(ctx, qs, f)
+}
+
+func (c *Client) runSplits(ctx context.Context, qs []*Query, f func(i int, it *Iterator) error) error {
+	errs := make(MultiError, len(qs))
+	var wg sync.WaitGroup
+	for i, q := range qs {
+		wg.Add(1)
+		go func(i int, q *Query) {
+			defer wg.Done()
+			errs[i] = f(i, c.run(ctx, q))
+		}(i, q)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
@@ -30,17 +30,34 @@ var ErrConcurrentTransaction = errors.New("datastore: concurrent transaction")
 
 var errExpiredTransaction = errors.New("datastore: transaction expired")
 
-// A TransactionOption configures the Transaction returned by NewTransaction.
+var errReadOnlyTransaction = errors.New("datastore: write in a read-only transaction")
+
+// A TransactionOption configures the Transaction returned by NewTransaction,
+// or those made by RunInTransaction.
 type TransactionOption interface {
-	apply(*pb.BeginTransactionRequest)
+	apply(*transactionSettings)
+}
+
+type transactionSettings struct {
+	req      pb.BeginTransactionRequest
+	attempts int
+	readOnly bool
+}
+
+func newTransactionSettings(opts []TransactionOption) *transactionSettings {
+	s := &transactionSettings{}
+	for _, o := range opts {
+		o.apply(s)
+	}
+	return s
 }
 
 type isolation struct {
 	level pb.BeginTransactionRequest_IsolationLevel
 }
 
-func (i isolation) apply(req *pb.BeginTransactionRequest) {
-	req.IsolationLevel = i.level.Enum()
+func (i isolation) apply(s *transactionSettings) {
+	s.req.IsolationLevel = i.level.Enum()
 }
 
 var (
@@ -50,6 +67,31 @@ var (
 	Serializable TransactionOption = isolation{pb.BeginTransactionRequest_SERIALIZABLE}
 )
 
+type readOnly struct{}
+
+func (readOnly) apply(s *transactionSettings) { s.readOnly = true }
+
+// ReadOnly causes the transaction to only permit reads. Its Put and Delete
+// methods return errors, and committing it never conflicts with other
+// transactions, as it is rolled back rather than committed.
+var ReadOnly TransactionOption = readOnly{}
+
+// MaxAttempts returns a TransactionOption that sets how many times
+// RunInTransaction tries to run a transaction before giving up.
+// The default is 3, or that of a Client's retry policy.
+// It has no effect on NewTransaction.
+func MaxAttempts(n int) TransactionOption {
+	return maxAttempts(n)
+}
+
+type maxAttempts int
+
+func (n maxAttempts) apply(s *transactionSettings) {
+	if n > 0 {
+		s.attempts = int(n)
+	}
+}
+
 // Transaction represents a set of datastore operations to be committed atomically.
 //
 // Operations are enqueued by calling the Put and Delete methods on Transaction
@@ -61,33 +103,108 @@ var (
 // A Transaction must be committed or rolled back exactly once.
 type Transaction struct {
 	id       []byte
+	client   *Client
 	ctx      context.Context
+	readOnly bool
 	mutation *pb.Mutation  // The mutations to apply.
-	pending  []*PendingKey // Incomplete keys pending transaction completion.
+	pending  []*PendingKey // Keys pending transaction completion; incomplete ones have no key yet.
 }
 
 // NewTransaction starts a new transaction.
 func NewTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
-	req, resp := &pb.BeginTransactionRequest{}, &pb.BeginTransactionResponse{}
-	for _, o := range opts {
-		o.apply(req)
-	}
-	if err := call(ctx, "beginTransaction", req, resp); err != nil {
+	return clientFromContext(ctx).NewTransaction(ctx, opts...)
+}
+
+func (c *Client) newTransaction(ctx context.Context, s *transactionSettings) (*Transaction, error) {
+	resp := &pb.BeginTransactionResponse{}
+	if err := c.call(ctx, "beginTransaction", &s.req, resp); err != nil {
 		return nil, err
 	}
 
 	return &Transaction{
 		id:       resp.Transaction,
+		client:   c,
 		ctx:      ctx,
+		readOnly: s.readOnly,
 		mutation: &pb.Mutation{},
 	}, nil
 }
 
+// RunInTransaction runs f in a transaction. It calls f with a transaction
+// handle tx that f should use for all datastore operations.
+//
+// If f returns nil, RunInTransaction commits the transaction, returning the
+// Commit and a nil error if it succeeds. If the commit fails because of a
+// conflicting transaction, or f returns such an error, either
+// ErrConcurrentTransaction or one from a read made with tx that conflicted,
+// RunInTransaction waits and retries f with a new transaction. It tries up to
+// the number of times set by MaxAttempts, waiting twice as long before each
+// retry, and returns ErrConcurrentTransaction if every attempt conflicts.
+//
+// If f returns any other error, or panics, the transaction is rolled back,
+// and RunInTransaction returns that error or continues panicking.
+//
+// As f may be called several times, it should usually be idempotent.
+func RunInTransaction(ctx context.Context, f func(tx *Transaction) error, opts ...TransactionOption) (*Commit, error) {
+	return clientFromContext(ctx).RunInTransaction(ctx, f, opts...)
+}
+
+func (c *Client) runInTransaction(ctx context.Context, f func(tx *Transaction) error, opts []TransactionOption) (*Commit, error) {
+	s := newTransactionSettings(opts)
+	if s.attempts == 0 {
+		s.attempts = c.retry.MaxAttempts
+	}
+	backoff := c.retry.InitialBackoff
+	for i := 0; i < s.attempts; i++ {
+		if i > 0 {
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+		}
+		tx, err := c.newTransaction(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.run(f); err != nil {
+			tx.Rollback()
+			if IsContention(err) {
+				continue
+			}
+			return nil, err
+		}
+		commit, err := tx.Commit()
+		if IsContention(err) {
+			continue
+		}
+		return commit, err
+	}
+	return nil, ErrConcurrentTransaction
+}
+
+// run calls f with t, rolling t back if f panics.
+func (t *Transaction) run(f func(tx *Transaction) error) error {
+	defer func() {
+		if x := recover(); x != nil {
+			t.Rollback()
+			panic(x)
+		}
+	}()
+	return f(t)
+}
+
 // Commit applies the enqueued operations atomically.
+// A read-only transaction has no operations, and is rolled back instead.
 func (t *Transaction) Commit() (*Commit, error) {
 	if t.id == nil {
 		return nil, errExpiredTransaction
 	}
+	if t.readOnly {
+		if err := t.Rollback(); err != nil {
+			return nil, err
+		}
+		return &Commit{}, nil
+	}
 	req := &pb.CommitRequest{
 		Transaction: t.id,
 		Mutation:    t.mutation,
@@ -95,29 +212,72 @@ func (t *Transaction) Commit() (*Commit, error) {
 	}
 	t.id = nil
 	resp := &pb.CommitResponse{}
-	if err := call(t.ctx, "commit", req, resp); err != nil {
-		if e, ok := err.(*errHTTP); ok && e.StatusCode == http.StatusConflict {
-			// TODO(jbd): Make sure that we explicitly handle the case where response
-			// has an HTTP 409 and the error message indicates that it's an concurrent
-			// transaction error.
-			return nil, ErrConcurrentTransaction
+	if err := t.client.call(t.ctx, "commit", req, resp); err != nil {
+		if e, ok := err.(*Error); ok {
+			if mayConflict(e, req.Mutation) {
+				if kerr := t.client.keyConflict(t.ctx, req.Mutation); kerr != nil {
+					return nil, kerr
+				}
+			}
+			if e.StatusCode == http.StatusConflict {
+				return nil, ErrConcurrentTransaction
+			}
 		}
 		return nil, err
 	}
+	t.client.uncache(t.ctx, mutationKeys(req.Mutation))
 
 	// Copy any newly minted keys into the returned keys.
-	if len(t.pending) != len(resp.MutationResult.InsertAutoIdKey) {
+	newKeys := resp.MutationResult.InsertAutoIdKey
+	incomplete := 0
+	for _, p := range t.pending {
+		if p.key == nil {
+			incomplete++
+		}
+	}
+	if incomplete != len(newKeys) {
 		return nil, errors.New("datastore: internal error: server returned the wrong number of keys")
 	}
 	commit := &Commit{}
-	for i, p := range t.pending {
-		p.key = protoToKey(resp.MutationResult.InsertAutoIdKey[i])
+	for _, p := range t.pending {
+		if p.key == nil {
+			p.key, newKeys = protoToKey(newKeys[0]), newKeys[1:]
+		}
 		p.commit = commit
 	}
 
 	return commit, nil
 }
 
+// keyConflict looks up the keys of m's inserts and updates, after a commit of
+// m failed, and returns ErrAlreadyExists if an inserted entity exists, or
+// ErrNoSuchEntity if an updated one does not. It returns nil if neither is so,
+// or the lookup fails, in which case the commit failed for some other reason.
+func (c *Client) keyConflict(ctx context.Context, m *pb.Mutation) error {
+	var keys []*Key
+	for _, e := range m.Insert {
+		keys = append(keys, protoToKey(e.Key))
+	}
+	for _, e := range m.Update {
+		keys = append(keys, protoToKey(e.Key))
+	}
+	found, err := c.lookupExisting(ctx, keys)
+	if err != nil {
+		return nil
+	}
+	for _, e := range m.Insert {
+		if found[protoToKey(e.Key).String()] {
+			return ErrAlreadyExists
+		}
+	}
+	for _, e := range m.Update {
+		if !found[protoToKey(e.Key).String()] {
+			return ErrNoSuchEntity
+		}
+	}
+	return nil
+}
+
 // Rollback abandons a pending transaction.
 func (t *Transaction) Rollback() error {
 	if t.id == nil {
@@ -125,7 +285,7 @@ func (t *Transaction) Rollback() error {
 	}
 	id := t.id
 	t.id = nil
-	return call(t.ctx, "rollback", &pb.RollbackRequest{Transaction: id}, &pb.RollbackResponse{})
+	return t.client.call(t.ctx, "rollback", &pb.RollbackRequest{Transaction: id}, &pb.RollbackResponse{})
 }
 
 // Get is the transaction-specific version of the package function Get.
@@ -134,7 +294,7 @@ func (t *Transaction) Rollback() error {
 // level, another transaction cannot concurrently modify the data that is read
 // or modified by this transaction.
 func (t *Transaction) Get(key *Key, dst interface{}) error {
-	err := get(t.ctx, []*Key{key}, []interface{}{dst}, &pb.ReadOptions{Transaction: t.id})
+	err := t.client.get(t.ctx, []*Key{key}, []interface{}{dst}, &pb.ReadOptions{Transaction: t.id})
 	if me, ok := err.(MultiError); ok {
 		return me[0]
 	}
@@ -146,7 +306,7 @@ func (t *Transaction) GetMulti(keys []*Key, dst interface{}) error {
 	if t.id == nil {
 		return errExpiredTransaction
 	}
-	return get(t.ctx, keys, dst, &pb.ReadOptions{Transaction: t.id})
+	return t.client.get(t.ctx, keys, dst, &pb.ReadOptions{Transaction: t.id})
 }
 
 // Put is the transaction-specific version of the package function Put.
@@ -169,10 +329,51 @@ func (t *Transaction) Put(key *Key, src interface{}) (*PendingKey, error) {
 // PutMulti is a batch version of Put. One PendingKey is returned for each
 // element of src in the same order.
 func (t *Transaction) PutMulti(keys []*Key, src interface{}) ([]*PendingKey, error) {
+	return t.putMulti(upsert, keys, src)
+}
+
+// Insert is the transaction-specific version of the package function Insert.
+// If an entity is already stored for key, Commit returns ErrAlreadyExists.
+func (t *Transaction) Insert(key *Key, src interface{}) (*PendingKey, error) {
+	h, err := t.InsertMulti([]*Key{key}, []interface{}{src})
+	if err != nil {
+		if me, ok := err.(MultiError); ok {
+			return nil, me[0]
+		}
+		return nil, err
+	}
+	return h[0], nil
+}
+
+// InsertMulti is a batch version of Insert.
+func (t *Transaction) InsertMulti(keys []*Key, src interface{}) ([]*PendingKey, error) {
+	return t.putMulti(insert, keys, src)
+}
+
+// Update is the transaction-specific version of the package function Update.
+// If no entity is stored for key, Commit returns ErrNoSuchEntity.
+func (t *Transaction) Update(key *Key, src interface{}) error {
+	err := t.UpdateMulti([]*Key{key}, []interface{}{src})
+	if me, ok := err.(MultiError); ok {
+		return me[0]
+	}
+	return err
+}
+
+// UpdateMulti is a batch version of Update.
+func (t *Transaction) UpdateMulti(keys []*Key, src interface{}) error {
+	_, err := t.putMulti(update, keys, src)
+	return err
+}
+
+func (t *Transaction) putMulti(mode putMode, keys []*Key, src interface{}) ([]*PendingKey, error) {
 	if t.id == nil {
 		return nil, errExpiredTransaction
 	}
-	mutation, err := putMutation(keys, src)
+	if t.readOnly {
+		return nil, errReadOnlyTransaction
+	}
+	mutation, err := putMutation(mode, keys, src)
 	if err != nil {
 		return nil, err
 	}
@@ -180,15 +381,14 @@ func (t *Transaction) PutMulti(keys []*Key, src interface{}) ([]*PendingKey, err
 
 	// Prepare the returned handles, pre-populating where possible.
 	ret := make([]*PendingKey, len(keys))
-	for _, key := range keys {
+	for i, key := range keys {
 		h := &PendingKey{}
-		if key.Incomplete() {
-			// This key will be in the final commit result.
-			t.pending = append(t.pending, h)
-		} else {
+		if !key.Incomplete() {
 			h.key = key
 		}
-		ret = append(ret, h)
+		// Incomplete keys will be in the final commit result.
+		t.pending = append(t.pending, h)
+		ret[i] = h
 	}
 	return ret, nil
 }
@@ -209,6 +409,9 @@ func (t *Transaction) DeleteMulti(keys []*Key) error {
 	if t.id == nil {
 		return errExpiredTransaction
 	}
+	if t.readOnly {
+		return errReadOnlyTransaction
+	}
 	mutation, err := deleteMutation(keys)
 	if err != nil {
 		return err
@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/datastore/dstest"
+	"google.golang.org/cloud/internal"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+type counter struct {
+	N int64
+}
+
+func newTestServer(t *testing.T) (context.Context, func()) {
+	srv, err := dstest.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return srv.NewContext("proj"), srv.Close
+}
+
+func init() {
+	defaultRetryPolicy.InitialBackoff = time.Millisecond
+}
+
+func TestRunInTransactionRetries(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	k := NewKey(ctx, "Counter", "c", 0, nil)
+	if _, err := Put(ctx, k, &counter{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	attempts := 0
+	_, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		attempts++
+		var c counter
+		if err := tx.Get(k, &c); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// A write outside the transaction makes the first commit conflict.
+			if _, err := Put(ctx, k, &counter{N: 10}); err != nil {
+				return err
+			}
+		}
+		c.N++
+		_, err := tx.Put(k, &c)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	var c counter
+	if err := Get(ctx, k, &c); err != nil || c.N != 11 {
+		t.Errorf("Get = %+v, %v; want N=11", c, err)
+	}
+
+	// Conflicts on every attempt exhaust MaxAttempts.
+	attempts = 0
+	_, err = RunInTransaction(ctx, func(tx *Transaction) error {
+		attempts++
+		return ErrConcurrentTransaction
+	}, MaxAttempts(4))
+	if err != ErrConcurrentTransaction {
+		t.Errorf("RunInTransaction: got %v, want ErrConcurrentTransaction", err)
+	}
+	if attempts != 4 {
+		t.Errorf("got %d attempts, want 4", attempts)
+	}
+}
+
+// conflictTransport fails the next conflicts transactional lookups
+// with an HTTP 409, as the service does when a transaction loses the
+// contention for an entity it reads, and passes other requests to base.
+type conflictTransport struct {
+	base      http.RoundTripper
+	conflicts int
+}
+
+func (t *conflictTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.conflicts > 0 && strings.HasSuffix(req.URL.Path, "/lookup") {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var in pb.LookupRequest
+		if err := proto.Unmarshal(body, &in); err != nil {
+			return nil, err
+		}
+		if in.GetReadOptions().GetTransaction() != nil {
+			t.conflicts--
+			return &http.Response{
+				StatusCode: http.StatusConflict,
+				Body:       ioutil.NopCloser(strings.NewReader("too much contention on these datastore entities")),
+				Request:    req,
+			}, nil
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+func TestRunInTransactionReadConflict(t *testing.T) {
+	srvCtx, done := newTestServer(t)
+	defer done()
+	ctx := cloud.NewContext("proj", &http.Client{
+		Transport: &conflictTransport{base: internal.HTTPClient(srvCtx).Transport, conflicts: 1},
+	})
+	k := NewKey(ctx, "Counter", "c", 0, nil)
+	if _, err := Put(ctx, k, &counter{N: 1}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	attempts := 0
+	_, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		attempts++
+		var c counter
+		if err := tx.Get(k, &c); err != nil {
+			return err
+		}
+		c.N++
+		_, err := tx.Put(k, &c)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	var c counter
+	if err := Get(ctx, k, &c); err != nil || c.N != 2 {
+		t.Errorf("Get = %+v, %v; want N=2", c, err)
+	}
+}
+
+func TestRunInTransactionRollback(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	k := NewKey(ctx, "Counter", "c", 0, nil)
+
+	wantErr := errors.New("failed")
+	_, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		if _, err := tx.Put(k, &counter{N: 1}); err != nil {
+			return err
+		}
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("RunInTransaction: got %v, want %v", err, wantErr)
+	}
+	var c counter
+	if err := Get(ctx, k, &c); err != ErrNoSuchEntity {
+		t.Errorf("Get after failed transaction: got %v, want ErrNoSuchEntity", err)
+	}
+
+	var tx *Transaction
+	func() {
+		defer func() {
+			if x := recover(); x != "boom" {
+				t.Errorf("recovered %v, want boom", x)
+			}
+		}()
+		RunInTransaction(ctx, func(t *Transaction) error {
+			tx = t
+			panic("boom")
+		})
+	}()
+	if _, err := tx.Commit(); err != errExpiredTransaction {
+		t.Errorf("Commit after panic: got %v, want errExpiredTransaction", err)
+	}
+}
+
+func TestReadOnlyTransaction(t *testing.T) {
+	ctx, done := newTestServer(t)
+	defer done()
+	k := NewKey(ctx, "Counter", "c", 0, nil)
+	if _, err := Put(ctx, k, &counter{N: 5}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, err := RunInTransaction(ctx, func(tx *Transaction) error {
+		var c counter
+		if err := tx.Get(k, &c); err != nil {
+			return err
+		}
+		if _, err := tx.Put(k, &c); err != errReadOnlyTransaction {
+			t.Errorf("Put: got %v, want errReadOnlyTransaction", err)
+		}
+		if err := tx.Delete(k); err != errReadOnlyTransaction {
+			t.Errorf("Delete: got %v, want errReadOnlyTransaction", err)
+		}
+		// A concurrent write does not make a read-only transaction fail.
+		_, err := Put(ctx, k, &counter{N: 6})
+		return err
+	}, ReadOnly, Snapshot)
+	if err != nil {
+		t.Errorf("RunInTransaction: %v", err)
+	}
+}